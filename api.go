@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// registerAPI adds the query endpoints, which answer from the in-memory
+// topology, next to the websocket on mux.
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/segments", serveSegments)
+	mux.HandleFunc("/trace", serveTrace)
+	mux.HandleFunc("/reachability", serveReachability)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println("ERROR: API RESPONSE", err)
+	}
+}
+
+// serveSegments lists the broadcast domains, or with ?device=<ns>:<index>
+// the one the device is in.
+func serveSegments(w http.ResponseWriter, r *http.Request) {
+	node := r.URL.Query().Get("device")
+	if node == "" {
+		writeJSON(w, topology.Segments())
+		return
+	}
+	s := topology.SegmentOf(node)
+	if s == nil {
+		http.Error(w, "no segment for "+node, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// serveTrace follows a packet from ?source=<namespace>[:<device>] to
+// ?destination=<ip>, see devices.Topology.Trace.
+func serveTrace(w http.ResponseWriter, r *http.Request) {
+	dst := net.ParseIP(r.URL.Query().Get("destination"))
+	if dst == nil {
+		http.Error(w, "destination must be an IP address", http.StatusBadRequest)
+		return
+	}
+	tr, err := topology.Trace(r.URL.Query().Get("source"), dst)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, tr)
+}
+
+// serveReachability returns the reachability matrix, or with ?from=<ns>&to=<ns>
+// the entry of one pair.
+func serveReachability(w http.ResponseWriter, r *http.Request) {
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" && to == "" {
+		writeJSON(w, topology.ReachabilityMatrix())
+		return
+	}
+	reach := topology.Reachability(from, to)
+	if reach == nil {
+		http.Error(w, "no reachability computed from "+from+" to "+to, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, reach)
+}
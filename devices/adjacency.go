@@ -0,0 +1,209 @@
+package devices
+
+import (
+	"net"
+)
+
+// The L3 adjacency layer places the gateways of routes: the device owning
+// a gateway address is the next hop of the route, and a "routes-via" edge
+// links the outgoing device of the route to it.
+
+// resolveGateway fills in where the gateway of p lives and reports whether
+// it moved. Addresses are not unique across namespaces, so owners in
+// namespaces n is connected to, or in n itself, are preferred.
+func (t *Topology) resolveGateway(n *Namespace, p *RouteNexthop) bool {
+	namespace, index := "", 0
+	if p.gw != nil {
+		if owner, i := t.GatewayOwner(n, p.gw); owner != nil {
+			namespace, index = owner.Name, i
+		}
+	}
+	t.lockState()
+	defer t.unlockState()
+	moved := p.GatewayNamespace != namespace || p.GatewayIndex != index
+	p.GatewayNamespace, p.GatewayIndex = namespace, index
+	return moved
+}
+
+// GatewayOwner returns the namespace and the index of the device owning
+// gw, a gateway of a route of n, preferring neighbours of n.
+func (t *Topology) GatewayOwner(n *Namespace, gw net.IP) (*Namespace, int) {
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	return t.gatewayOwner(n, gw)
+}
+
+// gatewayOwner is GatewayOwner for callers holding stateLock.
+func (t *Topology) gatewayOwner(n *Namespace, gw net.IP) (*Namespace, int) {
+	var fallback *Namespace
+	var fallbackIndex int
+	for _, peer := range t.Namespaces {
+		for index, d := range peer.L3Devices {
+			l3, ok := d.(*L3Device)
+			if !ok {
+				continue
+			}
+			for _, addr := range l3.ip {
+				if !addr.IP.Equal(gw) {
+					continue
+				}
+				if peer == n || n.connectedTo(peer.Name) {
+					return peer, index
+				}
+				if fallback == nil {
+					fallback, fallbackIndex = peer, index
+				}
+			}
+		}
+	}
+	return fallback, fallbackIndex
+}
+
+// connectedTo reports whether a device of n is linked to one of namespace.
+// Connections are keyed by the "namespace:index" of the peer device.
+func (n *Namespace) connectedTo(namespace string) bool {
+	for peer := range n.Connections {
+		if nodeNamespace(peer) == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveGateway places the gateway of a single path route, see
+// Topology.resolveGateway.
+func (r *Route) resolveGateway(t *Topology, n *Namespace) bool {
+	namespace, index := "", 0
+	if r.route.Gw != nil {
+		if owner, i := t.GatewayOwner(n, r.route.Gw); owner != nil {
+			namespace, index = owner.Name, i
+		}
+	}
+	t.lockState()
+	defer t.unlockState()
+	moved := r.GatewayNamespace != namespace || r.GatewayIndex != index
+	r.GatewayNamespace, r.GatewayIndex = namespace, index
+	return moved
+}
+
+// Paths returns the paths of r, the one it has or each of a multipath
+// route or nexthop object.
+func (r *Route) Paths() []*RouteNexthop {
+	if len(r.Nexthops) != 0 || r.NexthopID != 0 {
+		return r.Nexthops
+	}
+	return []*RouteNexthop{{
+		Gateway:          r.Gateway,
+		OutputIndex:      r.OutputIndex,
+		OutputInterface:  r.OutputInterface,
+		Weight:           1,
+		GatewayNamespace: r.GatewayNamespace,
+		GatewayIndex:     r.GatewayIndex,
+		gw:               r.route.Gw,
+	}}
+}
+
+// gatewaysChanged tells every namespace that the owner of addr changed.
+// Requests made while one is pending are merged into it.
+func (t *Topology) gatewaysChanged(addr net.IP) {
+	for _, n := range t.namespaceList() {
+		n.gatewayLock.Lock()
+		n.pendingGateways[addr.String()] = addr
+		n.gatewayLock.Unlock()
+		select {
+		case n.gatewayChannel <- true:
+		default:
+		}
+	}
+}
+
+// GatewayChanges is signalled when the owner of an address changed. The
+// route listener of n, which owns its routes, answers with
+// ResolveGateways.
+func (n *Namespace) GatewayChanges() <-chan bool {
+	return n.gatewayChannel
+}
+
+// ResolveGateways places again the gateways of the routes and nexthop
+// objects of n that are among the addresses changed since the last call,
+// and updates the routes-via edges of n when one moved.
+func (n *Namespace) ResolveGateways() {
+	n.gatewayLock.Lock()
+	changed := n.pendingGateways
+	n.pendingGateways = make(map[string]net.IP)
+	n.gatewayLock.Unlock()
+	matches := func(gw net.IP) bool {
+		return gw != nil && changed[gw.String()] != nil
+	}
+
+	t := n.topology
+	t.stateLock.RLock()
+	nexthops := make([]*Nexthop, 0, len(n.Nexthops))
+	for _, nh := range n.Nexthops {
+		if matches(nh.gw) {
+			nexthops = append(nexthops, nh)
+		}
+	}
+	t.stateLock.RUnlock()
+	moved, nexthopsMoved := false, false
+	for _, nh := range nexthops {
+		if t.resolveGateway(n, &nh.RouteNexthop) {
+			nexthopsMoved = true
+		}
+	}
+	for _, r := range n.Routes {
+		if matches(r.route.Gw) && r.resolveGateway(t, n) {
+			moved = true
+		}
+		if r.NexthopID != 0 {
+			continue
+		}
+		for _, p := range r.Nexthops {
+			if matches(p.gw) && t.resolveGateway(n, p) {
+				moved = true
+			}
+		}
+	}
+	if nexthopsMoved {
+		t.lockState()
+		for _, r := range n.Routes {
+			if r.NexthopID != 0 {
+				r.Nexthops = n.NexthopPaths(r.NexthopID)
+			}
+		}
+		t.unlockState()
+		moved = true
+	}
+	if moved {
+		t.updateRouteEdges(n)
+	}
+}
+
+// updateRouteEdges adds a routes-via edge for every path of a route of n
+// whose gateway is placed, and removes those of n no route needs anymore.
+func (t *Topology) updateRouteEdges(n *Namespace) {
+	want := make(map[Edge]bool)
+	for _, r := range n.Routes {
+		for _, p := range r.Paths() {
+			if p.GatewayNamespace == "" || p.OutputIndex == 0 {
+				continue
+			}
+			e := Edge{
+				Kind: EdgeRoutesVia,
+				From: getNSIndex(n.Name, p.OutputIndex),
+				To:   getNSIndex(p.GatewayNamespace, p.GatewayIndex),
+			}
+			if e.From != e.To {
+				want[e] = true
+			}
+		}
+	}
+	for _, e := range t.Edges() {
+		if e.Kind == EdgeRoutesVia && nodeNamespace(e.From) == n.Name && !want[e] {
+			t.RemoveEdge(e)
+		}
+	}
+	for e := range want {
+		t.AddEdge(e)
+	}
+}
@@ -0,0 +1,232 @@
+package devices
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+type L2BondEvent int
+
+// bondIota follows the events of bridges, which bonds share the L2 event
+// space with.
+const bondIota int = 22
+
+const (
+	L2BondCreate L2BondEvent = iota + L2BondEvent(bondIota)
+	L2BondDelete
+	L2BondAddMember
+	L2BondRemoveMember
+	L2BondMemberChange
+	L2BondFailover
+)
+
+var L2BondEventStrings = []string{
+	"L2BondCreate",
+	"L2BondDelete",
+	"L2BondAddMember",
+	"L2BondRemoveMember",
+	"L2BondMemberChange",
+	"L2BondFailover",
+}
+
+func (e L2BondEvent) String() string {
+	for i, str := range L2BondEventStrings {
+		if i == int(e-L2BondEvent(bondIota)) {
+			return str
+		}
+	}
+	return ""
+}
+
+// Bond callbacks get the index of the member an event is about, nil for
+// L2BondCreate and L2BondDelete.
+var defaultL2BondSubscriber []func(*L2Bond, L2BondEvent, interface{})
+
+func SubscribeAllL2BondEvents(callback func(*L2Bond, L2BondEvent, interface{})) {
+	defaultL2BondSubscriber = append(defaultL2BondSubscriber, callback)
+}
+
+// BondMember is the state the bond driver reports for one of its slaves.
+type BondMember struct {
+	Index            int    `json:"index"`
+	State            string `json:"state"`
+	MiiStatus        string `json:"miiStatus"`
+	LinkFailureCount uint32 `json:"linkFailureCount"`
+}
+
+// L2Bond is a bond or team master. Team devices are configured through
+// teamd over generic netlink, so only their members are known; Mode and
+// ActiveSlave are only reported for bonds.
+type L2Bond struct {
+	*L2Device
+	Kind            string              `json:"kind"`
+	Mode            string              `json:"mode"`
+	ActiveSlave     int                 `json:"activeSlave"`
+	Members         map[int]*BondMember `json:"members"`
+	onchange        map[L2BondEvent][]func(*L2Bond, L2BondEvent, interface{})
+	linkInfoChannel *chan netlink.Link
+}
+
+func NewL2Bond(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) *L2Bond {
+	defaultFunction := func(dev *L2Bond, change L2BondEvent, item interface{}) {
+		t := make(map[string]interface{})
+		t["name"] = dev.Index
+		t["ns"] = dev.Namespace
+		t["mode"] = dev.Mode
+		t["activeSlave"] = dev.ActiveSlave
+		if index, ok := item.(int); ok {
+			t["member"] = dev.Members[index]
+		}
+		t["bondEvent"] = change.String()
+		switch change {
+		case L2BondCreate:
+			t["event"] = "create"
+		case L2BondDelete:
+			t["event"] = "delete"
+		default:
+			t["event"] = "update"
+		}
+		dumper.Encode(t)
+	}
+	onChange := make(map[L2BondEvent][]func(*L2Bond, L2BondEvent, interface{}))
+	if consoleDisplay {
+		for i, _ := range L2BondEventStrings {
+			onChange[L2BondEvent(i)] = append(onChange[L2BondEvent(i)], defaultFunction)
+		}
+	}
+	for i, _ := range L2BondEventStrings {
+		onChange[L2BondEvent(i)] = append(onChange[L2BondEvent(i)], defaultL2BondSubscriber...)
+	}
+	linkInfo := make(chan netlink.Link)
+	bond := &L2Bond{
+		L2Device:        NewL2Device(update, t, namespace, consoleDisplay),
+		Kind:            update.Type(),
+		Members:         make(map[int]*BondMember),
+		onchange:        onChange,
+		linkInfoChannel: &linkInfo,
+	}
+	if b, ok := linkOf(update).(*netlink.Bond); ok {
+		bond.Mode = b.Mode.String()
+		if b.ActiveSlave > 0 {
+			bond.ActiveSlave = b.ActiveSlave
+		}
+	}
+	bond.CreateDevice()
+	return bond
+}
+
+func (dev *L2Bond) fireChangeEvents(change L2BondEvent, item interface{}) {
+	for _, f := range dev.onchange[change-L2BondEvent(bondIota)] {
+		f(dev, change, item)
+	}
+}
+
+func (dev *L2Bond) CreateDevice() {
+	dev.fireChangeEvents(L2BondCreate, nil)
+}
+
+func (dev *L2Bond) DeleteDevice() {
+	dev.L2Device.DeleteDevice()
+	dev.fireChangeEvents(L2BondDelete, nil)
+}
+
+func (dev *L2Bond) linkInfo() *chan netlink.Link {
+	return dev.linkInfoChannel
+}
+
+func (dev *L2Bond) AddMember(devIndex int) {
+	if _, ok := dev.Members[devIndex]; ok {
+		return
+	}
+	dev.Members[devIndex] = &BondMember{Index: devIndex}
+	dev.fireChangeEvents(L2BondAddMember, devIndex)
+}
+
+func (dev *L2Bond) RemoveMember(devIndex int) {
+	if _, ok := dev.Members[devIndex]; !ok {
+		return
+	}
+	dev.fireChangeEvents(L2BondRemoveMember, devIndex)
+	delete(dev.Members, devIndex)
+	if dev.ActiveSlave == devIndex {
+		dev.SetActiveSlave(0)
+	}
+}
+
+// SetActiveSlave records the member now carrying traffic and fires
+// L2BondFailover when it replaces another one.
+func (dev *L2Bond) SetActiveSlave(devIndex int) {
+	if dev.ActiveSlave == devIndex {
+		return
+	}
+	dev.ActiveSlave = devIndex
+	dev.fireChangeEvents(L2BondFailover, devIndex)
+}
+
+// updateLinkInfo applies the bond attributes of the bond itself or the
+// slave attributes of one of its members.
+func (dev *L2Bond) updateLinkInfo(link netlink.Link) {
+	if link.Attrs().Index == dev.Index {
+		if b, ok := link.(*netlink.Bond); ok {
+			dev.Mode = b.Mode.String()
+			if b.ActiveSlave > 0 {
+				dev.SetActiveSlave(b.ActiveSlave)
+			}
+		}
+		return
+	}
+	slave, ok := link.Attrs().Slave.(*netlink.BondSlave)
+	if !ok {
+		return
+	}
+	index := link.Attrs().Index
+	dev.AddMember(index)
+	m := dev.Members[index]
+	state, mii := slave.State.String(), slave.MiiStatus.String()
+	if m.State != state || m.MiiStatus != mii || m.LinkFailureCount != slave.LinkFailureCount {
+		m.State = state
+		m.MiiStatus = mii
+		m.LinkFailureCount = slave.LinkFailureCount
+		dev.fireChangeEvents(L2BondMemberChange, index)
+	}
+	// Every member of a load balancing bond is active, only an active-backup
+	// bond has a single active slave to fail over from.
+	if slave.State == netlink.BondStateActive && dev.Mode == netlink.BOND_MODE_ACTIVE_BACKUP.String() {
+		dev.SetActiveSlave(index)
+	}
+}
+
+func (dev *L2Bond) ReceiveLinkUpdate() {
+	for {
+		select {
+		case m := <-*(dev.flagsChannel):
+			dev.SetFlags(m.flags, m.operState)
+		case m := <-*(dev.setMasterChannel):
+			if m.devIndex == dev.Index {
+				if m.masterIndex != 0 {
+					dev.SetMaster(m.masterIndex)
+				} else {
+					dev.UnsetMaster()
+				}
+			} else if m.masterIndex != 0 {
+				dev.AddMember(m.devIndex)
+			} else {
+				dev.RemoveMember(m.devIndex)
+			}
+		case l := <-*(dev.linkInfoChannel):
+			dev.updateLinkInfo(l)
+		case reply := <-*(dev.snapshotChannel):
+			reply <- marshalDevice(dev.topology, dev)
+		case d := <-*(dev.dumpChannel):
+			if d {
+				dumper.Encode(dev)
+				*(dev.dumpChannel) <- true
+			}
+		case d := <-*(dev.deleteChannel):
+			if d {
+				return
+			}
+		case n := <-*(dev.nameChannel):
+			dev.SetName(n)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package devices
 
 import (
 	"net"
+	"sort"
+	"time"
 
 	"github.com/vishvananda/netlink"
 )
@@ -20,6 +22,16 @@ const (
 	L2BridgeDelete
 	L2BridgeAddPort
 	L2BridgeRemovePort
+	L2BridgeFdbLearn
+	L2BridgeFdbMove
+	L2BridgeFdbAge
+	L2BridgeVlanFiltering
+	L2BridgePortVlans
+	L2BridgeStp
+	L2BridgePortState
+	L2BridgeMulticast
+	L2BridgeMdbJoin
+	L2BridgeMdbLeave
 )
 
 var L2BridgeEventStrings = []string{
@@ -27,6 +39,16 @@ var L2BridgeEventStrings = []string{
 	"L2BridgeDelete",
 	"L2BridgeAddPort",
 	"L2BridgeDeletePort",
+	"L2BridgeFdbLearn",
+	"L2BridgeFdbMove",
+	"L2BridgeFdbAge",
+	"L2BridgeVlanFiltering",
+	"L2BridgePortVlans",
+	"L2BridgeStp",
+	"L2BridgePortState",
+	"L2BridgeMulticast",
+	"L2BridgeMdbJoin",
+	"L2BridgeMdbLeave",
 }
 
 func (e L2BridgeEvent) String() string {
@@ -38,30 +60,287 @@ func (e L2BridgeEvent) String() string {
 	return ""
 }
 
+// Bridge callbacks get the item an event is about: the *FdbEntry of FDB
+// events, the *MdbEntry of MDB events, and the port index of
+// L2BridgePortVlans and L2BridgePortState. It is nil otherwise.
+var defaultL2BridgeSubscriber []func(L2Bridge, L2BridgeEvent, interface{})
+
+func SubscribeAllL2BridgeEvents(callback func(L2Bridge, L2BridgeEvent, interface{})) {
+	defaultL2BridgeSubscriber = append(defaultL2BridgeSubscriber, callback)
+}
+
 type L2Bridge struct {
 	*L2Device
-	Ports         map[int]int
-	onchange      map[L2BridgeEvent][]func(dev L2Bridge, event L2BridgeEvent)
-	masterChannel *chan l2DeviceMasterEvent
-	BridgeEvent   string `json:"bridge_event"`
+	Ports map[int]int
+	// PortNames maps the index of each port to the name it is best known
+	// by, see Namespace.DeviceLabel.
+	PortNames map[int]string `json:"portNames"`
+	// Fdb is the forwarding database of the bridge, see FdbEntry.key.
+	Fdb map[string]*FdbEntry `json:"fdb"`
+	// PortVlans holds the VLANs of each port, and of the bridge itself
+	// under its own index.
+	VlanFiltering bool                 `json:"vlanFiltering"`
+	DefaultPVID   int                  `json:"defaultPvid"`
+	PortVlans     map[int][]BridgeVlan `json:"portVlans"`
+	// StpMode is "disabled", "kernel" or "user". BridgeID and RootID are
+	// formatted as priority.mac, RootPort is the port number of the root
+	// port, 0 when the bridge is the root.
+	StpMode      string                 `json:"stpMode"`
+	BridgeID     string                 `json:"bridgeId"`
+	RootID       string                 `json:"rootId"`
+	RootPort     int                    `json:"rootPort"`
+	RootPathCost int                    `json:"rootPathCost"`
+	PortStp      map[int]*BridgePortStp `json:"portStp"`
+	// Mdb is the multicast database of the bridge, see MdbEntry.key.
+	Multicast       BridgeMulticast      `json:"multicast"`
+	Mdb             map[string]*MdbEntry `json:"mdb"`
+	stateChannel    *chan bridgeState
+	onchange        map[L2BridgeEvent][]func(dev L2Bridge, event L2BridgeEvent, item interface{})
+	masterChannel   *chan l2DeviceMasterEvent
+	fdbChannel      *chan fdbUpdate
+	fdbQueryChannel *chan fdbQuery
+	mdbChannel      *chan mdbUpdate
+	// viewChannel hands a copy of the port state to other goroutines, see
+	// L2Bridge.view.
+	viewChannel *chan chan bridgeView
+	BridgeEvent string `json:"bridge_event"`
 }
 
 func (dev *L2Bridge) AddPort(devIndex int) {
 	dev.Ports[len(dev.Ports)] = devIndex
-	dev.fireChangeEvents(L2BridgeAddPort)
+	dev.fireChangeEvents(L2BridgeAddPort, nil)
 }
 
 func (dev *L2Bridge) RemovePort(devIndex int) {
 	for index, value := range dev.Ports {
 		if value == devIndex {
 			delete(dev.Ports, index)
-			dev.fireChangeEvents(L2BridgeRemovePort)
+			delete(dev.PortVlans, devIndex)
+			delete(dev.PortStp, devIndex)
+			dev.fireChangeEvents(L2BridgeRemovePort, nil)
+		}
+	}
+}
+
+// LearnFdb records e, firing L2BridgeFdbMove when the MAC was known on
+// another port and L2BridgeFdbLearn when it is new.
+func (dev *L2Bridge) LearnFdb(e *FdbEntry) {
+	key := e.key()
+	old, ok := dev.Fdb[key]
+	dev.Fdb[key] = e
+	if !ok {
+		dev.fireChangeEvents(L2BridgeFdbLearn, e)
+	} else if old.Port != e.Port {
+		dev.fireChangeEvents(L2BridgeFdbMove, e)
+	}
+}
+
+// AgeFdb forgets e, which the kernel aged out or which was removed.
+func (dev *L2Bridge) AgeFdb(e *FdbEntry) {
+	key := e.key()
+	if _, ok := dev.Fdb[key]; !ok {
+		return
+	}
+	delete(dev.Fdb, key)
+	dev.fireChangeEvents(L2BridgeFdbAge, e)
+}
+
+// Lookup returns the FDB entries of mac, one per VLAN it was learned in. A
+// bridge that does not answer, because it is being deleted, knows no entries.
+func (dev *L2Bridge) Lookup(mac string) []*FdbEntry {
+	reply := make(chan []*FdbEntry, 1)
+	select {
+	case *dev.fdbQueryChannel <- fdbQuery{mac, reply}:
+	case <-time.After(deviceQueryTimeout):
+		return []*FdbEntry{}
+	}
+	return <-reply
+}
+
+func (dev *L2Bridge) lookup(mac string) []*FdbEntry {
+	entries := make([]*FdbEntry, 0)
+	for _, e := range dev.Fdb {
+		if e.MAC == mac && !e.Self {
+			entries = append(entries, e)
 		}
 	}
+	return entries
+}
+
+// bridgeView is a copy of the ports of a bridge with their VLANs and
+// spanning tree state, and of its FDB by MAC, which only the bridge
+// goroutine may read.
+type bridgeView struct {
+	filtering bool
+	ports     []int
+	vlans     map[int][]BridgeVlan
+	stp       map[int]BridgePortStp
+	fdb       map[string][]FdbEntry
+}
+
+// lookup returns the FDB entries of mac, see L2Bridge.Lookup.
+func (v bridgeView) lookup(mac string) []FdbEntry {
+	return v.fdb[mac]
+}
+
+// view returns a copy of the port state and FDB of the bridge. A bridge
+// that does not answer, because it is being deleted, has no ports.
+func (dev *L2Bridge) view() bridgeView {
+	reply := make(chan bridgeView, 1)
+	select {
+	case *dev.viewChannel <- reply:
+	case <-time.After(deviceQueryTimeout):
+		return bridgeView{}
+	}
+	return <-reply
+}
+
+func (dev *L2Bridge) copyView() bridgeView {
+	v := bridgeView{
+		filtering: dev.VlanFiltering,
+		ports:     make([]int, 0, len(dev.Ports)),
+		vlans:     make(map[int][]BridgeVlan, len(dev.PortVlans)),
+		stp:       make(map[int]BridgePortStp, len(dev.PortStp)),
+		fdb:       make(map[string][]FdbEntry),
+	}
+	for _, e := range dev.Fdb {
+		if !e.Self {
+			v.fdb[e.MAC] = append(v.fdb[e.MAC], *e)
+		}
+	}
+	for _, port := range dev.Ports {
+		v.ports = append(v.ports, port)
+	}
+	sort.Ints(v.ports)
+	for port, vlans := range dev.PortVlans {
+		v.vlans[port] = append([]BridgeVlan(nil), vlans...)
+	}
+	for port, stp := range dev.PortStp {
+		v.stp[port] = *stp
+	}
+	return v
+}
+
+// SetVlans applies the VLAN state read from the kernel, firing
+// L2BridgeVlanFiltering when the bridge settings changed and
+// L2BridgePortVlans for every port whose VLANs changed.
+func (dev *L2Bridge) SetVlans(state bridgeState) {
+	changed := false
+	if dev.VlanFiltering != state.filtering || dev.DefaultPVID != state.defaultPvid {
+		changed = true
+		dev.VlanFiltering = state.filtering
+		dev.DefaultPVID = state.defaultPvid
+		dev.fireChangeEvents(L2BridgeVlanFiltering, nil)
+	}
+	members := map[int]bool{dev.Index: true}
+	for _, port := range dev.Ports {
+		members[port] = true
+	}
+	for port := range members {
+		vlans, ok := state.ports[port]
+		if !ok {
+			if _, known := dev.PortVlans[port]; known {
+				delete(dev.PortVlans, port)
+				dev.fireChangeEvents(L2BridgePortVlans, port)
+				changed = true
+			}
+			continue
+		}
+		if old, known := dev.PortVlans[port]; known && bridgeVlansEqual(old, vlans) {
+			continue
+		}
+		dev.PortVlans[port] = vlans
+		dev.fireChangeEvents(L2BridgePortVlans, port)
+		changed = true
+	}
+	for port := range dev.PortVlans {
+		if !members[port] {
+			delete(dev.PortVlans, port)
+			dev.fireChangeEvents(L2BridgePortVlans, port)
+			changed = true
+		}
+	}
+	if changed && dev.topology != nil {
+		dev.topology.bridgeSegmentsChanged(getNSIndex(dev.Namespace, dev.Index))
+	}
+}
+
+// SetStp applies the spanning tree state read from the kernel, firing
+// L2BridgeStp when the mode or the root changed and L2BridgePortState for
+// every port whose state, priority or cost changed. A port attached while
+// STP runs starts out listening or blocking, consumers should wait for
+// "forwarding" before treating it as connected.
+func (dev *L2Bridge) SetStp(state bridgeState) {
+	if dev.StpMode != state.stpMode || dev.BridgeID != state.bridgeID || dev.RootID != state.rootID ||
+		dev.RootPort != state.rootPort || dev.RootPathCost != state.rootPathCost {
+		dev.StpMode = state.stpMode
+		dev.BridgeID = state.bridgeID
+		dev.RootID = state.rootID
+		dev.RootPort = state.rootPort
+		dev.RootPathCost = state.rootPathCost
+		dev.fireChangeEvents(L2BridgeStp, nil)
+	}
+	for _, port := range dev.Ports {
+		stp, ok := state.stp[port]
+		if !ok {
+			continue
+		}
+		if old, known := dev.PortStp[port]; known && *old == *stp {
+			continue
+		}
+		dev.PortStp[port] = stp
+		dev.fireChangeEvents(L2BridgePortState, port)
+	}
+}
+
+// SetMulticast applies the snooping configuration read from the kernel.
+func (dev *L2Bridge) SetMulticast(state bridgeState) {
+	if dev.Multicast == state.multicast {
+		return
+	}
+	dev.Multicast = state.multicast
+	dev.fireChangeEvents(L2BridgeMulticast, nil)
+}
+
+// JoinMdb records that the port of e joined its group.
+func (dev *L2Bridge) JoinMdb(e *MdbEntry) {
+	key := e.key()
+	if old, ok := dev.Mdb[key]; ok && *old == *e {
+		return
+	}
+	dev.Mdb[key] = e
+	dev.fireChangeEvents(L2BridgeMdbJoin, e)
+}
+
+// LeaveMdb forgets e, after its port left the group or the membership
+// timed out.
+func (dev *L2Bridge) LeaveMdb(e *MdbEntry) {
+	key := e.key()
+	if _, ok := dev.Mdb[key]; !ok {
+		return
+	}
+	delete(dev.Mdb, key)
+	dev.fireChangeEvents(L2BridgeMdbLeave, e)
+}
+
+// SyncMdb makes the MDB of dev entries, forgetting those not among them.
+func (dev *L2Bridge) SyncMdb(entries []*MdbEntry) {
+	keys := make(map[string]bool)
+	for _, e := range entries {
+		keys[e.key()] = true
+	}
+	for key, e := range dev.Mdb {
+		if !keys[key] {
+			dev.LeaveMdb(e)
+		}
+	}
+	for _, e := range entries {
+		dev.JoinMdb(e)
+	}
 }
 
 func NewL2Bridge(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) *L2Bridge {
-	defaultFunction := func(dev L2Bridge, change L2BridgeEvent) {
+	defaultFunction := func(dev L2Bridge, change L2BridgeEvent, item interface{}) {
 		getKeys := func(m map[int]int) []int {
 			t := make([]int, 0)
 			for _, value := range m {
@@ -75,6 +354,30 @@ func NewL2Bridge(update netlink.Link, t *Topology, namespace string, consoleDisp
 		t["indexName"] = "device1"
 		t["ns"] = dev.Namespace
 		t["connections"] = getKeys(dev.Ports)
+		t["portNames"] = dev.PortNames
+		switch change {
+		case L2BridgeFdbLearn, L2BridgeFdbMove, L2BridgeFdbAge:
+			t["fdb"] = item
+		case L2BridgeVlanFiltering:
+			t["vlanFiltering"] = dev.VlanFiltering
+			t["defaultPvid"] = dev.DefaultPVID
+		case L2BridgePortVlans:
+			t["port"] = item
+			t["vlans"] = dev.PortVlans[item.(int)]
+		case L2BridgeStp:
+			t["stpMode"] = dev.StpMode
+			t["bridgeId"] = dev.BridgeID
+			t["rootId"] = dev.RootID
+			t["rootPort"] = dev.RootPort
+			t["rootPathCost"] = dev.RootPathCost
+		case L2BridgePortState:
+			t["port"] = item
+			t["stp"] = dev.PortStp[item.(int)]
+		case L2BridgeMulticast:
+			t["multicast"] = dev.Multicast
+		case L2BridgeMdbJoin, L2BridgeMdbLeave:
+			t["mdb"] = item
+		}
 		switch change {
 		case L2BridgeCreate:
 			t["event"] = "create"
@@ -85,34 +388,76 @@ func NewL2Bridge(update netlink.Link, t *Topology, namespace string, consoleDisp
 		}
 		dumper.Encode(t)
 	}
-	onChange := make(map[L2BridgeEvent][]func(dev L2Bridge, change L2BridgeEvent))
+	onChange := make(map[L2BridgeEvent][]func(dev L2Bridge, change L2BridgeEvent, item interface{}))
 	if consoleDisplay {
 		for i, _ := range L2BridgeEventStrings {
 			onChange[L2BridgeEvent(i)] = append(onChange[L2BridgeEvent(i)], defaultFunction)
 		}
 	}
+	for i, _ := range L2BridgeEventStrings {
+		onChange[L2BridgeEvent(i)] = append(onChange[L2BridgeEvent(i)], defaultL2BridgeSubscriber...)
+	}
+	fdbChannel := make(chan fdbUpdate)
+	fdbQueryChannel := make(chan fdbQuery)
+	stateChannel := make(chan bridgeState)
+	mdbChannel := make(chan mdbUpdate)
+	viewChannel := make(chan chan bridgeView)
 	l2br := &L2Bridge{
-		L2Device: NewL2Device(update, t, namespace, consoleDisplay),
-		Ports:    make(map[int]int),
-		onchange: onChange,
+		L2Device:        NewL2Device(update, t, namespace, consoleDisplay),
+		Ports:           make(map[int]int),
+		Fdb:             make(map[string]*FdbEntry),
+		onchange:        onChange,
+		fdbChannel:      &fdbChannel,
+		fdbQueryChannel: &fdbQueryChannel,
+		PortVlans:       make(map[int][]BridgeVlan),
+		PortStp:         make(map[int]*BridgePortStp),
+		stateChannel:    &stateChannel,
+		Mdb:             make(map[string]*MdbEntry),
+		mdbChannel:      &mdbChannel,
+		viewChannel:     &viewChannel,
 	}
 	l2br.CreateDevice()
 	return l2br
 }
 
-func (dev *L2Bridge) fireChangeEvents(change L2BridgeEvent) {
+// labelPorts refreshes PortNames. Taps learn their owner after they were
+// enslaved, so names are looked up again before every event and dump.
+func (dev *L2Bridge) labelPorts() {
+	names := make(map[int]string, len(dev.Ports))
+	if dev.topology == nil {
+		dev.PortNames = names
+		return
+	}
+	if n := dev.topology.Get(dev.Namespace); n != nil {
+		dev.topology.stateLock.RLock()
+		for _, port := range dev.Ports {
+			names[port] = n.DeviceLabel(port)
+		}
+		dev.topology.stateLock.RUnlock()
+	}
+	dev.PortNames = names
+}
+
+func (dev *L2Bridge) fireChangeEvents(change L2BridgeEvent, item interface{}) {
+	dev.labelPorts()
 	for _, f := range dev.onchange[change-L2BridgeEvent(bridgeIota)] {
-		f(*dev, change)
+		f(*dev, change, item)
+	}
+	switch change {
+	case L2BridgeVlanFiltering, L2BridgePortVlans, L2BridgePortState:
+		if dev.topology != nil {
+			dev.topology.reachabilityChanged(dev.Namespace)
+		}
 	}
 }
 
 func (dev *L2Bridge) CreateDevice() {
-	dev.fireChangeEvents(L2BridgeCreate)
+	dev.fireChangeEvents(L2BridgeCreate, nil)
 }
 
 func (dev *L2Bridge) DeleteDevice() {
 	dev.L2Device.DeleteDevice()
-	dev.fireChangeEvents(L2BridgeDelete)
+	dev.fireChangeEvents(L2BridgeDelete, nil)
 }
 
 func (dev *L2Bridge) ReceiveLinkUpdate() {
@@ -126,8 +471,33 @@ func (dev *L2Bridge) ReceiveLinkUpdate() {
 			} else {
 				dev.RemovePort(m.devIndex)
 			}
+		case f := <-*(dev.fdbChannel):
+			if f.add {
+				dev.LearnFdb(f.entry)
+			} else {
+				dev.AgeFdb(f.entry)
+			}
+		case s := <-*(dev.stateChannel):
+			dev.SetVlans(s)
+			dev.SetStp(s)
+			dev.SetMulticast(s)
+		case m := <-*(dev.mdbChannel):
+			if m.entries != nil {
+				dev.SyncMdb(m.entries)
+			} else if m.add {
+				dev.JoinMdb(m.entry)
+			} else {
+				dev.LeaveMdb(m.entry)
+			}
+		case q := <-*(dev.fdbQueryChannel):
+			q.reply <- dev.lookup(q.mac)
+		case reply := <-*(dev.viewChannel):
+			reply <- dev.copyView()
+		case reply := <-*(dev.snapshotChannel):
+			reply <- marshalDevice(dev.topology, dev)
 		case d := <-*(dev.dumpChannel):
 			if d {
+				dev.labelPorts()
 				dumper.Encode(dev)
 				*(dev.dumpChannel) <- true
 			}
@@ -0,0 +1,227 @@
+package devices
+
+import (
+	"fmt"
+	"sort"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// IFLA_BR_* attributes of the bridge link info, which the netlink package
+// only partially decodes.
+const (
+	iflaBrStpState        = 5
+	iflaBrVlanFiltering   = 7
+	iflaBrRootId          = 10
+	iflaBrBridgeId        = 11
+	iflaBrRootPort        = 12
+	iflaBrRootPathCost    = 13
+	iflaBrMcastRouter     = 22
+	iflaBrMcastSnooping   = 23
+	iflaBrMcastQuerier    = 25
+	iflaBrVlanDefaultPvid = 39
+	iflaBrMcastIgmpVer    = 43
+	iflaBrMcastMldVer     = 44
+)
+
+// Values of IFLA_BR_MCAST_ROUTER: whether the bridge itself is a multicast
+// router port never, when queries are seen, or always.
+var mcastRouterStrings = []string{
+	"disabled",
+	"auto",
+	"permanent",
+}
+
+// bridgeState is what UpdateBridgeState reads from the kernel about a
+// bridge and its ports in one go.
+type bridgeState struct {
+	filtering    bool
+	defaultPvid  int
+	stpMode      string
+	bridgeID     string
+	rootID       string
+	rootPort     int
+	rootPathCost int
+	multicast    BridgeMulticast
+	ports        map[int][]BridgeVlan
+	stp          map[int]*BridgePortStp
+}
+
+// BridgeMulticast is the IGMP/MLD snooping configuration of a bridge.
+type BridgeMulticast struct {
+	Snooping    bool   `json:"snooping"`
+	Querier     bool   `json:"querier"`
+	Router      string `json:"router"`
+	IGMPVersion int    `json:"igmpVersion"`
+	MLDVersion  int    `json:"mldVersion"`
+}
+
+// bridgeID formats a struct ifla_bridge_id, a 2 byte priority followed by
+// a MAC address, the way brctl shows it.
+func bridgeID(b []byte) string {
+	if len(b) < 8 {
+		return ""
+	}
+	return fmt.Sprintf("%02x%02x.%02x%02x%02x%02x%02x%02x", b[0], b[1], b[2], b[3], b[4], b[5], b[6], b[7])
+}
+
+// UpdateBridgeState reads the VLAN filtering, spanning tree and multicast
+// snooping settings of the bridge index, or of the bridge index is a port
+// of, together with the VLANs and STP state of all its ports, and hands them
+// to the bridge.
+func (n *Namespace) UpdateBridgeState(index int) {
+	d, ok := n.L2Devices[index]
+	if !ok {
+		return
+	}
+	b, ok := d.(*L2Bridge)
+	if !ok {
+		if b, ok = n.L2Devices[d.L2EventChannel().Master].(*L2Bridge); !ok {
+			return
+		}
+	}
+	state := bridgeState{
+		ports: make(map[int][]BridgeVlan),
+		stp:   make(map[int]*BridgePortStp),
+	}
+	_, info, err := n.linkInfoData(b.Index)
+	if err != nil {
+		fmt.Println("ERROR: GETTING BRIDGE INFO OF", b.Name, "IN NS", n.Name, err)
+		return
+	}
+	for _, attr := range info {
+		switch attr.Attr.Type {
+		case iflaBrVlanFiltering:
+			state.filtering = len(attr.Value) > 0 && attr.Value[0] != 0
+		case iflaBrVlanDefaultPvid:
+			if len(attr.Value) >= 2 {
+				state.defaultPvid = int(nl.NativeEndian().Uint16(attr.Value))
+			}
+		case iflaBrStpState:
+			if len(attr.Value) >= 4 {
+				state.stpMode = stpModeString(nl.NativeEndian().Uint32(attr.Value))
+			}
+		case iflaBrBridgeId:
+			state.bridgeID = bridgeID(attr.Value)
+		case iflaBrRootId:
+			state.rootID = bridgeID(attr.Value)
+		case iflaBrRootPort:
+			if len(attr.Value) >= 2 {
+				state.rootPort = int(nl.NativeEndian().Uint16(attr.Value))
+			}
+		case iflaBrRootPathCost:
+			if len(attr.Value) >= 4 {
+				state.rootPathCost = int(nl.NativeEndian().Uint32(attr.Value))
+			}
+		case iflaBrMcastSnooping:
+			state.multicast.Snooping = len(attr.Value) > 0 && attr.Value[0] != 0
+		case iflaBrMcastQuerier:
+			state.multicast.Querier = len(attr.Value) > 0 && attr.Value[0] != 0
+		case iflaBrMcastRouter:
+			if len(attr.Value) > 0 {
+				state.multicast.Router = "unknown"
+				if int(attr.Value[0]) < len(mcastRouterStrings) {
+					state.multicast.Router = mcastRouterStrings[attr.Value[0]]
+				}
+			}
+		case iflaBrMcastIgmpVer:
+			if len(attr.Value) > 0 {
+				state.multicast.IGMPVersion = int(attr.Value[0])
+			}
+		case iflaBrMcastMldVer:
+			if len(attr.Value) > 0 {
+				state.multicast.MLDVersion = int(attr.Value[0])
+			}
+		}
+	}
+	if err := n.bridgePorts(b.Index, &state); err != nil {
+		fmt.Println("ERROR: LISTING BRIDGE PORTS OF", b.Name, "IN NS", n.Name, err)
+		return
+	}
+	*b.stateChannel <- state
+}
+
+// bridgePorts dumps the AF_BRIDGE view of the links of n and records the
+// VLANs and STP state of bridge and of its ports in state. The netlink
+// package only exposes the VLANs, IFLA_PROTINFO is parsed here.
+func (n *Namespace) bridgePorts(bridge int, state *bridgeState) error {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(unix.AF_BRIDGE))
+	req.AddData(nl.NewRtAttr(unix.IFLA_EXT_MASK, nl.Uint32Attr(uint32(nl.RTEXT_FILTER_BRVLAN))))
+	msgs, err := n.execute(req, unix.RTM_NEWLINK)
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		msg := nl.DeserializeIfInfomsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return err
+		}
+		port := int(msg.Index)
+		if port != bridge && attrMaster(attrs) != bridge {
+			continue
+		}
+		for _, attr := range attrs {
+			switch attr.Attr.Type &^ unix.NLA_F_NESTED {
+			case unix.IFLA_AF_SPEC:
+				nested, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return err
+				}
+				for _, a := range nested {
+					if a.Attr.Type != nl.IFLA_BRIDGE_VLAN_INFO || len(a.Value) < nl.SizeofBridgeVlanInfo {
+						continue
+					}
+					info := nl.DeserializeBridgeVlanInfo(a.Value)
+					state.ports[port] = append(state.ports[port], BridgeVlan{
+						Vid:      int(info.Vid),
+						PVID:     info.PortVID(),
+						Untagged: info.EngressUntag(),
+					})
+				}
+			case unix.IFLA_PROTINFO:
+				nested, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return err
+				}
+				state.stp[port] = parsePortStp(nested)
+			}
+		}
+		list := state.ports[port]
+		sort.Slice(list, func(i, j int) bool { return list[i].Vid < list[j].Vid })
+	}
+	return nil
+}
+
+func attrMaster(attrs []syscall.NetlinkRouteAttr) int {
+	for _, attr := range attrs {
+		if attr.Attr.Type == unix.IFLA_MASTER && len(attr.Value) >= 4 {
+			return int(nl.NativeEndian().Uint32(attr.Value))
+		}
+	}
+	return 0
+}
+
+func parsePortStp(attrs []syscall.NetlinkRouteAttr) *BridgePortStp {
+	p := &BridgePortStp{}
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nl.IFLA_BRPORT_STATE:
+			if len(attr.Value) >= 1 {
+				p.State = portStateString(attr.Value[0])
+			}
+		case nl.IFLA_BRPORT_PRIORITY:
+			if len(attr.Value) >= 2 {
+				p.Priority = int(nl.NativeEndian().Uint16(attr.Value))
+			}
+		case nl.IFLA_BRPORT_COST:
+			if len(attr.Value) >= 4 {
+				p.Cost = int(nl.NativeEndian().Uint32(attr.Value))
+			}
+		}
+	}
+	return p
+}
@@ -0,0 +1,40 @@
+package devices
+
+// BridgePortStp is the spanning tree state of a bridge port. A port only
+// passes traffic once State is "forwarding".
+type BridgePortStp struct {
+	State    string `json:"state"`
+	Priority int    `json:"priority"`
+	Cost     int    `json:"cost"`
+}
+
+// BR_STATE_* values of IFLA_BRPORT_STATE.
+var portStateStrings = []string{
+	"disabled",
+	"listening",
+	"learning",
+	"forwarding",
+	"blocking",
+}
+
+func portStateString(state uint8) string {
+	if int(state) < len(portStateStrings) {
+		return portStateStrings[state]
+	}
+	return "unknown"
+}
+
+// Values of IFLA_BR_STP_STATE: no STP, STP run by the kernel, or by a
+// user space daemon such as mstpd.
+var stpModeStrings = []string{
+	"disabled",
+	"kernel",
+	"user",
+}
+
+func stpModeString(mode uint32) string {
+	if int(mode) < len(stpModeStrings) {
+		return stpModeStrings[mode]
+	}
+	return "unknown"
+}
@@ -0,0 +1,22 @@
+package devices
+
+// BridgeVlan is the membership of a bridge port, or of the bridge itself,
+// in VLAN Vid. PVID marks the VLAN untagged ingress frames are assigned to,
+// Untagged that egress frames leave without a tag.
+type BridgeVlan struct {
+	Vid      int  `json:"vid"`
+	PVID     bool `json:"pvid"`
+	Untagged bool `json:"untagged"`
+}
+
+func bridgeVlansEqual(a, b []BridgeVlan) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -7,6 +7,27 @@ import (
 type LinkUpdateReceiver interface {
 	ReceiveLinkUpdate()
 	L2EventChannel() L2channel
+	Attrs() *L2Device
+}
+
+// DeviceDeleter is implemented by every device type so that a namespace
+// can tear a device down without knowing its concrete type.
+type DeviceDeleter interface {
+	DeleteDevice()
+}
+
+// linkResolver is implemented by devices that refer to a link which may
+// live in another namespace, such as the peer of a veth or the parent of a
+// VLAN. resolveLink is retried when new nsids are assigned.
+type linkResolver interface {
+	linkResolved() bool
+	resolveLink()
+}
+
+// linkInfoReceiver is implemented by devices that track attributes beyond
+// flags and master, such as a bond following the state of its members.
+type linkInfoReceiver interface {
+	linkInfo() *chan netlink.Link
 }
 
 type AddrUpdateReceiver interface {
@@ -22,3 +43,12 @@ type LinkAddrUpdateReceiver interface {
 type Transformer interface {
 	Transform(*netlink.AddrUpdate) *L3Device
 }
+
+// linkOf returns the link carried by update, which is either a bare
+// netlink.Link from a dump or a *netlink.LinkUpdate from a subscription.
+func linkOf(update netlink.Link) netlink.Link {
+	if u, ok := update.(*netlink.LinkUpdate); ok {
+		return u.Link
+	}
+	return update
+}
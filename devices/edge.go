@@ -0,0 +1,166 @@
+package devices
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Kinds of edges between devices.
+const (
+	EdgeVlan    = "vlan"
+	EdgeMacvlan = "macvlan"
+	EdgeMacvtap = "macvtap"
+	EdgeIpvlan  = "ipvlan"
+	// EdgeUnderlay links a tunnel to the device its packets leave through.
+	EdgeUnderlay = "underlay"
+	// EdgeRoutesVia links the outgoing device of a route to the device
+	// owning its gateway address.
+	EdgeRoutesVia = "routes-via"
+)
+
+// ExternalNamespace is the namespace part of nodes that are not on this
+// host, such as the remote endpoint of a tunnel.
+const ExternalNamespace = "external"
+
+// ExternalNode returns the node of a remote endpoint.
+func ExternalNode(ip net.IP) string {
+	return ExternalNamespace + ":" + ip.String()
+}
+
+// nodeNamespace returns the namespace part of node, "namespace:index".
+func nodeNamespace(node string) string {
+	return strings.SplitN(node, ":", 2)[0]
+}
+
+type EdgeEvent int
+
+const (
+	EdgeAdd EdgeEvent = iota
+	EdgeRemove
+)
+
+var EdgeEventStrings = []string{
+	"EdgeAdd",
+	"EdgeRemove",
+}
+
+func (e EdgeEvent) String() string {
+	for i, str := range EdgeEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+// Edge is a typed relation between two nodes, each a device identified as
+// "namespace:index" or an external endpoint, see ExternalNode. From is the
+// lower side of the relation, such as the parent of a VLAN sub-interface.
+type Edge struct {
+	Kind string `json:"kind"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// crossNamespace reports whether e links two namespaces of this host.
+func (e Edge) crossNamespace() bool {
+	from, to := nodeNamespace(e.From), nodeNamespace(e.To)
+	return from != to && from != ExternalNamespace && to != ExternalNamespace
+}
+
+// connects reports whether e connects the namespaces it spans. Routes-via
+// edges follow links that are already there and leave connections alone.
+func (e Edge) connects() bool {
+	return e.crossNamespace() && e.Kind != EdgeRoutesVia
+}
+
+var defaultEdgeSubscriber []func(Edge, EdgeEvent)
+
+func SubscribeAllEdgeEvents(callback func(Edge, EdgeEvent)) {
+	defaultEdgeSubscriber = append(defaultEdgeSubscriber, callback)
+}
+
+func (t *Topology) OnEdgeChange(event EdgeEvent, callback func(Edge, EdgeEvent)) error {
+	if int(event) >= len(EdgeEventStrings) || int(event) < 0 {
+		return errors.New("Topology OnEdgeChange: EdgeEvent unrecognized")
+	}
+	t.edgeOnChange[event] = append(t.edgeOnChange[event], callback)
+	return nil
+}
+
+func (t *Topology) fireEdgeEvent(e Edge, event EdgeEvent) {
+	for _, f := range defaultEdgeSubscriber {
+		f(e, event)
+	}
+	for _, f := range t.edgeOnChange[event] {
+		f(e, event)
+	}
+}
+
+// AddEdge records e. Edges between namespaces also connect the namespaces,
+// see Edge.connects.
+func (t *Topology) AddEdge(e Edge) {
+	t.Lock()
+	if t.edges[e] {
+		t.Unlock()
+		return
+	}
+	t.edges[e] = true
+	t.Unlock()
+	if e.connects() {
+		t.Connect(e.From, e.To)
+	}
+	t.fireEdgeEvent(e, EdgeAdd)
+	if e.Kind != EdgeRoutesVia {
+		t.segmentsChanged()
+	}
+}
+
+func (t *Topology) RemoveEdge(e Edge) {
+	t.Lock()
+	if !t.edges[e] {
+		t.Unlock()
+		return
+	}
+	delete(t.edges, e)
+	t.Unlock()
+	if e.connects() {
+		t.Disconnect(e.From, e.To)
+	}
+	t.fireEdgeEvent(e, EdgeRemove)
+	if e.Kind != EdgeRoutesVia {
+		t.segmentsChanged()
+	}
+}
+
+// RemoveEdgesOf removes every edge with node, "namespace:index", on either
+// side.
+func (t *Topology) RemoveEdgesOf(node string) {
+	for _, e := range t.Edges() {
+		if e.From == node || e.To == node {
+			t.RemoveEdge(e)
+		}
+	}
+}
+
+// Edges returns the edges of the topology sorted by kind and endpoints.
+func (t *Topology) Edges() []Edge {
+	t.Lock()
+	edges := make([]Edge, 0, len(t.edges))
+	for e := range t.edges {
+		edges = append(edges, e)
+	}
+	t.Unlock()
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Kind != edges[j].Kind {
+			return edges[i].Kind < edges[j].Kind
+		}
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+	return edges
+}
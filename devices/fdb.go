@@ -0,0 +1,152 @@
+package devices
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ntfExtLearned is NTF_EXT_LEARNED, set on entries added by a driver or a
+// control plane rather than learned by the bridge itself.
+const ntfExtLearned = 0x10
+
+// FdbEntry is an entry of the forwarding database of a bridge, or of a
+// VXLAN port of a bridge when Remote is set.
+type FdbEntry struct {
+	MAC         string `json:"mac"`
+	Vlan        int    `json:"vlan,omitempty"`
+	Port        int    `json:"port"`
+	Remote      string `json:"remote,omitempty"`
+	VNI         int    `json:"vni,omitempty"`
+	State       string `json:"state"`
+	Static      bool   `json:"static"`
+	ExtLearned  bool   `json:"extLearned"`
+	Self        bool   `json:"self"`
+	bridgeIndex int
+}
+
+var neighStateStrings = map[int]string{
+	netlink.NUD_NONE:       "none",
+	netlink.NUD_INCOMPLETE: "incomplete",
+	netlink.NUD_REACHABLE:  "reachable",
+	netlink.NUD_STALE:      "stale",
+	netlink.NUD_DELAY:      "delay",
+	netlink.NUD_PROBE:      "probe",
+	netlink.NUD_FAILED:     "failed",
+	netlink.NUD_NOARP:      "noarp",
+	netlink.NUD_PERMANENT:  "permanent",
+}
+
+func NewFdbEntry(neigh netlink.Neigh) *FdbEntry {
+	e := &FdbEntry{
+		MAC:         neigh.HardwareAddr.String(),
+		Vlan:        neigh.Vlan,
+		Port:        neigh.LinkIndex,
+		VNI:         neigh.VNI,
+		State:       lookupString(neighStateStrings, neigh.State),
+		Static:      neigh.State&(netlink.NUD_PERMANENT|netlink.NUD_NOARP) != 0,
+		ExtLearned:  neigh.Flags&ntfExtLearned != 0,
+		Self:        neigh.Flags&netlink.NTF_SELF != 0,
+		bridgeIndex: neigh.MasterIndex,
+	}
+	if neigh.IP != nil {
+		e.Remote = neigh.IP.String()
+	}
+	return e
+}
+
+// key identifies e in the FDB of a bridge. The bridge knows a MAC on a
+// single port per VLAN, entries of the ports themselves, such as the remote
+// VTEPs of a VXLAN port, are kept apart.
+func (e *FdbEntry) key() string {
+	k := e.MAC + "@" + strconv.Itoa(e.Vlan)
+	if e.Self {
+		k += "#" + strconv.Itoa(e.Port) + ">" + e.Remote
+	}
+	return k
+}
+
+type fdbUpdate struct {
+	entry *FdbEntry
+	add   bool
+}
+
+type fdbQuery struct {
+	mac   string
+	reply chan []*FdbEntry
+}
+
+// UpdateFdb adds or removes the AF_BRIDGE neighbour neigh from the FDB of
+// the bridge it belongs to: its master, or the master of its port for
+// entries a port keeps itself.
+func (n *Namespace) UpdateFdb(neigh netlink.Neigh, add bool) {
+	e := NewFdbEntry(neigh)
+	n.topology.rlockState()
+	if e.bridgeIndex == 0 {
+		if d, ok := n.L2Devices[e.Port]; ok {
+			if _, isBridge := d.(*L2Bridge); isBridge {
+				e.bridgeIndex = e.Port
+			} else {
+				e.bridgeIndex = d.L2EventChannel().Master
+			}
+		}
+	}
+	b, ok := n.L2Devices[e.bridgeIndex].(*L2Bridge)
+	n.topology.runlockState()
+	if !ok {
+		return
+	}
+	// A bridge being removed no longer runs its goroutine.
+	select {
+	case *b.fdbChannel <- fdbUpdate{e, add}:
+	case <-time.After(deviceQueryTimeout):
+	}
+}
+
+// MACLocation is where a bridge of the topology has learned a MAC address.
+type MACLocation struct {
+	Namespace string    `json:"namespace"`
+	Bridge    int       `json:"bridge"`
+	Entry     *FdbEntry `json:"entry"`
+	PortName  string    `json:"portName"`
+}
+
+// LocateMAC returns every bridge port mac was learned on.
+func (t *Topology) LocateMAC(mac string) []MACLocation {
+	mac = strings.ToLower(mac)
+	type bridge struct {
+		n     *Namespace
+		index int
+		dev   *L2Bridge
+	}
+	bridges := make([]bridge, 0)
+	t.stateLock.RLock()
+	for _, n := range t.Namespaces {
+		for index, d := range n.L2Devices {
+			if b, ok := d.(*L2Bridge); ok {
+				bridges = append(bridges, bridge{n, index, b})
+			}
+		}
+	}
+	t.stateLock.RUnlock()
+	locations := make([]MACLocation, 0)
+	owners := make([]*Namespace, 0)
+	for _, b := range bridges {
+		for _, e := range b.dev.Lookup(mac) {
+			locations = append(locations, MACLocation{
+				Namespace: b.n.Name,
+				Bridge:    b.index,
+				Entry:     e,
+			})
+			owners = append(owners, b.n)
+		}
+	}
+	t.stateLock.RLock()
+	for i, l := range locations {
+		locations[i].PortName = owners[i].DeviceLabel(l.Entry.Port)
+	}
+	t.stateLock.RUnlock()
+	return locations
+}
@@ -0,0 +1,96 @@
+package devices
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// fdbNamespace returns a namespace with a bridge br0, index 5, running its
+// goroutine, and its port eth0, index 7.
+func fdbNamespace() (*Namespace, *L2Bridge) {
+	topology := NewTopology()
+	n := NewNamespace("test", topology, nil)
+	b := NewL2Bridge(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0", Index: 5}}, topology, "test", false)
+	n.setL2Device(5, b)
+	go b.ReceiveLinkUpdate()
+	port := NewL2Device(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 7, MasterIndex: 5}},
+		topology, "test", false)
+	port.Master = 5
+	n.setL2Device(7, port)
+	return n, b
+}
+
+func TestNamespace_UpdateFdb(t *testing.T) {
+	n, b := fdbNamespace()
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	n.UpdateFdb(netlink.Neigh{LinkIndex: 7, MasterIndex: 5, HardwareAddr: mac, State: netlink.NUD_REACHABLE}, true)
+	if got := b.Lookup(mac.String()); len(got) != 1 || got[0].Port != 7 {
+		t.Errorf("Lookup() after learning = %+v, want an entry on port 7", got)
+	}
+
+	// Entries of a port itself belong to the master of the port.
+	n.UpdateFdb(netlink.Neigh{LinkIndex: 7, HardwareAddr: mac, State: netlink.NUD_PERMANENT,
+		Flags: netlink.NTF_SELF}, true)
+
+	n.UpdateFdb(netlink.Neigh{LinkIndex: 7, MasterIndex: 5, HardwareAddr: mac}, false)
+	if got := b.Lookup(mac.String()); len(got) != 0 {
+		t.Errorf("Lookup() after ageing = %+v, want none", got)
+	}
+
+	b.DeleteDevice()
+	if len(b.Fdb) != 1 {
+		t.Errorf("len(Fdb) = %d, want the entry of eth0 itself", len(b.Fdb))
+	}
+}
+
+func TestNamespace_UpdateFdbOfRemovedBridge(t *testing.T) {
+	n, b := fdbNamespace()
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	// RemoveDevice stops the goroutine of the bridge before it takes it out
+	// of L2Devices, while the kernel flushes the FDB of the bridge.
+	b.DeleteDevice()
+	done := make(chan bool)
+	go func() {
+		n.UpdateFdb(netlink.Neigh{LinkIndex: 7, MasterIndex: 5, HardwareAddr: mac}, false)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * deviceQueryTimeout):
+		t.Error("UpdateFdb() blocked on a removed bridge")
+	}
+}
+
+func TestNamespace_UpdateFdbWhileAddingDevices(t *testing.T) {
+	n, _ := fdbNamespace()
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	stop, done := make(chan bool), make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+				index := 1000 + i%100
+				n.setL2Device(index, &Veth{L2Device: &L2Device{Name: "eth" + strconv.Itoa(i), Index: index}})
+			}
+		}
+	}()
+	for i := 0; i < 300; i++ {
+		n.UpdateFdb(netlink.Neigh{LinkIndex: 7, HardwareAddr: mac, State: netlink.NUD_REACHABLE}, i%2 == 0)
+	}
+	stop <- true
+	<-done
+}
+
+func TestL2BondEvent_afterBridgeEvents(t *testing.T) {
+	if last := L2BridgeEvent(bridgeIota + len(L2BridgeEventStrings) - 1); int(L2BondCreate) <= int(last) {
+		t.Errorf("L2BondCreate = %d overlaps %s = %d", L2BondCreate, last, last)
+	}
+}
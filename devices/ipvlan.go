@@ -0,0 +1,75 @@
+package devices
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	IpvlanCreate = iota
+	IpvlanParentResolve
+	IpvlanParentUnknown
+	IpvlanDelete
+)
+
+var IpvlanEventStrings = stackedEventStrings("Ipvlan")
+
+type IpvlanEvent int
+
+func (e IpvlanEvent) String() string {
+	for i, str := range IpvlanEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+var ipvlanModeStrings = map[netlink.IPVlanMode]string{
+	netlink.IPVLAN_MODE_L2:  "l2",
+	netlink.IPVLAN_MODE_L3:  "l3",
+	netlink.IPVLAN_MODE_L3S: "l3s",
+}
+
+var ipvlanFlagStrings = map[netlink.IPVlanFlag]string{
+	netlink.IPVLAN_FLAG_BRIDGE:  "bridge",
+	netlink.IPVLAN_FLAG_PRIVATE: "private",
+	netlink.IPVLAN_FLAG_VEPA:    "vepa",
+}
+
+type Ipvlan struct {
+	stackedDevice
+	Mode string `json:"mode"`
+	Flag string `json:"flag"`
+}
+
+var defaultIpvlanSubscriber []func(*Ipvlan, IpvlanEvent)
+
+func SubscribeAllIpvlanEvents(callback func(*Ipvlan, IpvlanEvent)) {
+	defaultIpvlanSubscriber = append(defaultIpvlanSubscriber, callback)
+}
+
+func NewIpvlan(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) *Ipvlan {
+	i := &Ipvlan{stackedDevice: newStackedDevice(update, t, namespace, consoleDisplay, EdgeIpvlan)}
+	i.device = i
+	if link, ok := linkOf(update).(*netlink.IPVlan); ok {
+		i.Mode = ipvlanModeStrings[link.Mode]
+		i.Flag = ipvlanFlagStrings[link.Flag]
+	}
+	for index, _ := range IpvlanEventStrings {
+		for _, defaultCallback := range defaultIpvlanSubscriber {
+			if err := i.OnChange(IpvlanEvent(index), defaultCallback); err != nil {
+				fmt.Println("ERROR: ASSIGNING ONCHANGE", err)
+			}
+		}
+	}
+	i.fireChangeEvents(stackedCreate)
+	return i
+}
+
+func (i *Ipvlan) OnChange(event IpvlanEvent, callback func(*Ipvlan, IpvlanEvent)) error {
+	return i.onStackedChange(stackedEvent(event), func(e stackedEvent) {
+		callback(i, IpvlanEvent(e))
+	})
+}
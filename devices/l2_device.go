@@ -1,7 +1,10 @@
 package devices
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/vishvananda/netlink"
 )
@@ -62,6 +65,12 @@ func (s L2Status) String() string {
 	return ""
 }
 
+var defaultL2DeviceSubscriber []func(L2Device, L2Event)
+
+func SubscribeAllL2DeviceEvents(callback func(L2Device, L2Event)) {
+	defaultL2DeviceSubscriber = append(defaultL2DeviceSubscriber, callback)
+}
+
 type L2Device struct {
 	topology         *Topology
 	Name             string   `json:"name"`
@@ -77,7 +86,10 @@ type L2Device struct {
 	deleteChannel    *chan bool
 	nameChannel      *chan string
 	dumpChannel      *chan bool
-	Event            string `json:"event"`
+	// snapshotChannel asks the goroutine of the device for its JSON, see
+	// L2Device.marshal.
+	snapshotChannel *chan chan json.RawMessage
+	Event           string `json:"event"`
 }
 
 func NewL2Device(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) *L2Device {
@@ -104,12 +116,16 @@ func NewL2Device(update netlink.Link, t *Topology, namespace string, consoleDisp
 			onChange[L2Event(i)] = append(onChange[L2Event(i)], defaultFunction)
 		}
 	}
+	for i, _ := range L2EventStrings {
+		onChange[L2Event(i)] = append(onChange[L2Event(i)], defaultL2DeviceSubscriber...)
+	}
 
 	l := make(chan l2DeviceFlagsEvent)
 	m := make(chan l2DeviceMasterEvent)
 	dumpChannel := make(chan bool)
 	deleteChannel := make(chan bool)
 	nameChannel := make(chan string)
+	snapshotChannel := make(chan chan json.RawMessage)
 	l2dev := L2Device{
 		topology:         t,
 		Name:             update.Attrs().Name,
@@ -124,6 +140,7 @@ func NewL2Device(update netlink.Link, t *Topology, namespace string, consoleDisp
 		deleteChannel:    &deleteChannel,
 		nameChannel:      &nameChannel,
 		dumpChannel:      &dumpChannel,
+		snapshotChannel:  &snapshotChannel,
 	}
 	l2dev.CreateDevice()
 	return &l2dev
@@ -133,10 +150,49 @@ func (dev *L2Device) L2EventChannel() L2channel {
 	return newL2Channel(dev.Master, dev.setMasterChannel, dev.flagsChannel, dev.nameChannel, dev.dumpChannel)
 }
 
+// Attrs returns the L2Device shared by all device types, the same way
+// netlink.Link exposes its common attributes.
+func (dev *L2Device) Attrs() *L2Device {
+	return dev
+}
+
 func (dev *L2Device) fireChangeEvents(change L2Event) {
 	for _, f := range dev.onchange[change] {
 		f(*dev, change)
 	}
+	if change != L2DeviceCreate && change != L2DeviceTransform && dev.topology != nil {
+		dev.topology.reachabilityChanged(dev.Namespace)
+	}
+}
+
+// deviceQueryTimeout bounds the wait for the goroutine of a device to
+// answer a query. One that does not is being deleted.
+const deviceQueryTimeout = time.Second
+
+// marshal returns the JSON of the device, whatever its type, encoded by its
+// goroutine, or null when the device is being deleted.
+func (dev *L2Device) marshal() json.RawMessage {
+	reply := make(chan json.RawMessage, 1)
+	select {
+	case *dev.snapshotChannel <- reply:
+	case <-time.After(deviceQueryTimeout):
+		return json.RawMessage("null")
+	}
+	return <-reply
+}
+
+// marshalDevice encodes dev, from its goroutine, for L2Device.marshal.
+func marshalDevice(t *Topology, dev interface{}) json.RawMessage {
+	if t != nil {
+		t.stateLock.RLock()
+		defer t.stateLock.RUnlock()
+	}
+	b, err := json.Marshal(dev)
+	if err != nil {
+		fmt.Println("ERROR: ENCODING DEVICE", err)
+		return json.RawMessage("null")
+	}
+	return b
 }
 
 func (dev *L2Device) CreateDevice() {
@@ -152,30 +208,46 @@ func (dev *L2Device) SetMaster(masterIndex int) {
 	if masterIndex == 0 {
 		return
 	}
+	dev.topology.lockState()
 	dev.Master = masterIndex
+	dev.topology.unlockState()
 	dev.fireChangeEvents(L2DeviceSetMaster)
+	if dev.topology != nil {
+		dev.topology.segmentsChanged()
+	}
 }
 
 func (dev *L2Device) UnsetMaster() {
+	dev.topology.lockState()
 	dev.Master = 0
+	dev.topology.unlockState()
 	dev.fireChangeEvents(L2DeviceUnsetMaster)
+	if dev.topology != nil {
+		dev.topology.segmentsChanged()
+	}
 }
 
 func (dev *L2Device) Up() {
-	dev.Status = L2Up
+	dev.setStatus(L2Up)
 	dev.fireChangeEvents(L2DeviceUp)
 }
 
 func (dev *L2Device) Down() {
-	dev.Status = L2Down
+	dev.setStatus(L2Down)
 	dev.fireChangeEvents(L2DeviceDown)
 }
 
 func (dev *L2Device) UpLowerLayerDown() {
-	dev.Status = L2LowerLayerDown
+	dev.setStatus(L2LowerLayerDown)
 	dev.fireChangeEvents(L2DeviceLowerLayerDown)
 }
 
+func (dev *L2Device) setStatus(status L2Status) {
+	dev.topology.lockState()
+	dev.Status = status
+	dev.topology.unlockState()
+}
+
 func (dev *L2Device) SetFlags(flags net.Flags, operState netlink.LinkOperState) {
 	if dev.flags == flags && dev.operState == operState {
 		return
@@ -207,6 +279,8 @@ func (dev *L2Device) ReceiveLinkUpdate() {
 			} else {
 				dev.UnsetMaster()
 			}
+		case reply := <-*(dev.snapshotChannel):
+			reply <- marshalDevice(dev.topology, dev)
 		case d := <-*(dev.dumpChannel):
 			if d {
 				dumper.Encode(dev)
@@ -226,5 +300,7 @@ func (device *L2Device) SetName(s string) {
 	if device.Name == s {
 		return
 	}
+	device.topology.lockState()
 	device.Name = s
+	device.topology.unlockState()
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 )
 
 type L3DeviceEvent int
@@ -22,6 +23,11 @@ const (
 	L3DeviceAddAddress
 	L3DeviceRemoveAddress
 	L3DeviceDelete
+	L3DeviceSetAllowedIPs
+	L3DeviceNeighborAdd
+	L3DeviceNeighborState
+	L3DeviceNeighborDelete
+	L3DeviceGatewayFailed
 )
 
 var L3DeviceEventStrings = []string{
@@ -29,6 +35,11 @@ var L3DeviceEventStrings = []string{
 	"L3DeviceAddAddress",
 	"L3DeviceRemoveAddress",
 	"L3DeviceDelete",
+	"L3DeviceSetAllowedIPs",
+	"L3DeviceNeighborAdd",
+	"L3DeviceNeighborState",
+	"L3DeviceNeighborDelete",
+	"L3DeviceGatewayFailed",
 }
 
 type L3Channel struct {
@@ -36,6 +47,8 @@ type L3Channel struct {
 	removeAddrChannel *chan *net.IPNet
 	dumpChannel       *chan bool
 	doneChannel       *chan bool
+	neighChannel      *chan neighUpdate
+	allowedIPsChannel *chan []string
 }
 
 func newL3Channel() L3Channel {
@@ -43,22 +56,32 @@ func newL3Channel() L3Channel {
 	r := make(chan *net.IPNet)
 	d := make(chan bool)
 	dc := make(chan bool)
-	return L3Channel{addAddrChannel: &a, removeAddrChannel: &r, dumpChannel: &d, doneChannel: &dc}
+	nc := make(chan neighUpdate)
+	ac := make(chan []string)
+	return L3Channel{addAddrChannel: &a, removeAddrChannel: &r, dumpChannel: &d, doneChannel: &dc, neighChannel: &nc,
+		allowedIPsChannel: &ac}
 }
 
 type L3Device struct {
 	Index     int
 	Namespace string
 	LinkUpdateReceiver
-	IP          []string
+	IP []string
+	// AllowedIPs are the prefixes routed through the device by its
+	// WireGuard peers.
+	AllowedIPs []string
+	// Neighbors is the ARP/NDP table of the device keyed by IP.
+	Neighbors   map[string]*Neighbor
 	ip          []*net.IPNet
-	onChange    map[L3DeviceEvent][]func(device *L3Device, event L3DeviceEvent)
+	onChange    map[L3DeviceEvent][]func(device *L3Device, event L3DeviceEvent, item interface{})
 	addrChannel L3Channel
 }
 
-var defaultL3DeviceSubscriber []func(device *L3Device, event L3DeviceEvent)
+// L3Device callbacks get the *net.IPNet of address events and the *Neighbor
+// of neighbour events, nil otherwise.
+var defaultL3DeviceSubscriber []func(device *L3Device, event L3DeviceEvent, item interface{})
 
-func SubscribeAllL3DeviceEvents(callback func(device *L3Device, event L3DeviceEvent)) {
+func SubscribeAllL3DeviceEvents(callback func(device *L3Device, event L3DeviceEvent, item interface{})) {
 	defaultL3DeviceSubscriber = append(defaultL3DeviceSubscriber, callback)
 }
 
@@ -69,6 +92,16 @@ func (dev *L3Device) ReceiveAddrUpdate() {
 			dev.AddAddr(a)
 		case a := <-*dev.addrChannel.removeAddrChannel:
 			dev.RemoveAddr(a)
+		case u := <-*dev.addrChannel.neighChannel:
+			if u.gateways != nil {
+				dev.setGateways(u.gateways)
+			} else if u.add {
+				dev.SetNeighbor(u.neighbor)
+			} else {
+				dev.RemoveNeighbor(u.neighbor)
+			}
+		case p := <-*dev.addrChannel.allowedIPsChannel:
+			dev.SetAllowedIPs(p)
 		case d := <-*dev.L3EventChannel().dumpChannel:
 			if d {
 				dumper.Encode(dev)
@@ -79,7 +112,7 @@ func (dev *L3Device) ReceiveAddrUpdate() {
 				for _, addr := range dev.ip {
 					dev.RemoveAddr(addr)
 				}
-				dev.fireChangeEvents(L3DeviceDelete)
+				dev.fireChangeEvents(L3DeviceDelete, nil)
 				*dev.L3EventChannel().doneChannel <- true
 				*dev.L3EventChannel().doneChannel <- true
 				return
@@ -98,7 +131,8 @@ func NewL3Device(index int, namespace string, l2dev LinkUpdateReceiver, addrs []
 		Namespace:          namespace,
 		LinkUpdateReceiver: l2dev,
 		addrChannel:        newL3Channel(),
-		onChange:           make(map[L3DeviceEvent][]func(device *L3Device, event L3DeviceEvent)),
+		Neighbors:          make(map[string]*Neighbor),
+		onChange:           make(map[L3DeviceEvent][]func(device *L3Device, event L3DeviceEvent, item interface{})),
 	}
 	for index, _ := range L3DeviceEventStrings {
 		for _, defaultCallback := range defaultL3DeviceSubscriber {
@@ -107,7 +141,7 @@ func NewL3Device(index int, namespace string, l2dev LinkUpdateReceiver, addrs []
 			}
 		}
 	}
-	d.fireChangeEvents(L3DeviceCreate)
+	d.fireChangeEvents(L3DeviceCreate, nil)
 	for _, addr := range addrs {
 		d.AddAddr(addr)
 	}
@@ -116,17 +150,12 @@ func NewL3Device(index int, namespace string, l2dev LinkUpdateReceiver, addrs []
 }
 
 func (dev *L3Device) AddAddr(addr *net.IPNet) {
-	if dev.IP == nil {
-		dev.ip = make([]*net.IPNet, 1)
-		dev.IP = make([]string, 1)
-		dev.IP[0] = addr.String()
-		dev.ip[0] = addr
-		dev.fireChangeEvents(L3DeviceAddAddress)
-		return
-	}
+	t := dev.Attrs().topology
+	t.lockState()
 	dev.IP = append(dev.IP, addr.String())
 	dev.ip = append(dev.ip, addr)
-	dev.fireChangeEvents(L3DeviceAddAddress)
+	t.unlockState()
+	dev.fireChangeEvents(L3DeviceAddAddress, addr)
 }
 
 func (dev *L3Device) RemoveAddr(addr *net.IPNet) {
@@ -135,15 +164,93 @@ func (dev *L3Device) RemoveAddr(addr *net.IPNet) {
 		sizeb, _ := addr.Mask.Size()
 		// ignore label for comparison
 		if ip.IP.Equal(addr.IP) && sizea == sizeb {
+			t := dev.Attrs().topology
+			t.lockState()
 			dev.IP = append(dev.IP[0:index], dev.IP[index+1:]...)
 			dev.ip = append(dev.ip[0:index], dev.ip[index+1:]...)
-			dev.fireChangeEvents(L3DeviceRemoveAddress)
+			t.unlockState()
+			dev.fireChangeEvents(L3DeviceRemoveAddress, ip)
+			return
+		}
+	}
+}
+
+// updateAllowedIPs hands prefixes to the goroutine of dev, which a device
+// being deleted no longer runs.
+func (dev *L3Device) updateAllowedIPs(prefixes []string) {
+	select {
+	case *dev.addrChannel.allowedIPsChannel <- prefixes:
+	case <-time.After(deviceQueryTimeout):
+	}
+}
+
+func (dev *L3Device) SetAllowedIPs(prefixes []string) {
+	if len(prefixes) == len(dev.AllowedIPs) {
+		same := true
+		for i := range prefixes {
+			if prefixes[i] != dev.AllowedIPs[i] {
+				same = false
+			}
+		}
+		if same {
 			return
 		}
 	}
+	t := dev.Attrs().topology
+	t.lockState()
+	dev.AllowedIPs = prefixes
+	t.unlockState()
+	dev.fireChangeEvents(L3DeviceSetAllowedIPs, nil)
+}
+
+// SetNeighbor records nb, firing L3DeviceNeighborAdd for a new entry and
+// L3DeviceNeighborState when the state or the MAC of a known one changed.
+// L3DeviceGatewayFailed additionally fires when a gateway of the namespace
+// could not be resolved.
+func (dev *L3Device) SetNeighbor(nb *Neighbor) {
+	old, ok := dev.Neighbors[nb.IP]
+	if ok && *old == *nb {
+		return
+	}
+	t := dev.Attrs().topology
+	t.lockState()
+	dev.Neighbors[nb.IP] = nb
+	t.unlockState()
+	if !ok {
+		dev.fireChangeEvents(L3DeviceNeighborAdd, nb)
+	} else {
+		dev.fireChangeEvents(L3DeviceNeighborState, nb)
+	}
+	if nb.Gateway && nb.Failed() && (!ok || !old.Failed()) {
+		dev.fireChangeEvents(L3DeviceGatewayFailed, nb)
+	}
+}
+
+// setGateways flags the neighbours that are gateways of the namespace,
+// firing L3DeviceNeighborState for those whose flag changed.
+func (dev *L3Device) setGateways(gateways map[string]bool) {
+	for ip, old := range dev.Neighbors {
+		if old.Gateway != gateways[ip] {
+			nb := *old
+			nb.Gateway = gateways[ip]
+			dev.SetNeighbor(&nb)
+		}
+	}
+}
+
+func (dev *L3Device) RemoveNeighbor(nb *Neighbor) {
+	old, ok := dev.Neighbors[nb.IP]
+	if !ok {
+		return
+	}
+	t := dev.Attrs().topology
+	t.lockState()
+	delete(dev.Neighbors, nb.IP)
+	t.unlockState()
+	dev.fireChangeEvents(L3DeviceNeighborDelete, old)
 }
 
-func (dev *L3Device) OnChange(event L3DeviceEvent, callback func(device *L3Device, event L3DeviceEvent)) error {
+func (dev *L3Device) OnChange(event L3DeviceEvent, callback func(device *L3Device, event L3DeviceEvent, item interface{})) error {
 	if int(event) >= len(L3DeviceEventStrings) || int(event) < 0 {
 		return errors.New("L3Device OnChange: L3DeviceEvent unrecognized")
 	}
@@ -151,8 +258,8 @@ func (dev *L3Device) OnChange(event L3DeviceEvent, callback func(device *L3Devic
 	return nil
 }
 
-func (dev *L3Device) fireChangeEvents(change L3DeviceEvent) {
+func (dev *L3Device) fireChangeEvents(change L3DeviceEvent, item interface{}) {
 	for _, f := range dev.onChange[change] {
-		f(dev, change)
+		f(dev, change, item)
 	}
 }
@@ -0,0 +1,57 @@
+package devices
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// linkAttrs fetches link index of n from the kernel and returns its raw
+// IFLA_* attributes, for the ones the netlink package does not decode.
+func (n *Namespace) linkAttrs(index int) ([]syscall.NetlinkRouteAttr, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+	msgs, err := n.execute(req, unix.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 || len(msgs[0]) < unix.SizeofIfInfomsg {
+		return nil, fmt.Errorf("link %d of namespace %s not found", index, n.Name)
+	}
+	return nl.ParseRouteAttr(msgs[0][unix.SizeofIfInfomsg:])
+}
+
+// linkInfoData returns the IFLA_INFO_KIND and the attributes nested in
+// IFLA_INFO_DATA of link index of n.
+func (n *Namespace) linkInfoData(index int) (string, []syscall.NetlinkRouteAttr, error) {
+	attrs, err := n.linkAttrs(index)
+	if err != nil {
+		return "", nil, err
+	}
+	var kind string
+	var data []syscall.NetlinkRouteAttr
+	for _, attr := range attrs {
+		if attr.Attr.Type != unix.IFLA_LINKINFO {
+			continue
+		}
+		infos, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, info := range infos {
+			switch info.Attr.Type {
+			case nl.IFLA_INFO_KIND:
+				kind = string(info.Value[:len(info.Value)-1])
+			case nl.IFLA_INFO_DATA:
+				if data, err = nl.ParseRouteAttr(info.Value); err != nil {
+					return "", nil, err
+				}
+			}
+		}
+	}
+	return kind, data, nil
+}
@@ -0,0 +1,78 @@
+package devices
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	MacvlanCreate = iota
+	MacvlanParentResolve
+	MacvlanParentUnknown
+	MacvlanDelete
+)
+
+var MacvlanEventStrings = stackedEventStrings("Macvlan")
+
+type MacvlanEvent int
+
+func (e MacvlanEvent) String() string {
+	for i, str := range MacvlanEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+var macvlanModeStrings = map[netlink.MacvlanMode]string{
+	netlink.MACVLAN_MODE_DEFAULT:  "default",
+	netlink.MACVLAN_MODE_PRIVATE:  "private",
+	netlink.MACVLAN_MODE_VEPA:     "vepa",
+	netlink.MACVLAN_MODE_BRIDGE:   "bridge",
+	netlink.MACVLAN_MODE_PASSTHRU: "passthru",
+	netlink.MACVLAN_MODE_SOURCE:   "source",
+}
+
+// Macvlan is a macvlan or macvtap device. Kind tells the two apart.
+type Macvlan struct {
+	stackedDevice
+	Kind string `json:"kind"`
+	Mode string `json:"mode"`
+}
+
+var defaultMacvlanSubscriber []func(*Macvlan, MacvlanEvent)
+
+func SubscribeAllMacvlanEvents(callback func(*Macvlan, MacvlanEvent)) {
+	defaultMacvlanSubscriber = append(defaultMacvlanSubscriber, callback)
+}
+
+func NewMacvlan(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) *Macvlan {
+	m := &Macvlan{
+		stackedDevice: newStackedDevice(update, t, namespace, consoleDisplay, update.Type()),
+		Kind:          update.Type(),
+	}
+	m.device = m
+	switch link := linkOf(update).(type) {
+	case *netlink.Macvlan:
+		m.Mode = macvlanModeStrings[link.Mode]
+	case *netlink.Macvtap:
+		m.Mode = macvlanModeStrings[link.Mode]
+	}
+	for index, _ := range MacvlanEventStrings {
+		for _, defaultCallback := range defaultMacvlanSubscriber {
+			if err := m.OnChange(MacvlanEvent(index), defaultCallback); err != nil {
+				fmt.Println("ERROR: ASSIGNING ONCHANGE", err)
+			}
+		}
+	}
+	m.fireChangeEvents(stackedCreate)
+	return m
+}
+
+func (m *Macvlan) OnChange(event MacvlanEvent, callback func(*Macvlan, MacvlanEvent)) error {
+	return m.onStackedChange(stackedEvent(event), func(e stackedEvent) {
+		callback(m, MacvlanEvent(e))
+	})
+}
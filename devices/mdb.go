@@ -0,0 +1,204 @@
+package devices
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// MDBA_* attributes of RTM_NEWMDB and RTM_DELMDB messages, which the
+// netlink package does not handle.
+const (
+	mdbaMdb          = 1
+	mdbaMdbEntry     = 1
+	mdbaMdbEntryInfo = 1
+	mdbPermanent     = 1
+	// sizeofBrMdbEntry is the size of struct br_mdb_entry without its
+	// trailing padding.
+	sizeofBrMdbEntry = 26
+	sizeofBrPortMsg  = 8
+)
+
+// MdbEntry is a multicast group joined on a port of a bridge, as tracked
+// by IGMP/MLD snooping or added by hand.
+type MdbEntry struct {
+	Group       string `json:"group"`
+	Port        int    `json:"port"`
+	Vlan        int    `json:"vlan,omitempty"`
+	Permanent   bool   `json:"permanent"`
+	bridgeIndex int
+}
+
+// key identifies e in the MDB of a bridge.
+func (e *MdbEntry) key() string {
+	return e.Group + "@" + strconv.Itoa(e.Vlan) + "#" + strconv.Itoa(e.Port)
+}
+
+type mdbUpdate struct {
+	entry *MdbEntry
+	add   bool
+	// entries, when set instead of entry, are the whole MDB of the bridge
+	// as dumped.
+	entries []*MdbEntry
+}
+
+// brPortMsg is struct br_port_msg, the header of MDB messages.
+type brPortMsg struct {
+	family  uint8
+	ifindex uint32
+}
+
+func (m *brPortMsg) Len() int {
+	return sizeofBrPortMsg
+}
+
+func (m *brPortMsg) Serialize() []byte {
+	b := make([]byte, sizeofBrPortMsg)
+	b[0] = m.family
+	nl.NativeEndian().PutUint32(b[4:], m.ifindex)
+	return b
+}
+
+// ParseMdb returns the entries carried by the payload of an RTM_NEWMDB or
+// RTM_DELMDB message. Entries of groups other than IPv4 and IPv6 ones are
+// skipped.
+func ParseMdb(b []byte) ([]*MdbEntry, error) {
+	if len(b) < sizeofBrPortMsg {
+		return nil, syscall.EINVAL
+	}
+	bridge := int(nl.NativeEndian().Uint32(b[4:8]))
+	attrs, err := nl.ParseRouteAttr(b[sizeofBrPortMsg:])
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*MdbEntry, 0)
+	for _, attr := range attrs {
+		if attr.Attr.Type&^unix.NLA_F_NESTED != mdbaMdb {
+			continue
+		}
+		mdb, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range mdb {
+			if entry.Attr.Type&^unix.NLA_F_NESTED != mdbaMdbEntry {
+				continue
+			}
+			infos, err := nl.ParseRouteAttr(entry.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range infos {
+				if info.Attr.Type&^unix.NLA_F_NESTED != mdbaMdbEntryInfo {
+					continue
+				}
+				if e := parseBrMdbEntry(info.Value); e != nil {
+					e.bridgeIndex = bridge
+					entries = append(entries, e)
+				}
+			}
+		}
+	}
+	return entries, nil
+}
+
+// parseBrMdbEntry decodes a struct br_mdb_entry: ifindex, state, flags,
+// vid, then the group address followed by its big endian protocol.
+func parseBrMdbEntry(b []byte) *MdbEntry {
+	if len(b) < sizeofBrMdbEntry {
+		return nil
+	}
+	e := &MdbEntry{
+		Port:      int(nl.NativeEndian().Uint32(b[0:4])),
+		Permanent: b[4] == mdbPermanent,
+		Vlan:      int(nl.NativeEndian().Uint16(b[6:8])),
+	}
+	switch binary.BigEndian.Uint16(b[24:26]) {
+	case unix.ETH_P_IP:
+		e.Group = net.IP(b[8:12]).String()
+	case unix.ETH_P_IPV6:
+		e.Group = net.IP(b[8:24]).String()
+	default:
+		return nil
+	}
+	return e
+}
+
+// UpdateMdb adds or removes the entries of an RTM_NEWMDB or RTM_DELMDB
+// message from the MDB of their bridge.
+func (n *Namespace) UpdateMdb(entries []*MdbEntry, add bool) {
+	bridges := make([]*L2Bridge, len(entries))
+	n.topology.rlockState()
+	for i, e := range entries {
+		bridges[i], _ = n.L2Devices[e.bridgeIndex].(*L2Bridge)
+	}
+	n.topology.runlockState()
+	// A bridge being removed no longer runs its goroutine, the remaining
+	// entries of a bridge that did not answer are dropped.
+	removed := make(map[*L2Bridge]bool)
+	for i, e := range entries {
+		b := bridges[i]
+		if b == nil || removed[b] {
+			continue
+		}
+		select {
+		case *b.mdbChannel <- mdbUpdate{entry: e, add: add}:
+		case <-time.After(deviceQueryTimeout):
+			removed[b] = true
+		}
+	}
+}
+
+// RefreshMdb dumps the MDB of every bridge of n. Later changes are picked
+// up from RTNLGRP_MDB notifications.
+func (n *Namespace) RefreshMdb() error {
+	req := nl.NewNetlinkRequest(unix.RTM_GETMDB, unix.NLM_F_DUMP)
+	req.AddData(&brPortMsg{family: unix.AF_BRIDGE})
+	msgs, err := n.execute(req, unix.RTM_NEWMDB)
+	if err != nil {
+		return err
+	}
+	entries := make([]*MdbEntry, 0)
+	for _, m := range msgs {
+		e, err := ParseMdb(m)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e...)
+	}
+	n.syncMdb(entries)
+	return nil
+}
+
+// syncMdb makes the MDB of every bridge of n its entries of a dump,
+// forgetting those the kernel no longer has. It makes up for the
+// notifications an MDB listener lost.
+func (n *Namespace) syncMdb(entries []*MdbEntry) {
+	mdb := make(map[int][]*MdbEntry)
+	for _, e := range entries {
+		mdb[e.bridgeIndex] = append(mdb[e.bridgeIndex], e)
+	}
+	bridges := make([]*L2Bridge, 0)
+	n.topology.rlockState()
+	for _, d := range n.L2Devices {
+		if b, ok := d.(*L2Bridge); ok {
+			bridges = append(bridges, b)
+		}
+	}
+	n.topology.runlockState()
+	for _, b := range bridges {
+		u := mdbUpdate{entries: mdb[b.Index]}
+		if u.entries == nil {
+			u.entries = make([]*MdbEntry, 0)
+		}
+		select {
+		case *b.mdbChannel <- u:
+		case <-time.After(deviceQueryTimeout):
+		}
+	}
+}
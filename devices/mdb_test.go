@@ -0,0 +1,148 @@
+package devices
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// brMdbEntry encodes a struct br_mdb_entry with its trailing padding.
+func brMdbEntry(port int, permanent bool, vlan int, group net.IP, proto uint16) []byte {
+	b := make([]byte, 28)
+	nl.NativeEndian().PutUint32(b[0:4], uint32(port))
+	if permanent {
+		b[4] = mdbPermanent
+	}
+	nl.NativeEndian().PutUint16(b[6:8], uint16(vlan))
+	if ip4 := group.To4(); ip4 != nil {
+		copy(b[8:12], ip4)
+	} else {
+		copy(b[8:24], group)
+	}
+	binary.BigEndian.PutUint16(b[24:26], proto)
+	return b
+}
+
+func mdbMessage(bridge int, entries ...[]byte) []byte {
+	mdb := nl.NewRtAttr(mdbaMdb|unix.NLA_F_NESTED, nil)
+	entry := mdb.AddRtAttr(mdbaMdbEntry|unix.NLA_F_NESTED, nil)
+	for _, e := range entries {
+		entry.AddRtAttr(mdbaMdbEntryInfo, e)
+	}
+	return append((&brPortMsg{family: unix.AF_BRIDGE, ifindex: uint32(bridge)}).Serialize(), mdb.Serialize()...)
+}
+
+func TestParseMdb(t *testing.T) {
+	got, err := ParseMdb(mdbMessage(5, brMdbEntry(7, false, 0, net.ParseIP("239.1.1.1"), unix.ETH_P_IP)))
+	want := []*MdbEntry{{Group: "239.1.1.1", Port: 7, bridgeIndex: 5}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseMdb() = %+v, %v, want %+v", got, err, want)
+	}
+	got, err = ParseMdb(mdbMessage(5, brMdbEntry(8, true, 10, net.ParseIP("ff0e::1"), unix.ETH_P_IPV6)))
+	want = []*MdbEntry{{Group: "ff0e::1", Port: 8, Vlan: 10, Permanent: true, bridgeIndex: 5}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseMdb() = %+v, %v, want %+v", got, err, want)
+	}
+	// Entries of other protocols, such as L2 groups, are skipped.
+	got, err = ParseMdb(mdbMessage(5,
+		brMdbEntry(7, false, 0, net.ParseIP("239.1.1.1"), unix.ETH_P_IP),
+		brMdbEntry(7, false, 0, nil, 0),
+		brMdbEntry(9, false, 0, net.ParseIP("239.1.1.2"), unix.ETH_P_IP)))
+	want = []*MdbEntry{{Group: "239.1.1.1", Port: 7, bridgeIndex: 5}, {Group: "239.1.1.2", Port: 9, bridgeIndex: 5}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseMdb() = %+v, %v, want %+v", got, err, want)
+	}
+	got, err = ParseMdb(mdbMessage(5, brMdbEntry(7, false, 0, net.ParseIP("239.1.1.1"), unix.ETH_P_IP)[:20]))
+	if err != nil || len(got) != 0 {
+		t.Errorf("ParseMdb() of a truncated entry = %+v, %v, want none", got, err)
+	}
+	if _, err := ParseMdb([]byte{unix.AF_BRIDGE}); err == nil {
+		t.Error("ParseMdb() of a truncated message succeeded")
+	}
+}
+
+func TestMdbEntry_key(t *testing.T) {
+	a := &MdbEntry{Group: "239.1.1.1", Port: 7}
+	if a.key() == (&MdbEntry{Group: "239.1.1.1", Port: 8}).key() ||
+		a.key() == (&MdbEntry{Group: "239.1.1.1", Port: 7, Vlan: 10}).key() {
+		t.Error("key() does not tell ports and VLANs apart")
+	}
+	if a.key() != (&MdbEntry{Group: "239.1.1.1", Port: 7, Permanent: true}).key() {
+		t.Error("key() depends on the state of the entry")
+	}
+}
+
+func TestNamespace_UpdateMdb(t *testing.T) {
+	n, b := fdbNamespace()
+	join := []*MdbEntry{{Group: "239.1.1.1", Port: 7, bridgeIndex: 5}, {Group: "ff0e::1", Port: 7, bridgeIndex: 5},
+		{Group: "239.1.1.2", Port: 7, bridgeIndex: 6}}
+	n.UpdateMdb(join, true)
+	n.UpdateMdb(join[:1], true)
+	n.UpdateMdb(join[1:2], false)
+	b.DeleteDevice()
+	if len(b.Mdb) != 1 || b.Mdb[join[0].key()] == nil {
+		t.Errorf("Mdb = %+v, want only 239.1.1.1 on port 7", b.Mdb)
+	}
+}
+
+func TestNamespace_UpdateMdbOfRemovedBridge(t *testing.T) {
+	n, b := fdbNamespace()
+	// The kernel flushes the MDB of a bridge it deletes, which RemoveDevice
+	// stops before it takes it out of L2Devices.
+	b.DeleteDevice()
+	leave := []*MdbEntry{{Group: "239.1.1.1", Port: 7, bridgeIndex: 5}, {Group: "239.1.1.2", Port: 7, bridgeIndex: 5},
+		{Group: "239.1.1.3", Port: 7, bridgeIndex: 5}}
+	done := make(chan bool)
+	go func() {
+		n.UpdateMdb(leave, false)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * deviceQueryTimeout):
+		t.Error("UpdateMdb() blocked on a removed bridge")
+	}
+}
+
+func TestNamespace_UpdateMdbWhileAddingDevices(t *testing.T) {
+	n, _ := fdbNamespace()
+	stop, done := make(chan bool), make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+				index := 1000 + i%100
+				n.setL2Device(index, &Veth{L2Device: &L2Device{Name: "eth" + strconv.Itoa(i), Index: index}})
+			}
+		}
+	}()
+	for i := 0; i < 300; i++ {
+		n.UpdateMdb([]*MdbEntry{{Group: "239.1.1.1", Port: 7, bridgeIndex: 5}}, i%2 == 0)
+	}
+	stop <- true
+	<-done
+}
+
+func TestNamespace_syncMdb(t *testing.T) {
+	n, b := fdbNamespace()
+	left := &MdbEntry{Group: "239.1.1.1", Port: 7, bridgeIndex: 5}
+	kept := &MdbEntry{Group: "239.1.1.2", Port: 7, bridgeIndex: 5}
+	n.UpdateMdb([]*MdbEntry{left, kept}, true)
+
+	// The listener lost port 7 leaving 239.1.1.1 and joining ff0e::1.
+	joined := &MdbEntry{Group: "ff0e::1", Port: 7, bridgeIndex: 5}
+	n.syncMdb([]*MdbEntry{{Group: "239.1.1.2", Port: 7, bridgeIndex: 5}, joined})
+	b.DeleteDevice()
+	if len(b.Mdb) != 2 || b.Mdb[left.key()] != nil || b.Mdb[kept.key()] != kept || b.Mdb[joined.key()] != joined {
+		t.Errorf("Mdb = %+v, want 239.1.1.2 as joined first and ff0e::1", b.Mdb)
+	}
+}
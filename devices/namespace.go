@@ -6,6 +6,8 @@ import (
 	"net"
 
 	"strconv"
+	"sync"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
@@ -21,6 +23,10 @@ const (
 	NSDisconnect
 	NSRouteAdd
 	NSRouteDelete
+	NSRuleAdd
+	NSRuleDelete
+	NSNexthopAdd
+	NSNexthopDelete
 )
 
 var NSEventStrings = []string{
@@ -31,6 +37,10 @@ var NSEventStrings = []string{
 	"NSDisconnect",
 	"NSRouteAdd",
 	"NSRouteDelete",
+	"NSRuleAdd",
+	"NSRuleDelete",
+	"NSNexthopAdd",
+	"NSNexthopDelete",
 }
 
 func (e NSEvent) String() string {
@@ -42,27 +52,47 @@ func (e NSEvent) String() string {
 	return ""
 }
 
-var defaultNsSubscriber []func(*Namespace, NSEvent)
+// Namespace callbacks get the item an event is about: the *Route of
+// NSRouteAdd and NSRouteDelete, the *Rule of NSRuleAdd and NSRuleDelete,
+// the *Nexthop of NSNexthopAdd and NSNexthopDelete, and the peer device,
+// "namespace:index", of NSConnect and NSDisconnect. It is nil otherwise.
+var defaultNsSubscriber []func(*Namespace, NSEvent, interface{})
 
-func SubscribeAllNamespaceEvents(callback func(*Namespace, NSEvent)) {
+func SubscribeAllNamespaceEvents(callback func(*Namespace, NSEvent, interface{})) {
 	defaultNsSubscriber = append(defaultNsSubscriber, callback)
 }
 
 type Namespace struct {
-	Name           string
-	Type           string
-	nsHandle       *netns.NsHandle
-	L2Devices      map[int]LinkUpdateReceiver
-	L3Devices      map[int]LinkAddrUpdateReceiver
-	Connections    map[string]string
-	onchange       map[NSEvent][]func(namespace *Namespace, change NSEvent)
-	Routes         []netlink.Route
-	topology       *Topology
-	peeringChannel *chan PeerEvent
-	Event          string `json:"event"`
-}
-
-func (n *Namespace) OnChange(event NSEvent, callback func(*Namespace, NSEvent)) error {
+	Name        string
+	Type        string
+	Inode       uint64            `json:"inode"`
+	Aliases     []string          `json:"aliases"`
+	PIDs        []int             `json:"pids"`
+	Sources     []string          `json:"sources"`
+	Metadata    map[string]string `json:"metadata"`
+	nsHandle    *netns.NsHandle
+	L2Devices   map[int]LinkUpdateReceiver
+	L3Devices   map[int]LinkAddrUpdateReceiver
+	Connections map[string]string
+	onchange    map[NSEvent][]func(namespace *Namespace, change NSEvent, item interface{})
+	Routes      []*Route
+	Rules       []*Rule `json:"rules"`
+	// Nexthops are the kernel nexthop objects of the namespace by ID.
+	Nexthops map[int]*Nexthop `json:"nexthops"`
+	topology *Topology
+	// handle is created on first use, see netlinkHandle, and guarded by
+	// handleLock.
+	handle     *netlink.Handle
+	handleLock sync.Mutex
+	// pendingGateways are the addresses whose owner changed since the
+	// gateways of n were last placed, see Namespace.ResolveGateways.
+	pendingGateways map[string]net.IP
+	gatewayLock     sync.Mutex
+	gatewayChannel  chan bool
+	Event           string `json:"event"`
+}
+
+func (n *Namespace) OnChange(event NSEvent, callback func(*Namespace, NSEvent, interface{})) error {
 	if int(event) >= len(NSEventStrings) || int(event) < 0 {
 		return errors.New("Namespace OnChange: NSEvent unrecognized")
 	}
@@ -70,19 +100,30 @@ func (n *Namespace) OnChange(event NSEvent, callback func(*Namespace, NSEvent))
 	return nil
 }
 
-func NewNamespace(name string, t *Topology, targetNs *netns.NsHandle) Namespace {
-	p := make(chan PeerEvent)
-	r := make([]netlink.Route, 0)
-	n := Namespace{
-		Name:           name,
-		L2Devices:      make(map[int]LinkUpdateReceiver),
-		L3Devices:      make(map[int]LinkAddrUpdateReceiver),
-		Connections:    make(map[string]string),
-		nsHandle:       targetNs,
-		topology:       t,
-		onchange:       make(map[NSEvent][]func(*Namespace, NSEvent)),
-		Routes:         r,
-		peeringChannel: &p,
+func NewNamespace(name string, t *Topology, targetNs *netns.NsHandle) *Namespace {
+	r := make([]*Route, 0)
+	var inode uint64
+	if targetNs != nil {
+		var err error
+		if inode, err = NamespaceInode(*targetNs); err != nil {
+			fmt.Println("ERROR: GETTING NS INODE", name, err)
+		}
+	}
+	n := &Namespace{
+		Name:            name,
+		Inode:           inode,
+		L2Devices:       make(map[int]LinkUpdateReceiver),
+		L3Devices:       make(map[int]LinkAddrUpdateReceiver),
+		Connections:     make(map[string]string),
+		nsHandle:        targetNs,
+		topology:        t,
+		onchange:        make(map[NSEvent][]func(*Namespace, NSEvent, interface{})),
+		Routes:          r,
+		Rules:           make([]*Rule, 0),
+		Nexthops:        make(map[int]*Nexthop),
+		Metadata:        make(map[string]string),
+		pendingGateways: make(map[string]net.IP),
+		gatewayChannel:  make(chan bool, 1),
 	}
 	for index, _ := range NSEventStrings {
 		for _, defaultCallback := range defaultNsSubscriber {
@@ -91,11 +132,18 @@ func NewNamespace(name string, t *Topology, targetNs *netns.NsHandle) Namespace
 			}
 		}
 	}
-	n.fire(NSCreate)
+	n.fire(NSCreate, nil)
 	n.SetType("bridged")
 	return n
 }
 
+// setL2Device adds d to the devices of n, see Topology.stateLock.
+func (n *Namespace) setL2Device(index int, d LinkUpdateReceiver) {
+	n.topology.lockState()
+	n.L2Devices[index] = d
+	n.topology.unlockState()
+}
+
 func (n *Namespace) AddL2Device(update netlink.Link, consoleDisplay bool) {
 	index := update.Attrs().Index
 	if _, ok := n.L2Devices[index]; ok {
@@ -108,8 +156,16 @@ func (n *Namespace) AddL2Device(update netlink.Link, consoleDisplay bool) {
 		l := NewL2Bridge(update, n.topology, n.Name, consoleDisplay)
 		l.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
 		lu = l
-		n.L2Devices[update.Attrs().Index] = lu
+		n.setL2Device(index, lu)
 		go lu.ReceiveLinkUpdate()
+		n.UpdateBridgeState(update.Attrs().Index)
+	case "bond", "team":
+		l := NewL2Bond(update, n.topology, n.Name, consoleDisplay)
+		l.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
+		lu = l
+		n.setL2Device(index, lu)
+		go lu.ReceiveLinkUpdate()
+		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
 	case "veth":
 		v, err := NewVeth(update, n.topology, n.Name, consoleDisplay)
 		if err != nil {
@@ -117,17 +173,112 @@ func (n *Namespace) AddL2Device(update netlink.Link, consoleDisplay bool) {
 		}
 		v.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
 		lu = v
-		n.L2Devices[update.Attrs().Index] = lu
+		n.setL2Device(index, lu)
+		go lu.ReceiveLinkUpdate()
+		n.topology.PairVeth(v)
+		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
+	case "vlan":
+		v := NewVlanDevice(update, n.topology, n.Name, consoleDisplay)
+		v.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
+		lu = v
+		n.setL2Device(index, lu)
+		go lu.ReceiveLinkUpdate()
+		v.resolveLink()
+		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
+	case "macvlan", "macvtap":
+		m := NewMacvlan(update, n.topology, n.Name, consoleDisplay)
+		m.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
+		lu = m
+		n.setL2Device(index, lu)
+		go lu.ReceiveLinkUpdate()
+		m.resolveLink()
+		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
+	case "vxlan", "geneve", "gre", "gretap", "ip6gre", "ip6gretap", "ipip", "ip6tnl", "sit", "vti", "vti6":
+		var info []syscall.NetlinkRouteAttr
+		if update.Type() == "geneve" {
+			var err error
+			if _, info, err = n.linkInfoData(index); err != nil {
+				fmt.Println("ERROR: GETTING LINK INFO OF", update.Attrs().Name, err)
+			}
+		}
+		tun := NewTunnel(update, info, n.topology, n.Name, consoleDisplay)
+		tun.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
+		lu = tun
+		n.setL2Device(index, lu)
+		go lu.ReceiveLinkUpdate()
+		tun.resolveLink()
+		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
+	case "tuntap":
+		tap := NewTuntap(update, n.topology, n.Name, consoleDisplay)
+		tap.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
+		lu = tap
+		n.setL2Device(index, lu)
+		go lu.ReceiveLinkUpdate()
+		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
+	case "vrf":
+		v := NewVrf(update, n.topology, n.Name, consoleDisplay)
+		v.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
+		lu = v
+		n.setL2Device(index, lu)
 		go lu.ReceiveLinkUpdate()
+		routes := make([]*Route, 0)
+		n.topology.lockState()
+		for _, r := range n.Routes {
+			if r.Table == v.Table {
+				r.VRF = v.Name
+				routes = append(routes, r)
+			}
+		}
+		n.topology.unlockState()
+		for _, r := range routes {
+			v.updateRoute(r, true)
+		}
+		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
+	case "wireguard":
+		w := NewWireGuard(update, n.topology, n.Name, consoleDisplay)
+		w.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
+		lu = w
+		n.setL2Device(index, lu)
+		go lu.ReceiveLinkUpdate()
+		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
+	case "ipvlan":
+		i := NewIpvlan(update, n.topology, n.Name, consoleDisplay)
+		i.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
+		lu = i
+		n.setL2Device(index, lu)
+		go lu.ReceiveLinkUpdate()
+		i.resolveLink()
 		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
 	default:
 		l := NewL2Device(update, n.topology, n.Name, consoleDisplay)
 		l.SetFlags(update.Attrs().Flags, update.Attrs().OperState)
 		lu = l
 		go lu.ReceiveLinkUpdate()
-		n.L2Devices[update.Attrs().Index] = lu
+		n.setL2Device(index, lu)
 		n.SetMaster(update.Attrs().Index, update.Attrs().MasterIndex)
 	}
+	n.UpdateLinkInfo(update)
+	if _, ok := n.L2Devices[update.Attrs().MasterIndex].(*L2Bridge); ok {
+		n.UpdateBridgeState(update.Attrs().MasterIndex)
+	}
+	n.topology.resolveChildren(index)
+	n.topology.segmentsChanged()
+}
+
+// UpdateLinkInfo hands the full link to the device and to its master when
+// either tracks more than flags and master, e.g. the slave state of a bond
+// member.
+func (n *Namespace) UpdateLinkInfo(update netlink.Link) {
+	link := linkOf(update)
+	index := link.Attrs().Index
+	if d, ok := n.L2Devices[index].(linkInfoReceiver); ok {
+		*d.linkInfo() <- link
+	}
+	if master := link.Attrs().MasterIndex; master != 0 && master != index && link.Attrs().Slave != nil {
+		if m, ok := n.L2Devices[master].(linkInfoReceiver); ok {
+			*m.linkInfo() <- link
+		}
+	}
 }
 
 func (n *Namespace) AddL3Device(index int, addrs []netlink.Addr, consoleDisplay bool) {
@@ -137,7 +288,28 @@ func (n *Namespace) AddL3Device(index int, addrs []netlink.Addr, consoleDisplay
 	}
 	if d, ok := n.L2Devices[index]; ok {
 		l3dev := NewL3Device(index, n.Name, d, ipAddrs, consoleDisplay)
+		n.topology.lockState()
 		n.L3Devices[index] = l3dev
+		n.topology.unlockState()
+		addressChanged := func(_ *L3Device, _ L3DeviceEvent, item interface{}) {
+			n.topology.ResolveTunnels()
+			if addr, ok := item.(*net.IPNet); ok {
+				n.topology.gatewaysChanged(addr.IP)
+			}
+		}
+		l3dev.OnChange(L3DeviceAddAddress, addressChanged)
+		l3dev.OnChange(L3DeviceRemoveAddress, addressChanged)
+		reachabilityChanged := func(*L3Device, L3DeviceEvent, interface{}) {
+			n.topology.reachabilityChanged(n.Name)
+		}
+		for _, event := range []L3DeviceEvent{L3DeviceAddAddress, L3DeviceRemoveAddress,
+			L3DeviceNeighborAdd, L3DeviceNeighborState, L3DeviceNeighborDelete} {
+			l3dev.OnChange(event, reachabilityChanged)
+		}
+		n.topology.ResolveTunnels()
+		if w, ok := d.(*WireGuard); ok {
+			w.refreshSoon()
+		}
 		n.SetType("network")
 	}
 }
@@ -159,18 +331,20 @@ func (n *Namespace) RemoveDevice(index int) {
 	if dev, ok := n.L3Devices[index]; ok {
 		*dev.L3EventChannel().doneChannel <- true
 		<-*dev.L3EventChannel().doneChannel
+		n.topology.lockState()
 		delete(n.L3Devices, index)
+		n.topology.unlockState()
 	}
 	if dev, ok := n.L2Devices[index]; ok {
-		if d, ok := dev.(*L2Device); ok {
-			d.DeleteDevice()
-		} else if d, ok := dev.(*L2Bridge); ok {
-			d.DeleteDevice()
-		} else if d, ok := dev.(*Veth); ok {
+		if d, ok := dev.(DeviceDeleter); ok {
 			d.DeleteDevice()
 		}
+		n.topology.RemoveEdgesOf(getNSIndex(n.Name, index))
+		n.topology.lockState()
 		delete(n.L2Devices, index)
+		n.topology.unlockState()
 	}
+	n.topology.segmentsChanged()
 }
 
 func (n *Namespace) SetFlags(index int, f net.Flags, o netlink.LinkOperState) {
@@ -226,17 +400,18 @@ func (n *Namespace) DumpAll() {
 		*value.L3EventChannel().dumpChannel <- true
 		_ = <-*value.L3EventChannel().dumpChannel
 	}
-	for index, _ := range n.L2Devices {
-		if dev, ok := n.L2Devices[index]; !ok {
-			*dev.L2EventChannel().dump <- true
-			<-*dev.L2EventChannel().dump
-		}
+	for _, dev := range n.L2Devices {
+		*dev.L2EventChannel().dump <- true
+		<-*dev.L2EventChannel().dump
 	}
 }
 
-func (n *Namespace) fire(event NSEvent) {
+func (n *Namespace) fire(event NSEvent, item interface{}) {
 	for _, callback := range n.onchange[event] {
-		callback(n, event)
+		callback(n, event, item)
+	}
+	if event != NSTypeChange && n.topology != nil {
+		n.topology.reachabilityChanged(n.Name)
 	}
 }
 
@@ -250,68 +425,6 @@ func getNSIndex(namespace string, index int) string {
 	return namespace + ":" + strconv.Itoa(index)
 }
 
-func (n *Namespace) SendVPCreateEvent(event PeerEvent) {
-	fmt.Printf("\ncreate event\n%+v%+v\n", event.Veth, event.Event)
-	//fmt.Printf("CREATE %+v %+v\n", *event.Veth, event.Event)
-	if e, ok := n.topology.GetEvent(event); ok {
-		if e.Event == VPDelete {
-			fmt.Printf("create previously own delete event\n%+v\n%+v", e.Veth, e.Event)
-			n.topology.RemoveFromBuffer(event.GetIndex())
-			n.topology.Disconnect(getNSIndex(e.PeerNamespace, e.PeerIndex), getNSIndex(e.Namespace, e.Index))
-			event.Pair(e.PeerIndex, e.PeerName, e.PeerNamespace)
-			//e.Pair(event.PeerIndex, event.PeerName, event.PeerNamespace)
-			n.topology.Get(e.PeerNamespace).SetVethPeer(e.PeerIndex, event.Index, event.Name, event.Namespace)
-			n.topology.Connect(getNSIndex(e.PeerNamespace, event.PeerIndex),
-				getNSIndex(event.Namespace, event.Index))
-			//n.topology.Connect(e.PeerNamespace + ":"+ strings.itoa(e.PeerIndex), event.Namespace + ":" + strings.itoa(event.Index))
-			return
-		}
-	} else if e, ok := n.topology.GetPeerEvent(event); ok {
-		//fmt.Println("Create Got peer event\n")
-		fmt.Printf("create previously peer create event\n%+v\n%+v", e.Veth, e.Event)
-		if e.Event == VPCreate {
-			n.topology.RemoveFromBuffer(event.GetPeerIndex())
-			event.Pair(e.Index, e.Name, e.Namespace)
-			e.Pair(event.Index, event.Name, event.Namespace)
-			n.topology.Connect(getNSIndex(event.Namespace, event.Index), getNSIndex(e.Namespace, e.Index))
-			return
-		}
-	}
-	n.topology.AddToBuffer(event)
-}
-
-func (n *Namespace) SendVPDeleteEvent(event PeerEvent) {
-
-	fmt.Printf("\ndelete event\n%+v%+v\n", event.Veth, event.Event)
-	//if e, ok := n.topology.buffer[event.GetIndex()]; ok {
-	//	//n.topology.Connect()
-	//}
-	//fmt.Printf("Delete %+v %+v\n", *event.Veth, event.Event)
-	if e, ok := n.topology.GetEvent(event); ok {
-		//fmt.Println("Got own event\n")
-		if e.Event == VPCreate {
-			fmt.Printf("delete previously own create event\n%+v\n%+v", e.Veth, e.Event)
-			n.topology.RemoveFromBuffer(event.GetIndex())
-			e.Pair(event.PeerIndex, event.PeerName, event.PeerNamespace)
-			n.topology.Get(e.PeerNamespace).SetVethPeer(event.PeerIndex, e.Index, e.Name, e.Namespace)
-			n.topology.Disconnect(getNSIndex(event.Namespace, event.Index), getNSIndex(event.PeerNamespace, event.PeerIndex))
-			n.topology.Connect(getNSIndex(e.Namespace, e.Index), getNSIndex(event.PeerNamespace, event.PeerIndex))
-			return
-		}
-	} else if e, ok := n.topology.GetPeerEvent(event); ok {
-		//fmt.Println("Got peer event\n")
-		fmt.Printf("delete previously peer delete event\n%+v\n%+v", e.Veth, e.Event)
-		if e.Event == VPDelete {
-			e.fireChangeEvents(VethDelete)
-			event.fireChangeEvents(VethDelete)
-			n.topology.RemoveFromBuffer(event.GetPeerIndex())
-			n.topology.Disconnect(getNSIndex(e.Namespace, e.Index), getNSIndex(event.Namespace, event.Index))
-			return
-		}
-	}
-	n.topology.AddToBuffer(event)
-}
-
 func (n *Namespace) Connect(ns string) {
 	if n != nil {
 		if nTemp, ok := n.Connections[ns]; ok {
@@ -319,15 +432,17 @@ func (n *Namespace) Connect(ns string) {
 				return
 			}
 		}
+		n.topology.lockState()
 		n.Connections[ns] = ns
-		n.fire(NSConnect)
+		n.topology.unlockState()
+		n.fire(NSConnect, ns)
 		//peerNs := n.topology.Get(ns)
 		//if peerNs != nil {
 		//	n.Connections[ns] = peerNs.Name
 		//	n.fire(NSConnect)
 		//}
 	} else {
-		fmt.Println("\n\nnamespace", ns, "nil\n\n")
+		fmt.Printf("\n\nnamespace %s nil\n\n\n", ns)
 	}
 	return
 }
@@ -335,15 +450,20 @@ func (n *Namespace) Connect(ns string) {
 func (n *Namespace) Disconnect(ns string) {
 	fmt.Println("\n\nDisconnecting", n.Name, ns)
 	if _, ok := n.Connections[ns]; ok {
+		n.topology.lockState()
 		delete(n.Connections, ns)
-		n.fire(NSDisconnect)
+		n.topology.unlockState()
+		n.fire(NSDisconnect, ns)
 	}
 	return
 }
 
 func (n *Namespace) GetVeth(dev int) *Veth {
 	if n != nil {
-		if d, ok := n.L2Devices[dev]; ok {
+		n.topology.stateLock.RLock()
+		d, ok := n.L2Devices[dev]
+		n.topology.stateLock.RUnlock()
+		if ok {
 			if v, ok := d.(*Veth); ok {
 				return v
 			}
@@ -365,31 +485,186 @@ func (n *Namespace) SetType(s string) {
 	if n.Type == s {
 		return
 	}
+	n.topology.lockState()
 	n.Type = s
-	n.fire(NSTypeChange)
+	n.topology.unlockState()
+	n.fire(NSTypeChange, nil)
+}
+
+// AddMetadata records that source discovered the namespace and what it told
+// about it. Keys already set by another source are kept.
+func (n *Namespace) AddMetadata(source string, metadata map[string]string) {
+	n.topology.lockState()
+	defer n.topology.unlockState()
+	found := false
+	for _, s := range n.Sources {
+		if s == source {
+			found = true
+		}
+	}
+	if !found {
+		n.Sources = append(n.Sources, source)
+	}
+	for k, v := range metadata {
+		if _, ok := n.Metadata[k]; !ok {
+			n.Metadata[k] = v
+		}
+	}
+}
+
+func (n *Namespace) removeAlias(name string) {
+	for i, a := range n.Aliases {
+		if a == name {
+			n.Aliases = append(n.Aliases[:i], n.Aliases[i+1:]...)
+			return
+		}
+	}
 }
 
 func (n *Namespace) Delete() {
-	for _, r := range n.Routes {
-		n.DeleteRoute(r)
+	routes := make([]*Route, len(n.Routes))
+	copy(routes, n.Routes)
+	for _, r := range routes {
+		n.DeleteRoute(r.NetlinkRoute())
+	}
+	n.handleLock.Lock()
+	if n.handle != nil {
+		n.handle.Delete()
+		n.handle = nil
 	}
-	n.fire(NSDelete)
+	n.handleLock.Unlock()
+	n.fire(NSDelete, nil)
 }
+
+// AddRoute records route and fires NSRouteAdd with it.
+// Cloned routes are cache entries and are ignored.
 func (n *Namespace) AddRoute(route netlink.Route) {
+	if route.Flags&syscall.RTM_F_CLONED != 0 {
+		return
+	}
 	for _, r := range n.Routes {
-		if route.Equal(r) {
+		if r.Matches(route) {
 			return
 		}
 	}
-	n.Routes = append(n.Routes, route)
-	n.fire(NSRouteAdd)
+	r := NewRoute(route, n.deviceName(route.LinkIndex))
+	r.Nexthops = n.newRouteNexthops(route)
+	if len(n.Nexthops) != 0 {
+		n.setRouteNexthop(r)
+	}
+	r.resolveGateway(n.topology, n)
+	vrf := n.vrfByTable(r.Table)
+	if vrf != nil {
+		r.VRF = vrf.Name
+	}
+	n.topology.lockState()
+	n.Routes = append(n.Routes, r)
+	n.topology.unlockState()
+	n.fire(NSRouteAdd, r)
+	n.topology.updateRouteEdges(n)
+	n.refreshGateways()
+	if vrf != nil {
+		vrf.updateRoute(r, true)
+	}
 }
 
+// DeleteRoute removes route and fires NSRouteDelete with the removed entry.
 func (n *Namespace) DeleteRoute(route netlink.Route) {
 	for i, r := range n.Routes {
-		if route.Equal(r) {
+		if r.Matches(route) {
+			n.topology.lockState()
 			n.Routes = append(n.Routes[0:i], n.Routes[i+1:]...)
-			n.fire(NSRouteDelete)
+			n.topology.unlockState()
+			n.fire(NSRouteDelete, r)
+			n.topology.updateRouteEdges(n)
+			n.refreshGateways()
+			if vrf := n.vrfByTable(r.Table); vrf != nil {
+				vrf.updateRoute(r, false)
+			}
+			return
+		}
+	}
+}
+
+// RefreshRoutes dumps the routes of n, adding those not tracked yet and
+// deleting those the kernel no longer has. It makes up for the updates a
+// route listener lost before subscribing again.
+func (n *Namespace) RefreshRoutes() error {
+	h, err := n.netlinkHandle()
+	if err != nil {
+		return err
+	}
+	routes, err := h.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: syscall.RT_TABLE_UNSPEC},
+		netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	stale := make([]*Route, 0)
+	for _, r := range n.Routes {
+		found := false
+		for _, route := range routes {
+			if r.Matches(route) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, r)
+		}
+	}
+	for _, r := range stale {
+		n.DeleteRoute(r.NetlinkRoute())
+	}
+	for _, route := range routes {
+		n.AddRoute(route)
+	}
+	return nil
+}
+
+// vrfByTable returns the VRF of n routing through table, if any.
+func (n *Namespace) vrfByTable(table int) *Vrf {
+	n.topology.stateLock.RLock()
+	defer n.topology.stateLock.RUnlock()
+	for _, d := range n.L2Devices {
+		if vrf, ok := d.(*Vrf); ok && vrf.Table == table {
+			return vrf
+		}
+	}
+	return nil
+}
+
+// RouteTables returns the routes of n partitioned by routing table.
+func (n *Namespace) RouteTables() map[int][]*Route {
+	tables := make(map[int][]*Route)
+	for _, r := range n.Routes {
+		tables[r.Table] = append(tables[r.Table], r)
+	}
+	return tables
+}
+
+// deviceName returns the name of device index, for the goroutines other
+// than the link goroutine, which owns the devices.
+func (n *Namespace) deviceName(index int) string {
+	n.topology.rlockState()
+	defer n.topology.runlockState()
+	if d, ok := n.L2Devices[index]; ok {
+		return d.Attrs().Name
+	}
+	return ""
+}
+
+// DeviceLabel returns the name device index is best known by, which for a
+// tap is the VM or process owning it. The caller holds stateLock.
+func (n *Namespace) DeviceLabel(index int) string {
+	switch d := n.L2Devices[index].(type) {
+	case nil:
+		return strconv.Itoa(index)
+	case *Tuntap:
+		return d.Label()
+	default:
+		if name := d.Attrs().Name; name != "" {
+			return name
 		}
+		return strconv.Itoa(index)
 	}
 }
@@ -0,0 +1,18 @@
+package devices
+
+import (
+	"syscall"
+
+	"github.com/vishvananda/netns"
+)
+
+// NamespaceInode returns the nsfs inode of the namespace behind h. Two
+// handles refer to the same network namespace exactly when their inodes
+// match, whatever path they were opened from.
+func NamespaceInode(h netns.NsHandle) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(h), &st); err != nil {
+		return 0, err
+	}
+	return st.Ino, nil
+}
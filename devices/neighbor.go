@@ -0,0 +1,103 @@
+package devices
+
+import (
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Neighbor is an ARP or NDP entry of an L3Device. Gateway is set when a
+// route of the namespace goes through IP, Router when the peer announced
+// itself as an IPv6 router.
+type Neighbor struct {
+	IP      string `json:"ip"`
+	MAC     string `json:"mac,omitempty"`
+	State   string `json:"state"`
+	Router  bool   `json:"router"`
+	Gateway bool   `json:"gateway"`
+}
+
+func NewNeighbor(neigh netlink.Neigh) *Neighbor {
+	nb := &Neighbor{
+		IP:     neigh.IP.String(),
+		State:  lookupString(neighStateStrings, neigh.State),
+		Router: neigh.Flags&netlink.NTF_ROUTER != 0,
+	}
+	if neigh.HardwareAddr != nil {
+		nb.MAC = neigh.HardwareAddr.String()
+	}
+	return nb
+}
+
+// Failed reports whether the neighbour could not be resolved.
+func (nb *Neighbor) Failed() bool {
+	return nb.State == neighStateStrings[netlink.NUD_FAILED]
+}
+
+type neighUpdate struct {
+	neighbor *Neighbor
+	add      bool
+	// gateways, when set instead of neighbor, are the gateways of the
+	// namespace to set the Gateway flag of every neighbour against.
+	gateways map[string]bool
+}
+
+// UpdateNeighbor adds, updates or removes the AF_INET or AF_INET6
+// neighbour neigh on the L3Device of its link. Entries ip neigh hides by
+// default, those without ARP and those not in use yet, are ignored.
+func (n *Namespace) UpdateNeighbor(neigh netlink.Neigh, add bool) {
+	if neigh.IP == nil {
+		return
+	}
+	if add && (neigh.State == netlink.NUD_NONE || neigh.State&netlink.NUD_NOARP != 0) {
+		return
+	}
+	n.topology.rlockState()
+	d, ok := n.L3Devices[neigh.LinkIndex]
+	gateways := n.gateways()
+	n.topology.runlockState()
+	if !ok {
+		return
+	}
+	nb := NewNeighbor(neigh)
+	nb.Gateway = gateways[nb.IP]
+	sendNeighUpdate(d, neighUpdate{neighbor: nb, add: add})
+}
+
+// sendNeighUpdate hands u to the goroutine of d, which a device being
+// removed no longer runs.
+func sendNeighUpdate(d LinkAddrUpdateReceiver, u neighUpdate) {
+	select {
+	case *d.L3EventChannel().neighChannel <- u:
+	case <-time.After(deviceQueryTimeout):
+	}
+}
+
+// gateways returns the gateways of the routes of n, multipath ones
+// included. The caller holds stateLock.
+func (n *Namespace) gateways() map[string]bool {
+	gateways := make(map[string]bool)
+	for _, r := range n.Routes {
+		for _, p := range r.Paths() {
+			if p.Gateway != "" {
+				gateways[p.Gateway] = true
+			}
+		}
+	}
+	return gateways
+}
+
+// refreshGateways has every device of n set the Gateway flag of its
+// neighbours again, after a route was added or deleted.
+func (n *Namespace) refreshGateways() {
+	n.topology.rlockState()
+	gateways := n.gateways()
+	l3 := make([]LinkAddrUpdateReceiver, 0, len(n.L3Devices))
+	for _, d := range n.L3Devices {
+		l3 = append(l3, d)
+	}
+	n.topology.runlockState()
+	for _, d := range l3 {
+		sendNeighUpdate(d, neighUpdate{gateways: gateways})
+	}
+}
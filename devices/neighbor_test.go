@@ -0,0 +1,124 @@
+package devices
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// neighborNamespace returns a namespace with an L3 device eth0, index 2,
+// and the neighbour events of eth0 as "event ip gateway" strings.
+func neighborNamespace() (*Namespace, chan string) {
+	topology := NewTopology()
+	n := NewNamespace("test", topology, nil)
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}}
+	n.setL2Device(2, NewL2Device(link, topology, "test", false))
+	n.AddL3Device(2, nil, false)
+	events := make(chan string, 10)
+	record := func(dev *L3Device, event L3DeviceEvent, item interface{}) {
+		nb := item.(*Neighbor)
+		s := event.String() + " " + nb.IP
+		if nb.Gateway {
+			s += " gateway"
+		}
+		events <- s
+	}
+	l3 := n.L3Devices[2].(*L3Device)
+	for _, event := range []L3DeviceEvent{L3DeviceNeighborAdd, L3DeviceNeighborState, L3DeviceNeighborDelete,
+		L3DeviceGatewayFailed} {
+		l3.OnChange(event, record)
+	}
+	return n, events
+}
+
+func expectEvents(t *testing.T, events chan string, want ...string) {
+	for _, w := range want {
+		select {
+		case got := <-events:
+			if got != w {
+				t.Errorf("got event %q, want %q", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("no event, want %q", w)
+		}
+	}
+	select {
+	case got := <-events:
+		t.Errorf("unexpected event %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNamespace_UpdateNeighbor(t *testing.T) {
+	n, events := neighborNamespace()
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	neigh := func(ip string, state int) netlink.Neigh {
+		return netlink.Neigh{LinkIndex: 2, IP: net.ParseIP(ip), State: state, HardwareAddr: mac}
+	}
+	defaultRoute := netlink.Route{LinkIndex: 2, Gw: net.ParseIP("10.0.0.1"), Table: syscall.RT_TABLE_MAIN,
+		Type: syscall.RTN_UNICAST}
+
+	n.AddRoute(defaultRoute)
+	n.UpdateNeighbor(neigh("10.0.0.1", netlink.NUD_REACHABLE), true)
+	n.UpdateNeighbor(neigh("10.0.0.5", netlink.NUD_REACHABLE), true)
+	expectEvents(t, events, "L3DeviceNeighborAdd 10.0.0.1 gateway", "L3DeviceNeighborAdd 10.0.0.5")
+
+	// Entries ip neigh hides and those of unknown links are ignored.
+	n.UpdateNeighbor(neigh("10.0.0.6", netlink.NUD_NOARP), true)
+	n.UpdateNeighbor(netlink.Neigh{LinkIndex: 3, IP: net.ParseIP("10.0.0.7"), State: netlink.NUD_REACHABLE}, true)
+	expectEvents(t, events)
+
+	n.UpdateNeighbor(neigh("10.0.0.1", netlink.NUD_FAILED), true)
+	expectEvents(t, events, "L3DeviceNeighborState 10.0.0.1 gateway", "L3DeviceGatewayFailed 10.0.0.1 gateway")
+
+	n.DeleteRoute(defaultRoute)
+	expectEvents(t, events, "L3DeviceNeighborState 10.0.0.1")
+
+	n.UpdateNeighbor(neigh("10.0.0.5", netlink.NUD_REACHABLE), false)
+	expectEvents(t, events, "L3DeviceNeighborDelete 10.0.0.5")
+}
+
+func TestNamespace_UpdateNeighborWhileAddingRoutes(t *testing.T) {
+	n, events := neighborNamespace()
+	go func() {
+		for range events {
+		}
+	}()
+	done := make(chan bool)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			n.AddRoute(netlink.Route{LinkIndex: 2, Dst: mustCIDR("10.1." + strconv.Itoa(i) + ".0/24"),
+				Gw: net.ParseIP("10.0.0.1"), Table: syscall.RT_TABLE_MAIN, Type: syscall.RTN_UNICAST})
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		n.UpdateNeighbor(netlink.Neigh{LinkIndex: 2, IP: net.ParseIP("10.0.0.1"), State: netlink.NUD_REACHABLE}, i%2 == 0)
+	}
+	<-done
+}
+
+func TestNamespace_refreshGatewaysOfRemovedDevice(t *testing.T) {
+	n, _ := neighborNamespace()
+	// Stop the goroutine of the device the way RemoveDevice does, leaving
+	// it in L3Devices as RemoveDevice does until it takes the lock.
+	d := n.L3Devices[2]
+	*d.L3EventChannel().doneChannel <- true
+	<-*d.L3EventChannel().doneChannel
+
+	done := make(chan bool)
+	go func() {
+		n.refreshGateways()
+		n.UpdateNeighbor(netlink.Neigh{LinkIndex: 2, IP: net.ParseIP("10.0.0.1"), State: netlink.NUD_REACHABLE}, true)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * deviceQueryTimeout):
+		t.Error("refreshGateways() blocked on a removed device")
+	}
+}
@@ -0,0 +1,43 @@
+package devices
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// Exec runs f on an OS thread switched into n, for queries the netlink
+// package has no namespaced variant of.
+func (n *Namespace) Exec(f func() error) error {
+	if n.nsHandle == nil {
+		return fmt.Errorf("namespace %s has no handle", n.Name)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	curNs, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer curNs.Close()
+	if err := netns.Set(*n.nsHandle); err != nil {
+		return err
+	}
+	defer netns.Set(curNs)
+	return f()
+}
+
+// execute sends req on a NETLINK_ROUTE socket inside n and returns the
+// payloads of the answers of type resType.
+func (n *Namespace) execute(req *nl.NetlinkRequest, resType uint16) ([][]byte, error) {
+	var msgs [][]byte
+	err := n.Exec(func() error {
+		var err error
+		msgs, err = req.Execute(unix.NETLINK_ROUTE, resType)
+		return err
+	})
+	return msgs, err
+}
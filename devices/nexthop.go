@@ -0,0 +1,444 @@
+package devices
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Nexthop object messages and attributes, which neither the netlink
+// package nor x/sys know about yet.
+const (
+	RtmNewNexthop    = 104
+	RtmDelNexthop    = 105
+	rtmGetNexthop    = 106
+	RtnlGroupNexthop = 32
+	sizeofNhmsg      = 8
+	sizeofNhGroup    = 8
+	nhaID            = 1
+	nhaGroup         = 2
+	nhaBlackhole     = 4
+	nhaOif           = 5
+	nhaGateway       = 6
+	rtaNhID          = 30
+	rtmFFibMatch     = 0x2000
+)
+
+// RouteNexthop is one of the paths of a route: its outgoing device, its
+// gateway and, when the gateway address belongs to a tracked device, the
+// namespace and index of that device. Weight is the share of flows of a
+// multipath route taking this path.
+type RouteNexthop struct {
+	Gateway          string `json:"gateway,omitempty"`
+	OutputIndex      int    `json:"oifIndex"`
+	OutputInterface  string `json:"oif"`
+	Weight           int    `json:"weight"`
+	GatewayNamespace string `json:"gatewayNamespace,omitempty"`
+	GatewayIndex     int    `json:"gatewayIndex,omitempty"`
+	gw               net.IP
+}
+
+// NexthopGroupMember is a nexthop object of a group, see Nexthop.
+type NexthopGroupMember struct {
+	ID     int `json:"id"`
+	Weight int `json:"weight"`
+}
+
+// Nexthop is a kernel nexthop object, which routes refer to by ID. It is
+// either a single path, a blackhole, or a Group of other nexthops.
+type Nexthop struct {
+	ID        int                  `json:"id"`
+	Blackhole bool                 `json:"blackhole,omitempty"`
+	Group     []NexthopGroupMember `json:"group,omitempty"`
+	RouteNexthop
+}
+
+// String formats nh the way ip nexthop shows it.
+func (nh *Nexthop) String() string {
+	s := "id " + strconv.Itoa(nh.ID)
+	switch {
+	case nh.Blackhole:
+		return s + " blackhole"
+	case len(nh.Group) != 0:
+		s += " group "
+		for i, m := range nh.Group {
+			if i != 0 {
+				s += "/"
+			}
+			s += strconv.Itoa(m.ID)
+			if m.Weight != 1 {
+				s += "," + strconv.Itoa(m.Weight)
+			}
+		}
+		return s
+	}
+	if nh.Gateway != "" {
+		s += " via " + nh.Gateway
+	}
+	if nh.OutputInterface != "" {
+		s += " dev " + nh.OutputInterface
+	}
+	if nh.GatewayNamespace != "" {
+		s += " (" + nh.GatewayNamespace + ")"
+	}
+	return s
+}
+
+// nhmsg is struct nhmsg, the header of nexthop messages.
+type nhmsg struct {
+	family uint8
+}
+
+func (m *nhmsg) Len() int {
+	return sizeofNhmsg
+}
+
+func (m *nhmsg) Serialize() []byte {
+	b := make([]byte, sizeofNhmsg)
+	b[0] = m.family
+	return b
+}
+
+// ParseNexthop decodes the payload of an RTM_NEWNEXTHOP or RTM_DELNEXTHOP
+// message.
+func ParseNexthop(b []byte) (*Nexthop, error) {
+	if len(b) < sizeofNhmsg {
+		return nil, syscall.EINVAL
+	}
+	attrs, err := nl.ParseRouteAttr(b[sizeofNhmsg:])
+	if err != nil {
+		return nil, err
+	}
+	native := nl.NativeEndian()
+	nh := &Nexthop{}
+	nh.Weight = 1
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nhaID:
+			nh.ID = int(native.Uint32(attr.Value))
+		case nhaBlackhole:
+			nh.Blackhole = true
+		case nhaOif:
+			nh.OutputIndex = int(native.Uint32(attr.Value))
+		case nhaGateway:
+			nh.gw = net.IP(attr.Value)
+			nh.Gateway = nh.gw.String()
+		case nhaGroup:
+			// struct nexthop_grp: id, weight - 1, two reserved fields.
+			for i := 0; i+sizeofNhGroup <= len(attr.Value); i += sizeofNhGroup {
+				nh.Group = append(nh.Group, NexthopGroupMember{
+					ID:     int(native.Uint32(attr.Value[i : i+4])),
+					Weight: int(attr.Value[i+4]) + 1,
+				})
+			}
+		}
+	}
+	return nh, nil
+}
+
+// newRouteNexthops returns the paths of a multipath route. The weight of a
+// path is its hop count plus one, as ip route shows it.
+func (n *Namespace) newRouteNexthops(route netlink.Route) []*RouteNexthop {
+	if len(route.MultiPath) == 0 {
+		return nil
+	}
+	paths := make([]*RouteNexthop, 0, len(route.MultiPath))
+	for _, info := range route.MultiPath {
+		p := &RouteNexthop{
+			OutputIndex:     info.LinkIndex,
+			OutputInterface: n.deviceName(info.LinkIndex),
+			Weight:          info.Hops + 1,
+			gw:              info.Gw,
+		}
+		if info.Gw != nil {
+			p.Gateway = info.Gw.String()
+		}
+		n.topology.resolveGateway(n, p)
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// AddNexthop records nh, replacing the object with the same ID, and fires
+// NSNexthopAdd with it.
+func (n *Namespace) AddNexthop(nh *Nexthop) {
+	n.addNexthop(nh)
+	n.expandRouteNexthops(nh.ID)
+}
+
+// addNexthop is AddNexthop without refreshing the routes using nh.
+func (n *Namespace) addNexthop(nh *Nexthop) {
+	nh.OutputInterface = n.deviceName(nh.OutputIndex)
+	n.topology.resolveGateway(n, &nh.RouteNexthop)
+	n.topology.lockState()
+	n.Nexthops[nh.ID] = nh
+	n.topology.unlockState()
+	n.fire(NSNexthopAdd, nh)
+}
+
+// DeleteNexthop forgets the nexthop object with the ID of nh and fires
+// NSNexthopDelete. The kernel removes the routes using it on its own.
+func (n *Namespace) DeleteNexthop(nh *Nexthop) {
+	old, ok := n.Nexthops[nh.ID]
+	if !ok {
+		return
+	}
+	n.topology.lockState()
+	delete(n.Nexthops, nh.ID)
+	n.topology.unlockState()
+	n.fire(NSNexthopDelete, old)
+	n.expandRouteNexthops(nh.ID)
+}
+
+// expandRouteNexthops refreshes the paths of the routes using nexthop
+// object id, directly or through a group, and their routes-via edges.
+func (n *Namespace) expandRouteNexthops(id int) {
+	changed := false
+	n.topology.lockState()
+	for _, r := range n.Routes {
+		if r.NexthopID != 0 && n.nexthopUses(r.NexthopID, id) {
+			r.Nexthops = n.NexthopPaths(r.NexthopID)
+			changed = true
+		}
+	}
+	n.topology.unlockState()
+	if changed {
+		n.topology.updateRouteEdges(n)
+	}
+}
+
+// nexthopUses reports whether nexthop object id is member or a group
+// containing it.
+func (n *Namespace) nexthopUses(id, member int) bool {
+	if id == member {
+		return true
+	}
+	if nh, ok := n.Nexthops[id]; ok {
+		for _, m := range nh.Group {
+			if m.ID == member {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RefreshNexthops dumps the nexthop objects of n. Later changes are picked
+// up from RTNLGRP_NEXTHOP notifications. Kernels before 5.3 have no
+// nexthop objects and fail the dump.
+func (n *Namespace) RefreshNexthops() error {
+	req := nl.NewNetlinkRequest(rtmGetNexthop, unix.NLM_F_DUMP)
+	req.AddData(&nhmsg{family: unix.AF_UNSPEC})
+	msgs, err := n.execute(req, RtmNewNexthop)
+	if err != nil {
+		return err
+	}
+	nexthops := make([]*Nexthop, 0, len(msgs))
+	for _, m := range msgs {
+		nh, err := ParseNexthop(m)
+		if err != nil {
+			return err
+		}
+		nexthops = append(nexthops, nh)
+	}
+	n.syncNexthops(nexthops)
+	if len(n.Nexthops) == 0 {
+		return nil
+	}
+	// Routes dumped before the objects were known are linked to them from
+	// a single dump of the routes, and expanded once.
+	ids, err := n.routeNexthopIDs()
+	if err != nil {
+		return err
+	}
+	n.topology.lockState()
+	for _, r := range n.Routes {
+		if id, ok := ids[routeNexthopKey(r.Table, routeDst(r.route), r.route.Priority)]; ok {
+			r.NexthopID = id
+		}
+		if r.NexthopID != 0 {
+			r.Nexthops = n.NexthopPaths(r.NexthopID)
+		}
+	}
+	n.topology.unlockState()
+	n.topology.updateRouteEdges(n)
+	return nil
+}
+
+// syncNexthops makes the nexthop objects of n those of a dump, deleting
+// those the kernel no longer has. It makes up for the notifications a
+// nexthop listener lost.
+func (n *Namespace) syncNexthops(nexthops []*Nexthop) {
+	ids := make(map[int]bool)
+	for _, nh := range nexthops {
+		ids[nh.ID] = true
+	}
+	stale := make([]*Nexthop, 0)
+	for id, nh := range n.Nexthops {
+		if !ids[id] {
+			stale = append(stale, nh)
+		}
+	}
+	for _, nh := range stale {
+		n.DeleteNexthop(nh)
+	}
+	for _, nh := range nexthops {
+		n.addNexthop(nh)
+	}
+}
+
+// routeNexthopIDs dumps the routes of n and returns the nexthop object of
+// those using one, by routeNexthopKey.
+func (n *Namespace) routeNexthopIDs() (map[string]int, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETROUTE, unix.NLM_F_DUMP)
+	req.AddData(&nl.RtMsg{RtMsg: unix.RtMsg{Family: unix.AF_UNSPEC}})
+	msgs, err := n.execute(req, unix.RTM_NEWROUTE)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int)
+	for _, m := range msgs {
+		msg := nl.DeserializeRtMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+		table, priority, id := int(msg.Table), 0, 0
+		var dst net.IP
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.RTA_TABLE:
+				table = int(nl.NativeEndian().Uint32(attr.Value))
+			case unix.RTA_PRIORITY:
+				priority = int(nl.NativeEndian().Uint32(attr.Value))
+			case unix.RTA_DST:
+				dst = net.IP(attr.Value)
+			case rtaNhID:
+				id = int(nl.NativeEndian().Uint32(attr.Value))
+			}
+		}
+		if id == 0 {
+			continue
+		}
+		if dst == nil {
+			dst = net.IPv6zero
+			if msg.Family == unix.AF_INET {
+				dst = net.IPv4zero.To4()
+			}
+		}
+		ipNet := &net.IPNet{IP: dst, Mask: net.CIDRMask(int(msg.Dst_len), 8*len(dst))}
+		ids[routeNexthopKey(table, ipNet, priority)] = id
+	}
+	return ids, nil
+}
+
+// routeNexthopKey identifies a route of a namespace by its table,
+// destination and metric.
+func routeNexthopKey(table int, dst *net.IPNet, priority int) string {
+	return strconv.Itoa(table) + " " + dst.String() + " " + strconv.Itoa(priority)
+}
+
+// setRouteNexthop links r to the nexthop object it uses, if any, and
+// expands the paths of the object onto r. It asks the kernel about r, see
+// RefreshNexthops for routes known before the objects.
+func (n *Namespace) setRouteNexthop(r *Route) {
+	if id := n.routeNexthopID(r.route); id != 0 {
+		n.topology.lockState()
+		r.NexthopID = id
+		r.Nexthops = n.NexthopPaths(id)
+		n.topology.unlockState()
+	}
+}
+
+// NexthopPaths returns the single paths nexthop object id expands to,
+// with the weight each has within its group.
+func (n *Namespace) NexthopPaths(id int) []*RouteNexthop {
+	nh, ok := n.Nexthops[id]
+	if !ok {
+		return nil
+	}
+	if len(nh.Group) == 0 {
+		if nh.Blackhole {
+			return nil
+		}
+		p := nh.RouteNexthop
+		return []*RouteNexthop{&p}
+	}
+	paths := make([]*RouteNexthop, 0, len(nh.Group))
+	for _, member := range nh.Group {
+		if m, ok := n.Nexthops[member.ID]; ok && !m.Blackhole {
+			p := m.RouteNexthop
+			p.Weight = member.Weight
+			paths = append(paths, &p)
+		}
+	}
+	return paths
+}
+
+// routeNexthopID asks the kernel which nexthop object route uses, if any.
+// The netlink package drops RTA_NH_ID, so the route is looked up again
+// with RTM_F_FIB_MATCH, which answers with the matching FIB entry.
+func (n *Namespace) routeNexthopID(route netlink.Route) int {
+	ipNet := routeDst(route)
+	dst := ipNet.IP
+	dstLen, _ := ipNet.Mask.Size()
+	family := unix.AF_INET6
+	if dst.To4() != nil {
+		family, dst = unix.AF_INET, dst.To4()
+	}
+	req := nl.NewNetlinkRequest(unix.RTM_GETROUTE, unix.NLM_F_ACK)
+	msg := &nl.RtMsg{RtMsg: unix.RtMsg{Family: uint8(family), Flags: rtmFFibMatch}}
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(unix.RTA_DST, dst))
+	req.AddData(nl.NewRtAttr(unix.RTA_TABLE, nl.Uint32Attr(uint32(route.Table))))
+	msgs, err := n.execute(req, unix.RTM_NEWROUTE)
+	if err != nil || len(msgs) == 0 {
+		return 0
+	}
+	reply := nl.DeserializeRtMsg(msgs[0])
+	if int(reply.Dst_len) != dstLen {
+		return 0
+	}
+	attrs, err := nl.ParseRouteAttr(msgs[0][reply.Len():])
+	if err != nil {
+		return 0
+	}
+	id, priority := 0, 0
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case rtaNhID:
+			id = int(nl.NativeEndian().Uint32(attr.Value))
+		case unix.RTA_PRIORITY:
+			priority = int(nl.NativeEndian().Uint32(attr.Value))
+		}
+	}
+	if priority != route.Priority {
+		return 0
+	}
+	return id
+}
+
+// routeDst returns the destination of route, the default route of its
+// family when it has none.
+func routeDst(route netlink.Route) *net.IPNet {
+	if route.Dst != nil {
+		return route.Dst
+	}
+	if gw := routeGateway(route); gw != nil && gw.To4() == nil {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
+
+// routeGateway returns a gateway of route, to tell its family when it has
+// no destination.
+func routeGateway(route netlink.Route) net.IP {
+	if route.Gw != nil || len(route.MultiPath) == 0 {
+		return route.Gw
+	}
+	return route.MultiPath[0].Gw
+}
@@ -0,0 +1,201 @@
+package devices
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func nexthopMessage(attrs ...*nl.RtAttr) []byte {
+	b := (&nhmsg{family: unix.AF_INET}).Serialize()
+	for _, attr := range attrs {
+		b = append(b, attr.Serialize()...)
+	}
+	return b
+}
+
+// nexthopGroup encodes struct nexthop_grp entries, weights as ip nexthop
+// shows them.
+func nexthopGroup(members ...NexthopGroupMember) []byte {
+	b := make([]byte, 0, len(members)*sizeofNhGroup)
+	for _, m := range members {
+		b = append(b, nl.Uint32Attr(uint32(m.ID))...)
+		b = append(b, byte(m.Weight-1), 0, 0, 0)
+	}
+	return b
+}
+
+// parsedNexthop returns the nexthop object of msg as ip nexthop shows it.
+func parsedNexthop(t *testing.T, msg []byte) string {
+	nh, err := ParseNexthop(msg)
+	if err != nil {
+		t.Fatalf("ParseNexthop() error = %v", err)
+	}
+	return nh.String()
+}
+
+func TestParseNexthop(t *testing.T) {
+	gateway := nexthopMessage(
+		nl.NewRtAttr(nhaID, nl.Uint32Attr(1)),
+		nl.NewRtAttr(nhaOif, nl.Uint32Attr(2)),
+		nl.NewRtAttr(nhaGateway, net.ParseIP("192.168.0.1").To4()))
+	if got, want := parsedNexthop(t, gateway), "id 1 via 192.168.0.1"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	nh, _ := ParseNexthop(gateway)
+	if nh.OutputIndex != 2 || nh.Weight != 1 || !nh.gw.Equal(net.ParseIP("192.168.0.1")) {
+		t.Errorf("ParseNexthop() = %+v, want device 2, weight 1 and gateway 192.168.0.1", nh)
+	}
+	got := parsedNexthop(t, nexthopMessage(
+		nl.NewRtAttr(nhaID, nl.Uint32Attr(2)),
+		nl.NewRtAttr(nhaOif, nl.Uint32Attr(3))))
+	if want := "id 2"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedNexthop(t, nexthopMessage(
+		nl.NewRtAttr(nhaID, nl.Uint32Attr(3)),
+		nl.NewRtAttr(nhaBlackhole, []byte{})))
+	if want := "id 3 blackhole"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedNexthop(t, nexthopMessage(
+		nl.NewRtAttr(nhaID, nl.Uint32Attr(10)),
+		nl.NewRtAttr(nhaGroup, nexthopGroup(NexthopGroupMember{1, 1}, NexthopGroupMember{2, 3}))))
+	if want := "id 10 group 1/2,3"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	if _, err := ParseNexthop([]byte{unix.AF_INET}); err == nil {
+		t.Error("ParseNexthop() of a truncated message succeeded")
+	}
+}
+
+// pathStrings returns the gateways and weights of paths.
+func pathStrings(paths []*RouteNexthop) []string {
+	s := make([]string, 0, len(paths))
+	for _, p := range paths {
+		s = append(s, p.Gateway+"/"+strconv.Itoa(p.Weight))
+	}
+	return s
+}
+
+func TestNamespace_NexthopPaths(t *testing.T) {
+	n := &Namespace{Nexthops: map[int]*Nexthop{
+		1:  {ID: 1, RouteNexthop: RouteNexthop{Gateway: "192.168.0.1", OutputIndex: 2, Weight: 1}},
+		2:  {ID: 2, RouteNexthop: RouteNexthop{Gateway: "192.168.1.1", OutputIndex: 3, Weight: 1}},
+		3:  {ID: 3, Blackhole: true},
+		10: {ID: 10, Group: []NexthopGroupMember{{1, 1}, {2, 3}}},
+		11: {ID: 11, Group: []NexthopGroupMember{{1, 2}, {3, 1}, {4, 1}}},
+	}}
+	if got, want := pathStrings(n.NexthopPaths(1)), []string{"192.168.0.1/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NexthopPaths(1) = %v, want %v", got, want)
+	}
+	if got := n.NexthopPaths(3); len(got) != 0 {
+		t.Errorf("NexthopPaths() of a blackhole = %v, want none", pathStrings(got))
+	}
+	if got := n.NexthopPaths(4); len(got) != 0 {
+		t.Errorf("NexthopPaths() of an unknown ID = %v, want none", pathStrings(got))
+	}
+	got := pathStrings(n.NexthopPaths(10))
+	if want := []string{"192.168.0.1/1", "192.168.1.1/3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NexthopPaths(10) = %v, want %v", got, want)
+	}
+	// Blackholes and unknown members of a group carry no traffic.
+	if got, want := pathStrings(n.NexthopPaths(11)), []string{"192.168.0.1/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NexthopPaths(11) = %v, want %v", got, want)
+	}
+	if !n.nexthopUses(11, 1) || !n.nexthopUses(1, 1) || n.nexthopUses(10, 3) {
+		t.Error("nexthopUses() does not follow the groups")
+	}
+}
+
+func TestRouteDst(t *testing.T) {
+	if got := routeDst(netlink.Route{Dst: mustCIDR("10.0.0.0/8")}).String(); got != "10.0.0.0/8" {
+		t.Errorf("routeDst() = %s, want 10.0.0.0/8", got)
+	}
+	if got := routeDst(netlink.Route{Gw: net.ParseIP("192.168.0.1")}).String(); got != "0.0.0.0/0" {
+		t.Errorf("routeDst() of a default route = %s, want 0.0.0.0/0", got)
+	}
+	if got := routeDst(netlink.Route{}).String(); got != "0.0.0.0/0" {
+		t.Errorf("routeDst() of a default route without gateway = %s, want 0.0.0.0/0", got)
+	}
+	if got := routeDst(netlink.Route{Gw: net.ParseIP("fe80::1")}).String(); got != "::/0" {
+		t.Errorf("routeDst() of an IPv6 default route = %s, want ::/0", got)
+	}
+	multipath := netlink.Route{MultiPath: []*netlink.NexthopInfo{{Gw: net.ParseIP("fe80::1")}}}
+	if got := routeDst(multipath).String(); got != "::/0" {
+		t.Errorf("routeDst() of an IPv6 multipath default route = %s, want ::/0", got)
+	}
+}
+
+func TestNamespace_AddNexthop(t *testing.T) {
+	n := NewNamespace("test", NewTopology(), nil)
+	events := make([]string, 0)
+	record := func(n *Namespace, event NSEvent, item interface{}) {
+		events = append(events, event.String()+" "+item.(*Nexthop).String())
+	}
+	n.OnChange(NSNexthopAdd, record)
+	n.OnChange(NSNexthopDelete, record)
+	n.AddNexthop(&Nexthop{ID: 10, Group: []NexthopGroupMember{{1, 1}, {2, 1}}})
+	r := NewRoute(netlink.Route{Dst: mustCIDR("10.0.0.0/8"), Table: syscall.RT_TABLE_MAIN}, "")
+	r.NexthopID = 10
+	n.Routes = append(n.Routes, r)
+
+	// Members may be added after the group, as the kernel dumps them by ID.
+	n.AddNexthop(&Nexthop{ID: 1, RouteNexthop: RouteNexthop{Gateway: "192.168.0.1", OutputIndex: 2, Weight: 1}})
+	n.AddNexthop(&Nexthop{ID: 2, RouteNexthop: RouteNexthop{Gateway: "192.168.1.1", OutputIndex: 3, Weight: 1}})
+	if got, want := pathStrings(r.Nexthops), []string{"192.168.0.1/1", "192.168.1.1/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("route paths = %v, want %v", got, want)
+	}
+	n.AddNexthop(&Nexthop{ID: 10, Group: []NexthopGroupMember{{1, 1}, {2, 4}}})
+	if got, want := pathStrings(r.Nexthops), []string{"192.168.0.1/1", "192.168.1.1/4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("route paths after replacing the group = %v, want %v", got, want)
+	}
+	n.DeleteNexthop(&Nexthop{ID: 1})
+	n.DeleteNexthop(&Nexthop{ID: 1})
+	if got, want := pathStrings(r.Nexthops), []string{"192.168.1.1/4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("route paths after deleting nexthop 1 = %v, want %v", got, want)
+	}
+	want := []string{"NSNexthopAdd id 10 group 1/2", "NSNexthopAdd id 1 via 192.168.0.1",
+		"NSNexthopAdd id 2 via 192.168.1.1", "NSNexthopAdd id 10 group 1/2,4", "NSNexthopDelete id 1 via 192.168.0.1"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestNamespace_syncNexthops(t *testing.T) {
+	n := NewNamespace("test", NewTopology(), nil)
+	n.AddNexthop(&Nexthop{ID: 1, RouteNexthop: RouteNexthop{Gateway: "192.168.0.1", OutputIndex: 2, Weight: 1}})
+	n.AddNexthop(&Nexthop{ID: 2, RouteNexthop: RouteNexthop{Gateway: "192.168.1.1", OutputIndex: 3, Weight: 1}})
+	n.AddNexthop(&Nexthop{ID: 10, Group: []NexthopGroupMember{{1, 1}, {2, 1}}})
+	r := NewRoute(netlink.Route{Dst: mustCIDR("10.0.0.0/8"), Table: syscall.RT_TABLE_MAIN}, "")
+	r.NexthopID = 10
+	r.Nexthops = n.NexthopPaths(10)
+	n.Routes = append(n.Routes, r)
+	deleted := make([]int, 0)
+	n.OnChange(NSNexthopDelete, func(n *Namespace, event NSEvent, item interface{}) {
+		deleted = append(deleted, item.(*Nexthop).ID)
+	})
+
+	// The listener lost the deletion of nexthop 2, which the kernel took
+	// out of group 10.
+	n.syncNexthops([]*Nexthop{
+		{ID: 1, RouteNexthop: RouteNexthop{Gateway: "192.168.0.1", OutputIndex: 2, Weight: 1}},
+		{ID: 10, Group: []NexthopGroupMember{{1, 1}}},
+	})
+	if !reflect.DeepEqual(deleted, []int{2}) {
+		t.Errorf("syncNexthops() deleted %v, want [2]", deleted)
+	}
+	if len(n.Nexthops) != 2 || n.Nexthops[2] != nil {
+		t.Errorf("Nexthops = %v, want 1 and 10", n.Nexthops)
+	}
+	if len(r.Nexthops) != 1 || r.Nexthops[0].Gateway != "192.168.0.1" {
+		t.Errorf("route paths = %+v, want 192.168.0.1 only", r.Nexthops)
+	}
+}
@@ -0,0 +1,266 @@
+package devices
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkHandle returns a netlink handle whose sockets live in n, so that
+// queries answer from the point of view of n.
+func (n *Namespace) netlinkHandle() (*netlink.Handle, error) {
+	n.handleLock.Lock()
+	defer n.handleLock.Unlock()
+	if n.handle != nil {
+		return n.handle, nil
+	}
+	if n.nsHandle == nil {
+		return nil, fmt.Errorf("namespace %s has no handle", n.Name)
+	}
+	h, err := netlink.NewHandleAt(*n.nsHandle)
+	if err != nil {
+		return nil, err
+	}
+	n.handle = h
+	return h, nil
+}
+
+// ParseNsid returns the NETNSA_NSID attribute of the payload of an
+// RTM_NEWNSID or RTM_DELNSID message.
+func ParseNsid(b []byte) (int, bool) {
+	msg := nl.DeserializeRtGenMsg(b)
+	attrs, err := nl.ParseRouteAttr(b[msg.Len():])
+	if err != nil {
+		return 0, false
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == netlink.NETNSA_NSID && len(attr.Value) >= 4 {
+			return int(int32(nl.NativeEndian().Uint32(attr.Value))), true
+		}
+	}
+	return 0, false
+}
+
+// dumpNsids returns every nsid assigned inside n, tracked or not.
+func (n *Namespace) dumpNsids() ([]int, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETNSID, unix.NLM_F_DUMP)
+	req.AddData(nl.NewRtGenMsg())
+	msgs, err := n.execute(req, unix.RTM_NEWNSID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(msgs))
+	for _, m := range msgs {
+		if id, ok := ParseNsid(m); ok && id >= 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// RefreshNsids dumps the nsids assigned inside n and asks the kernel which
+// tracked namespace each belongs to. The kernel uses those ids in
+// IFLA_LINK_NETNSID to tell where the other end of a link lives. Ids of
+// namespaces that are not tracked are kept with an empty name.
+func (t *Topology) RefreshNsids(n *Namespace) {
+	h, err := n.netlinkHandle()
+	if err != nil {
+		fmt.Println("ERROR: GETTING NETLINK HANDLE IN NS", n.Name, err)
+		return
+	}
+	ids := make(map[int]string)
+	assigned, err := n.dumpNsids()
+	if err != nil {
+		fmt.Println("ERROR: DUMPING NSIDS IN NS", n.Name, err)
+	}
+	for _, id := range assigned {
+		ids[id] = ""
+	}
+	for _, peer := range t.namespaceList() {
+		if peer == n || peer.nsHandle == nil {
+			continue
+		}
+		id, err := h.GetNetNsIdByFd(int(*peer.nsHandle))
+		if err != nil || id < 0 {
+			continue
+		}
+		ids[id] = peer.Name
+	}
+	t.Lock()
+	t.nsids[n.Name] = ids
+	peers := make(map[string]int)
+	for id, name := range ids {
+		if name != "" {
+			peers[name] = id
+		}
+	}
+	t.peerNsids[n.Name] = peers
+	t.Unlock()
+}
+
+// ensureNsids loads the nsids of n the first time they are needed, which
+// can be before its nsid listener has started.
+func (t *Topology) ensureNsids(n *Namespace) {
+	t.Lock()
+	_, known := t.nsids[n.Name]
+	t.Unlock()
+	if !known {
+		t.RefreshNsids(n)
+	}
+}
+
+// NamespaceByNsid returns the namespace that namespace knows as nsid, or nil
+// when the id is unassigned or belongs to a namespace that is not tracked.
+func (t *Topology) NamespaceByNsid(namespace string, nsid int) *Namespace {
+	n := t.Get(namespace)
+	if n == nil {
+		return nil
+	}
+	t.ensureNsids(n)
+	t.Lock()
+	name, ok := t.nsids[namespace][nsid]
+	t.Unlock()
+	if ok && name == "" && t.nsidRefreshDue(namespace) {
+		// The id may belong to a namespace that was tracked since.
+		t.RefreshNsids(n)
+		t.Lock()
+		name = t.nsids[namespace][nsid]
+		t.Unlock()
+	}
+	if name == "" {
+		return nil
+	}
+	return t.Get(name)
+}
+
+// nsidRefreshInterval bounds how often NamespaceByNsid dumps the nsids of
+// a namespace for ids of untracked namespaces, which links to namespaces
+// that are never tracked keep asking for.
+const nsidRefreshInterval = 5 * time.Second
+
+func (t *Topology) nsidRefreshDue(namespace string) bool {
+	t.Lock()
+	defer t.Unlock()
+	if time.Since(t.nsidRefreshed[namespace]) < nsidRefreshInterval {
+		return false
+	}
+	t.nsidRefreshed[namespace] = time.Now()
+	return true
+}
+
+// Nsid returns the nsid namespace has assigned to peer.
+func (t *Topology) Nsid(namespace, peer string) (int, bool) {
+	t.Lock()
+	defer t.Unlock()
+	id, ok := t.peerNsids[namespace][peer]
+	return id, ok
+}
+
+// Nsids returns a copy of the nsids assigned inside namespace, mapped to the
+// name of the namespace they refer to.
+func (t *Topology) Nsids(namespace string) map[int]string {
+	t.Lock()
+	defer t.Unlock()
+	ids := make(map[int]string, len(t.nsids[namespace]))
+	for id, name := range t.nsids[namespace] {
+		ids[id] = name
+	}
+	return ids
+}
+
+func (t *Topology) hasNsid(namespace string, nsid int) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.nsids[namespace][nsid]
+	return ok
+}
+
+// ResolveLinkNamespace returns the namespace holding the other end or the
+// lower device of link index in n, given the NetNsID netlink reported for
+// it. netlink leaves NetNsID at 0 when IFLA_LINK_NETNSID is absent, so when
+// nsid 0 is in use the attribute is looked up directly.
+func (t *Topology) ResolveLinkNamespace(n *Namespace, index int, netNsID int) *Namespace {
+	if netNsID == 0 {
+		t.ensureNsids(n)
+		if !t.hasNsid(n.Name, 0) {
+			return n
+		}
+		id, ok := n.linkNetNsID(index)
+		if !ok {
+			return n
+		}
+		netNsID = id
+	}
+	return t.NamespaceByNsid(n.Name, netNsID)
+}
+
+// linkNetNsID fetches link index from the kernel and returns its
+// IFLA_LINK_NETNSID attribute, if any.
+func (n *Namespace) linkNetNsID(index int) (int, bool) {
+	attrs, err := n.linkAttrs(index)
+	if err != nil {
+		return 0, false
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == unix.IFLA_LINK_NETNSID && len(attr.Value) >= 4 {
+			return int(int32(nl.NativeEndian().Uint32(attr.Value))), true
+		}
+	}
+	return 0, false
+}
+
+// NsidAdded is called when the kernel assigns a new nsid in n. Links of n
+// whose other end could not be placed may now be resolvable.
+func (t *Topology) NsidAdded(n *Namespace) {
+	t.RefreshNsids(n)
+	// resolveLink takes stateLock to place the link, so the devices are
+	// collected first.
+	resolvers := make([]linkResolver, 0)
+	t.rlockState()
+	for _, d := range n.L2Devices {
+		if r, ok := d.(linkResolver); ok && !r.linkResolved() {
+			resolvers = append(resolvers, r)
+		}
+	}
+	t.runlockState()
+	for _, r := range resolvers {
+		r.resolveLink()
+	}
+}
+
+// NsidDeleted forgets nsid in n.
+func (t *Topology) NsidDeleted(n *Namespace, nsid int) {
+	t.Lock()
+	defer t.Unlock()
+	if name, ok := t.nsids[n.Name][nsid]; ok {
+		delete(t.nsids[n.Name], nsid)
+		delete(t.peerNsids[n.Name], name)
+	}
+}
+
+// Nsids returns the nsids assigned inside n, see Topology.Nsids.
+func (n *Namespace) Nsids() map[int]string {
+	return n.topology.Nsids(n.Name)
+}
+
+// NsidStrings formats ids as sorted "nsid:namespace" pairs for display.
+func NsidStrings(ids map[int]string) []string {
+	keys := make([]int, 0, len(ids))
+	for id := range ids {
+		keys = append(keys, id)
+	}
+	sort.Ints(keys)
+	s := make([]string, 0, len(keys))
+	for _, id := range keys {
+		name := ids[id]
+		if name == "" {
+			name = "untracked"
+		}
+		s = append(s, fmt.Sprintf("%d:%s", id, name))
+	}
+	return s
+}
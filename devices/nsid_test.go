@@ -0,0 +1,154 @@
+package devices
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+func nsidMessage(attrs ...*nl.RtAttr) []byte {
+	b := nl.NewRtGenMsg().Serialize()
+	for _, attr := range attrs {
+		b = append(b, attr.Serialize()...)
+	}
+	return b
+}
+
+func TestParseNsid(t *testing.T) {
+	if id, ok := ParseNsid(nsidMessage(nl.NewRtAttr(netlink.NETNSA_NSID, nl.Uint32Attr(3)))); id != 3 || !ok {
+		t.Errorf("ParseNsid() = %d, %v, want 3, true", id, ok)
+	}
+	if id, ok := ParseNsid(nsidMessage(nl.NewRtAttr(netlink.NETNSA_NSID, nl.Uint32Attr(0)))); id != 0 || !ok {
+		t.Errorf("ParseNsid() = %d, %v, want 0, true", id, ok)
+	}
+	id, ok := ParseNsid(nsidMessage(
+		nl.NewRtAttr(netlink.NETNSA_PID, nl.Uint32Attr(1234)),
+		nl.NewRtAttr(netlink.NETNSA_NSID, nl.Uint32Attr(7))))
+	if id != 7 || !ok {
+		t.Errorf("ParseNsid() = %d, %v, want 7, true", id, ok)
+	}
+	// NETNSA_NSID_NOT_ASSIGNED
+	if id, ok := ParseNsid(nsidMessage(nl.NewRtAttr(netlink.NETNSA_NSID, nl.Uint32Attr(0xffffffff)))); id != -1 || !ok {
+		t.Errorf("ParseNsid() of an unassigned id = %d, %v, want -1, true", id, ok)
+	}
+	if _, ok := ParseNsid(nsidMessage(nl.NewRtAttr(netlink.NETNSA_PID, nl.Uint32Attr(1234)))); ok {
+		t.Error("ParseNsid() without NETNSA_NSID succeeded")
+	}
+	if _, ok := ParseNsid(nsidMessage(nl.NewRtAttr(netlink.NETNSA_NSID, []byte{1, 0}))); ok {
+		t.Error("ParseNsid() of a short NETNSA_NSID succeeded")
+	}
+}
+
+func TestTopology_NamespaceByNsid(t *testing.T) {
+	topology := NewTopology()
+	a := &Namespace{Name: "a", topology: topology}
+	b := &Namespace{Name: "b", topology: topology}
+	topology.Namespaces["a"] = a
+	topology.Namespaces["b"] = b
+	topology.nsids["a"] = map[int]string{0: "b", 4: ""}
+	topology.peerNsids["a"] = map[string]int{"b": 0}
+	// Keep the untracked id from triggering a dump.
+	topology.nsidRefreshed["a"] = time.Now()
+
+	if got := topology.NamespaceByNsid("a", 0); got != b {
+		t.Errorf("NamespaceByNsid(a, 0) = %v, want b", got)
+	}
+	if got := topology.NamespaceByNsid("a", 4); got != nil {
+		t.Errorf("NamespaceByNsid() of an untracked namespace = %s, want nil", got.Name)
+	}
+	if got := topology.NamespaceByNsid("a", 5); got != nil {
+		t.Errorf("NamespaceByNsid() of an unassigned id = %s, want nil", got.Name)
+	}
+	if got := topology.NamespaceByNsid("c", 0); got != nil {
+		t.Errorf("NamespaceByNsid() in an unknown namespace = %s, want nil", got.Name)
+	}
+	if id, ok := topology.Nsid("a", "b"); !ok || id != 0 {
+		t.Errorf("Nsid(a, b) = %d, %v, want 0, true", id, ok)
+	}
+	if got, want := NsidStrings(a.Nsids()), []string{"0:b", "4:untracked"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NsidStrings() = %v, want %v", got, want)
+	}
+
+	topology.NsidDeleted(a, 0)
+	if _, ok := topology.Nsid("a", "b"); ok {
+		t.Error("NsidDeleted() kept the peer")
+	}
+	if got := topology.NamespaceByNsid("a", 0); got != nil {
+		t.Errorf("NamespaceByNsid() of a deleted id = %s, want nil", got.Name)
+	}
+	if got, want := NsidStrings(a.Nsids()), []string{"4:untracked"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NsidStrings() = %v, want %v", got, want)
+	}
+}
+
+func TestTopology_NsidAdded(t *testing.T) {
+	topology := NewTopology()
+	a := NewNamespace("a", topology, nil)
+	b := NewNamespace("b", topology, nil)
+	topology.Namespaces["a"] = a
+	topology.Namespaces["b"] = b
+	va, _ := NewVeth(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth-a", Index: 7, ParentIndex: 8, NetNsID: 3}},
+		topology, "a", false)
+	vb, _ := NewVeth(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth-b", Index: 8, ParentIndex: 7}},
+		topology, "b", false)
+	a.setL2Device(7, va)
+	b.setL2Device(8, vb)
+
+	started, stop, done := make(chan bool), make(chan bool), make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+				index := 1000 + i%100
+				a.setL2Device(index, &L2Device{Name: "eth" + strconv.Itoa(i), Index: index})
+				if i == 0 {
+					started <- true
+				}
+			}
+		}
+	}()
+	<-started
+	// a has no handle to dump its nsids with, the kernel assigned 3 to b.
+	topology.nsids["a"] = map[int]string{3: "b"}
+	topology.nsidRefreshed["a"] = time.Now()
+	for i := 0; i < 300; i++ {
+		topology.NsidAdded(a)
+	}
+	stop <- true
+	<-done
+
+	if va.PeerNamespace != "b" || va.PeerName != "veth-b" || vb.PeerNamespace != "a" || vb.PeerName != "veth-a" {
+		t.Errorf("NsidAdded() paired %s with %s/%s and %s with %s/%s", va.Name, va.PeerNamespace, va.PeerName,
+			vb.Name, vb.PeerNamespace, vb.PeerName)
+	}
+}
+
+func TestTopology_DeleteNamespaceForgetsNsids(t *testing.T) {
+	topology := NewTopology()
+	topology.CreateNamespace("a", nil)
+	topology.CreateNamespace("b", nil)
+	topology.nsids["a"] = map[int]string{3: "b"}
+	topology.peerNsids["a"] = map[string]int{"b": 3}
+	topology.nsids["b"] = map[int]string{0: "a"}
+	topology.peerNsids["b"] = map[string]int{"a": 0}
+	topology.nsidRefreshed["a"] = time.Now()
+
+	topology.DeleteNamespace("b")
+	if _, ok := topology.Nsid("a", "b"); ok {
+		t.Error("Nsid() still knows the deleted namespace")
+	}
+	// The kernel keeps the id until the namespace is freed.
+	if got := NsidStrings(topology.Nsids("a")); !reflect.DeepEqual(got, []string{"3:untracked"}) {
+		t.Errorf("NsidStrings() = %v, want [3:untracked]", got)
+	}
+	if ids := topology.Nsids("b"); len(ids) != 0 {
+		t.Errorf("Nsids() of the deleted namespace = %v, want none", ids)
+	}
+}
@@ -0,0 +1,187 @@
+package devices
+
+import (
+	"errors"
+
+	"github.com/vishvananda/netlink"
+)
+
+// parentLink is the lower device a stacked device such as a VLAN or a
+// macvlan rides on. ParentIndex is the ifindex reported by IFLA_LINK and
+// parentNetNsID the nsid reported by IFLA_LINK_NETNSID. ParentNamespace is
+// only set once the parent has been found in the topology.
+type parentLink struct {
+	ParentIndex     int    `json:"parentIndex"`
+	ParentNamespace string `json:"parentNamespace"`
+	parentNetNsID   int
+}
+
+func newParentLink(update netlink.Link) parentLink {
+	return parentLink{
+		ParentIndex:   update.Attrs().ParentIndex,
+		parentNetNsID: update.Attrs().NetNsID,
+	}
+}
+
+func (p *parentLink) linkResolved() bool {
+	return p.ParentNamespace != ""
+}
+
+// waitsFor reports whether the parent is still to be found and may be the
+// device index just added.
+func (p *parentLink) waitsFor(index int) bool {
+	return !p.linkResolved() && p.ParentIndex == index
+}
+
+// parentResolver is implemented by the stacked devices, see parentLink.
+type parentResolver interface {
+	waitsFor(index int) bool
+	resolveLink()
+}
+
+// resolveChildren retries the stacked devices, in any namespace, that were
+// created before their parent, which may be device index just added.
+func (t *Topology) resolveChildren(index int) {
+	children := make([]parentResolver, 0)
+	t.stateLock.RLock()
+	for _, n := range t.Namespaces {
+		for _, d := range n.L2Devices {
+			if r, ok := d.(parentResolver); ok && r.waitsFor(index) {
+				children = append(children, r)
+			}
+		}
+	}
+	t.stateLock.RUnlock()
+	for _, r := range children {
+		r.resolveLink()
+	}
+}
+
+// findParent looks the parent of dev up, possibly in another namespace, and
+// adds a parent to child edge of the given kind. It reports whether the
+// parent was found.
+func (p *parentLink) findParent(dev *L2Device, kind string) bool {
+	n := dev.topology.Get(dev.Namespace)
+	if n == nil || p.ParentIndex == 0 {
+		return false
+	}
+	parentNs := dev.topology.ResolveLinkNamespace(n, dev.Index, p.parentNetNsID)
+	if parentNs == nil {
+		return false
+	}
+	dev.topology.stateLock.Lock()
+	_, ok := parentNs.L2Devices[p.ParentIndex]
+	if ok {
+		p.ParentNamespace = parentNs.Name
+	}
+	dev.topology.stateLock.Unlock()
+	if !ok {
+		return false
+	}
+	dev.topology.AddEdge(Edge{
+		Kind: kind,
+		From: getNSIndex(p.ParentNamespace, p.ParentIndex),
+		To:   getNSIndex(dev.Namespace, dev.Index),
+	})
+	return true
+}
+
+type stackedEvent int
+
+// The events every stacked device fires. VlanEvent, MacvlanEvent and
+// IpvlanEvent name them in this order.
+const (
+	stackedCreate stackedEvent = iota
+	stackedParentResolve
+	stackedParentUnknown
+	stackedDelete
+)
+
+// stackedEventStrings names the stacked events of a kind of device.
+func stackedEventStrings(kind string) []string {
+	return []string{
+		kind + "Create",
+		kind + "ParentResolve",
+		kind + "ParentUnknown",
+		kind + "Delete",
+	}
+}
+
+// stackedDevice is what VLANs, macvlans and ipvlans share: an L2Device on a
+// parentLink, its goroutine and its events. The device embedding it sets
+// device to itself, which is what snapshots and dumps encode, and wraps its
+// callbacks with onStackedChange.
+type stackedDevice struct {
+	*L2Device
+	parentLink
+	edgeKind string
+	device   interface{}
+	onChange map[stackedEvent][]func(stackedEvent)
+}
+
+func newStackedDevice(update netlink.Link, t *Topology, namespace string, consoleDisplay bool,
+	edgeKind string) stackedDevice {
+	return stackedDevice{
+		L2Device:   NewL2Device(update, t, namespace, consoleDisplay),
+		parentLink: newParentLink(update),
+		edgeKind:   edgeKind,
+		onChange:   make(map[stackedEvent][]func(stackedEvent)),
+	}
+}
+
+// resolveLink looks the parent up and adds the parent to child edge, which
+// connects a container to the host NIC its macvlan rides on, for instance.
+func (s *stackedDevice) resolveLink() {
+	if s.findParent(s.L2Device, s.edgeKind) {
+		s.fireChangeEvents(stackedParentResolve)
+		return
+	}
+	s.fireChangeEvents(stackedParentUnknown)
+}
+
+func (s *stackedDevice) ReceiveLinkUpdate() {
+	for {
+		select {
+		case f := <-*(s.flagsChannel):
+			s.SetFlags(f.flags, f.operState)
+		case m := <-*(s.setMasterChannel):
+			if m.masterIndex != 0 {
+				s.SetMaster(m.masterIndex)
+			} else {
+				s.UnsetMaster()
+			}
+		case reply := <-*(s.snapshotChannel):
+			reply <- marshalDevice(s.topology, s.device)
+		case d := <-*(s.dumpChannel):
+			if d {
+				dumper.Encode(s.device)
+				*(s.dumpChannel) <- true
+			}
+		case d := <-*(s.deleteChannel):
+			if d {
+				return
+			}
+		case n := <-*(s.nameChannel):
+			s.SetName(n)
+		}
+	}
+}
+
+func (s *stackedDevice) DeleteDevice() {
+	s.L2Device.DeleteDevice()
+	s.fireChangeEvents(stackedDelete)
+}
+
+func (s *stackedDevice) onStackedChange(event stackedEvent, callback func(stackedEvent)) error {
+	if event < stackedCreate || event > stackedDelete {
+		return errors.New("OnChange: stacked device event unrecognized")
+	}
+	s.onChange[event] = append(s.onChange[event], callback)
+	return nil
+}
+
+func (s *stackedDevice) fireChangeEvents(event stackedEvent) {
+	for _, f := range s.onChange[event] {
+		f(event)
+	}
+}
@@ -0,0 +1,353 @@
+package devices
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type ReachabilityEvent int
+
+const (
+	ReachabilityGain ReachabilityEvent = iota
+	ReachabilityLoss
+	ReachabilityChange
+)
+
+var ReachabilityEventStrings = []string{
+	"ReachabilityGain",
+	"ReachabilityLoss",
+	"ReachabilityChange",
+}
+
+func (e ReachabilityEvent) String() string {
+	for i, str := range ReachabilityEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+// reachabilityDelay lets a burst of changes, such as the routes of a new
+// namespace, settle before the affected pairs are computed again.
+const reachabilityDelay = 200 * time.Millisecond
+
+// Reachability tells whether namespace From reaches namespace To. L2 is set
+// when both have an addressed device up in the same segment, L3 when a packet
+// to an address of To gets there, see Topology.Trace. When it does not,
+// Cause, one of the Trace causes, BreakAt and Reason tell where it stops.
+type Reachability struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	L2      bool   `json:"l2"`
+	L3      bool   `json:"l3"`
+	Cause   string `json:"cause,omitempty"`
+	BreakAt string `json:"breakAt,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	// crossed are the namespaces the trace went through, whose changes
+	// may change the result.
+	crossed map[string]bool
+}
+
+// Reachable reports whether From reaches To at either layer.
+func (r *Reachability) Reachable() bool {
+	return r.L2 || r.L3
+}
+
+func (r *Reachability) equal(o *Reachability) bool {
+	return r.L2 == o.L2 && r.L3 == o.L3 && r.Cause == o.Cause && r.BreakAt == o.BreakAt
+}
+
+type reachabilityPair struct {
+	from, to string
+}
+
+// reachabilityState is the matrix with the namespaces changed since it was
+// last computed.
+type reachabilityState struct {
+	matrix   map[reachabilityPair]*Reachability
+	dirty    map[string]bool
+	onChange map[ReachabilityEvent][]func(*Reachability, ReachabilityEvent)
+	wake     chan bool
+	sync.Mutex
+}
+
+func newReachabilityState() *reachabilityState {
+	return &reachabilityState{
+		matrix:   make(map[reachabilityPair]*Reachability),
+		dirty:    make(map[string]bool),
+		onChange: make(map[ReachabilityEvent][]func(*Reachability, ReachabilityEvent)),
+		wake:     make(chan bool, 1),
+	}
+}
+
+var defaultReachabilitySubscriber []func(*Reachability, ReachabilityEvent)
+
+func SubscribeAllReachabilityEvents(callback func(*Reachability, ReachabilityEvent)) {
+	defaultReachabilitySubscriber = append(defaultReachabilitySubscriber, callback)
+}
+
+func (t *Topology) OnReachabilityChange(event ReachabilityEvent, callback func(*Reachability, ReachabilityEvent)) error {
+	if int(event) >= len(ReachabilityEventStrings) || int(event) < 0 {
+		return errors.New("Topology OnReachabilityChange: ReachabilityEvent unrecognized")
+	}
+	t.reachability.onChange[event] = append(t.reachability.onChange[event], callback)
+	return nil
+}
+
+func (t *Topology) fireReachabilityEvent(r *Reachability, event ReachabilityEvent) {
+	for _, f := range defaultReachabilitySubscriber {
+		f(r, event)
+	}
+	for _, f := range t.reachability.onChange[event] {
+		f(r, event)
+	}
+}
+
+// reachabilityChanged marks namespace as changed, so that the pairs
+// involving it or crossing it are computed again.
+func (t *Topology) reachabilityChanged(namespace string) {
+	s := t.reachability
+	s.Lock()
+	s.dirty[namespace] = true
+	s.Unlock()
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+func (t *Topology) receiveReachabilityUpdates() {
+	for range t.reachability.wake {
+		<-time.After(reachabilityDelay)
+		t.UpdateReachability()
+	}
+}
+
+// UpdateReachability computes the pairs affected by the changes marked
+// since the last call, and fires ReachabilityGain or ReachabilityLoss when
+// a pair gained or lost its path and ReachabilityChange when only the layer
+// or the break point moved. Pairs of namespaces that are gone are dropped,
+// with ReachabilityLoss when they were reachable. The pairs are computed
+// from the tracked state as it is while holding stateLock.
+func (t *Topology) UpdateReachability() {
+	s := t.reachability
+	s.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[string]bool)
+	old := make(map[reachabilityPair]*Reachability, len(s.matrix))
+	for p, r := range s.matrix {
+		old[p] = r
+	}
+	s.Unlock()
+
+	bridges := t.bridgeViews()
+	t.stateLock.RLock()
+	matrix := t.computeReachability(old, dirty, bridges)
+	t.stateLock.RUnlock()
+	changed, events := diffReachability(old, matrix)
+
+	s.Lock()
+	s.matrix = matrix
+	s.Unlock()
+	for i, r := range changed {
+		t.fireReachabilityEvent(r, events[i])
+	}
+}
+
+// computeReachability returns the matrix of the tracked namespaces, taking
+// over the pairs of old none of the dirty namespaces may have changed. The
+// caller holds stateLock.
+func (t *Topology) computeReachability(old map[reachabilityPair]*Reachability, dirty map[string]bool,
+	bridges map[*L2Bridge]bridgeView) map[reachabilityPair]*Reachability {
+	names := make([]string, 0, len(t.Namespaces))
+	for name := range t.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	matrix := make(map[reachabilityPair]*Reachability, len(names)*len(names))
+	for _, from := range names {
+		for _, to := range names {
+			if from == to {
+				continue
+			}
+			p := reachabilityPair{from, to}
+			if before, known := old[p]; known && !dirty[from] && !dirty[to] && !crossesAny(before, dirty) {
+				matrix[p] = before
+				continue
+			}
+			matrix[p] = t.reachable(t.Namespaces[from], t.Namespaces[to], bridges)
+		}
+	}
+	return matrix
+}
+
+// diffReachability returns the pairs of matrix that differ from old, and
+// those of old gone from matrix, with the event each fires.
+func diffReachability(old, matrix map[reachabilityPair]*Reachability) ([]*Reachability, []ReachabilityEvent) {
+	changed := make([]*Reachability, 0)
+	events := make([]ReachabilityEvent, 0)
+	pairs := make([]reachabilityPair, 0, len(matrix))
+	for p := range matrix {
+		pairs = append(pairs, p)
+	}
+	for p := range old {
+		if _, ok := matrix[p]; !ok {
+			pairs = append(pairs, p)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].from != pairs[j].from {
+			return pairs[i].from < pairs[j].from
+		}
+		return pairs[i].to < pairs[j].to
+	})
+	for _, p := range pairs {
+		before, known := old[p]
+		r, ok := matrix[p]
+		switch {
+		case !ok:
+			if before.Reachable() {
+				gone := &Reachability{From: p.from, To: p.to, Cause: TraceUntracked,
+					Reason: "the pair is no longer tracked"}
+				changed, events = append(changed, gone), append(events, ReachabilityLoss)
+			}
+		case r == before:
+		case !known:
+			if r.Reachable() {
+				changed, events = append(changed, r), append(events, ReachabilityGain)
+			}
+		case before.Reachable() != r.Reachable():
+			event := ReachabilityLoss
+			if r.Reachable() {
+				event = ReachabilityGain
+			}
+			changed, events = append(changed, r), append(events, event)
+		case !before.equal(r):
+			changed, events = append(changed, r), append(events, ReachabilityChange)
+		}
+	}
+	return changed, events
+}
+
+func crossesAny(r *Reachability, namespaces map[string]bool) bool {
+	for ns := range r.crossed {
+		if namespaces[ns] {
+			return true
+		}
+	}
+	return false
+}
+
+// reachable computes whether from reaches to, tracing a packet to every
+// address of to until one gets there. Loopback and link-local addresses
+// are left out, they do not identify to. The caller holds stateLock.
+func (t *Topology) reachable(from, to *Namespace, bridges map[*L2Bridge]bridgeView) *Reachability {
+	r := &Reachability{From: from.Name, To: to.Name, crossed: make(map[string]bool)}
+	r.L2 = t.shareSegment(from, to)
+	var failed *Trace
+	for _, addr := range to.addresses() {
+		tr, err := t.trace(from.Name, addr, bridges)
+		if err != nil {
+			continue
+		}
+		for _, h := range tr.Hops {
+			r.crossed[h.Namespace] = true
+		}
+		if tr.Reached && tr.Hops[len(tr.Hops)-1].Namespace == to.Name {
+			r.L3 = true
+			return r
+		}
+		if failed == nil {
+			failed = tr
+		}
+	}
+	if failed == nil {
+		r.Cause, r.Reason = TraceNoRoute, to.Name+" has no address"
+		return r
+	}
+	last := failed.Hops[len(failed.Hops)-1]
+	r.Cause, r.BreakAt, r.Reason = failed.Cause, last.Namespace, last.Reason
+	if last.Device != "" {
+		r.BreakAt += "/" + last.Device
+	}
+	if r.Cause == "" {
+		if failed.Reached {
+			r.Reason = failed.Destination + " is delivered to " + last.Namespace
+		}
+		r.Cause = TraceNoPath
+	}
+	return r
+}
+
+// shareSegment reports whether addressed devices of a and b that are up
+// share a segment.
+func (t *Topology) shareSegment(a, b *Namespace) bool {
+	segments := make(map[*Segment]bool)
+	for _, index := range a.upL3Devices() {
+		if s := t.SegmentOf(getNSIndex(a.Name, index)); s != nil {
+			segments[s] = true
+		}
+	}
+	for _, index := range b.upL3Devices() {
+		if segments[t.SegmentOf(getNSIndex(b.Name, index))] {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Namespace) upL3Devices() []int {
+	indexes := make([]int, 0, len(n.L3Devices))
+	for index := range n.L3Devices {
+		if d, ok := n.L2Devices[index]; ok && d.Attrs().Status == L2Up {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+// addresses returns the addresses of n other hosts can reach it on.
+func (n *Namespace) addresses() []net.IP {
+	addrs := make([]net.IP, 0)
+	for _, d := range n.L3Devices {
+		if l3, ok := d.(*L3Device); ok {
+			for _, addr := range l3.ip {
+				if !addr.IP.IsLoopback() && !addr.IP.IsLinkLocalUnicast() {
+					addrs = append(addrs, addr.IP)
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// ReachabilityMatrix returns every pair of namespaces sorted by From and To.
+func (t *Topology) ReachabilityMatrix() []*Reachability {
+	s := t.reachability
+	s.Lock()
+	defer s.Unlock()
+	matrix := make([]*Reachability, 0, len(s.matrix))
+	for _, r := range s.matrix {
+		matrix = append(matrix, r)
+	}
+	sort.Slice(matrix, func(i, j int) bool {
+		if matrix[i].From != matrix[j].From {
+			return matrix[i].From < matrix[j].From
+		}
+		return matrix[i].To < matrix[j].To
+	})
+	return matrix
+}
+
+// Reachability returns whether namespace from reaches namespace to, or nil
+// when the pair was not computed yet.
+func (t *Topology) Reachability(from, to string) *Reachability {
+	s := t.reachability
+	s.Lock()
+	defer s.Unlock()
+	return s.matrix[reachabilityPair{from, to}]
+}
@@ -0,0 +1,194 @@
+package devices
+
+import (
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// reachabilityString returns "from to event cause" for a published change.
+func reachabilityString(r *Reachability, event ReachabilityEvent) string {
+	s := r.From + " " + r.To + " " + event.String()
+	if r.Cause != "" {
+		s += " " + r.Cause
+	}
+	return s
+}
+
+// diffStrings returns the changes diffReachability finds from old to
+// matrix.
+func diffStrings(t *testing.T, old, matrix map[reachabilityPair]*Reachability) []string {
+	changed, events := diffReachability(old, matrix)
+	if len(changed) != len(events) {
+		t.Fatalf("diffReachability() returned %d pairs and %d events", len(changed), len(events))
+	}
+	s := make([]string, 0, len(changed))
+	for i, r := range changed {
+		s = append(s, reachabilityString(r, events[i]))
+	}
+	return s
+}
+
+func TestDiffReachability(t *testing.T) {
+	up := func(from, to string) *Reachability {
+		return &Reachability{From: from, To: to, L3: true}
+	}
+	down := func(from, to, cause string) *Reachability {
+		return &Reachability{From: from, To: to, Cause: cause, BreakAt: from, Reason: "dropped"}
+	}
+	ab := reachabilityPair{"a", "b"}
+	type pairs map[reachabilityPair]*Reachability
+
+	kept := up("a", "b")
+	if got := diffStrings(t, pairs{ab: kept}, pairs{ab: kept}); len(got) != 0 {
+		t.Errorf("diffReachability() of a kept pair = %v, want none", got)
+	}
+	// Only the cause and where it happens are compared, not the reason.
+	alike := &Reachability{From: "a", To: "b", Cause: TraceNoRoute, BreakAt: "a", Reason: "other"}
+	if got := diffStrings(t, pairs{ab: down("a", "b", TraceNoRoute)}, pairs{ab: alike}); len(got) != 0 {
+		t.Errorf("diffReachability() of a pair computed alike = %v, want none", got)
+	}
+
+	got := diffStrings(t, pairs{}, pairs{ab: up("a", "b")})
+	if want := []string{"a b ReachabilityGain"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("diffReachability() of a new reachable pair = %v, want %v", got, want)
+	}
+	if got := diffStrings(t, pairs{}, pairs{ab: down("a", "b", TraceNoRoute)}); len(got) != 0 {
+		t.Errorf("diffReachability() of a new unreachable pair = %v, want none", got)
+	}
+	got = diffStrings(t, pairs{ab: down("a", "b", TraceNoRoute)}, pairs{ab: up("a", "b")})
+	if want := []string{"a b ReachabilityGain"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("diffReachability() = %v, want %v", got, want)
+	}
+	got = diffStrings(t, pairs{ab: up("a", "b")}, pairs{ab: down("a", "b", TraceLinkDown)})
+	if want := []string{"a b ReachabilityLoss link down"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("diffReachability() = %v, want %v", got, want)
+	}
+	got = diffStrings(t, pairs{ab: down("a", "b", TraceNoRoute)}, pairs{ab: down("a", "b", TraceLinkDown)})
+	if want := []string{"a b ReachabilityChange link down"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("diffReachability() of another cause = %v, want %v", got, want)
+	}
+	got = diffStrings(t, pairs{ab: up("a", "b")}, pairs{ab: {From: "a", To: "b", L2: true, L3: true}})
+	if want := []string{"a b ReachabilityChange"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("diffReachability() of another layer = %v, want %v", got, want)
+	}
+
+	got = diffStrings(t, pairs{ab: up("a", "b")}, pairs{})
+	if want := []string{"a b ReachabilityLoss untracked"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("diffReachability() of a reachable pair gone = %v, want %v", got, want)
+	}
+	if got := diffStrings(t, pairs{ab: down("a", "b", TraceNoRoute)}, pairs{}); len(got) != 0 {
+		t.Errorf("diffReachability() of an unreachable pair gone = %v, want none", got)
+	}
+
+	got = diffStrings(t, pairs{{"b", "a"}: up("b", "a"), {"a", "c"}: up("a", "c")},
+		pairs{ab: up("a", "b"), {"a", "c"}: down("a", "c", TraceNoPath)})
+	want := []string{"a b ReachabilityGain", "a c ReachabilityLoss no path", "b a ReachabilityLoss untracked"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffReachability() = %v, want %v sorted by pair", got, want)
+	}
+}
+
+// markReachability marks namespace as changed without waking the goroutine
+// of t that computes the pairs again, so that the test does.
+func markReachability(t *Topology, namespace string) {
+	t.reachability.Lock()
+	t.reachability.dirty[namespace] = true
+	t.reachability.Unlock()
+}
+
+func TestTopology_UpdateReachability(t *testing.T) {
+	topology := traceTopology()
+	events := make([]string, 0)
+	for event := range ReachabilityEventStrings {
+		topology.OnReachabilityChange(ReachabilityEvent(event), func(r *Reachability, event ReachabilityEvent) {
+			events = append(events, reachabilityString(r, event))
+		})
+	}
+	if err := topology.OnReachabilityChange(ReachabilityEvent(len(ReachabilityEventStrings)), nil); err == nil {
+		t.Error("OnReachabilityChange() accepted an unknown event")
+	}
+
+	topology.UpdateReachability()
+	want := []string{"a b ReachabilityGain", "a c ReachabilityGain", "b a ReachabilityGain", "b c ReachabilityGain",
+		"c a ReachabilityGain", "c b ReachabilityGain"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("first UpdateReachability() fired %q, want %q", events, want)
+	}
+	ab, ca := topology.Reachability("a", "b"), topology.Reachability("c", "a")
+
+	// b loses its route to c. Nothing is computed again until b is marked.
+	b := topology.Namespaces["b"]
+	b.Routes = b.Routes[:0]
+	b.Routes = append(b.Routes, NewRoute(netlink.Route{LinkIndex: 2, Dst: mustCIDR("10.0.0.0/24"),
+		Table: syscall.RT_TABLE_MAIN, Type: syscall.RTN_UNICAST}, "a"))
+	events = events[:0]
+	topology.UpdateReachability()
+	if len(events) != 0 {
+		t.Errorf("UpdateReachability() without changes fired %q", events)
+	}
+	markReachability(topology, "b")
+	topology.UpdateReachability()
+	want = []string{"a c ReachabilityLoss no route", "b c ReachabilityLoss no route"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("UpdateReachability() after b changed fired %q, want %q", events, want)
+	}
+	if r := topology.Reachability("a", "b"); r == ab {
+		t.Error("a to b, which crosses b, was not computed again")
+	}
+	if r := topology.Reachability("c", "a"); r == ca || !r.L3 {
+		t.Errorf("Reachability(c, a) = %+v, want computed again and reachable", r)
+	}
+	if r := topology.Reachability("a", "c"); r.BreakAt != "b" {
+		t.Errorf("Reachability(a, c) breaks at %q, want b", r.BreakAt)
+	}
+
+	// a is left alone by a change of c it does not cross anymore.
+	ab = topology.Reachability("a", "b")
+	events = events[:0]
+	topology.lockState()
+	delete(topology.Namespaces, "c")
+	topology.unlockState()
+	markReachability(topology, "c")
+	topology.UpdateReachability()
+	want = []string{"c a ReachabilityLoss untracked", "c b ReachabilityLoss untracked"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("UpdateReachability() after c was deleted fired %q, want %q", events, want)
+	}
+	if topology.Reachability("a", "b") != ab {
+		t.Error("a to b was computed again for a change of c")
+	}
+	if got := len(topology.ReachabilityMatrix()); got != 2 {
+		t.Errorf("len(ReachabilityMatrix()) = %d, want 2", got)
+	}
+}
+
+func TestTopology_UpdateReachabilityWhileAddingDevices(t *testing.T) {
+	topology := traceTopology()
+	a := topology.Namespaces["a"]
+	stop, done := make(chan bool), make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+				index := 1000 + i%100
+				a.setL2Device(index, &Veth{L2Device: &L2Device{Name: "eth" + strconv.Itoa(i), Index: index}})
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		topology.reachabilityChanged("a")
+		topology.UpdateReachability()
+	}
+	stop <- true
+	<-done
+	if r := topology.Reachability("a", "c"); r == nil || !r.L3 {
+		t.Errorf("Reachability(a, c) = %+v, want reachable", r)
+	}
+}
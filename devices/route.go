@@ -0,0 +1,168 @@
+package devices
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+var routeProtocolStrings = map[int]string{
+	syscall.RTPROT_UNSPEC:   "unspec",
+	syscall.RTPROT_REDIRECT: "redirect",
+	syscall.RTPROT_KERNEL:   "kernel",
+	syscall.RTPROT_BOOT:     "boot",
+	syscall.RTPROT_STATIC:   "static",
+	syscall.RTPROT_GATED:    "gated",
+	syscall.RTPROT_RA:       "ra",
+	syscall.RTPROT_MRT:      "mrt",
+	syscall.RTPROT_ZEBRA:    "zebra",
+	syscall.RTPROT_BIRD:     "bird",
+	syscall.RTPROT_DNROUTED: "dnrouted",
+	syscall.RTPROT_XORP:     "xorp",
+	syscall.RTPROT_NTK:      "ntk",
+	syscall.RTPROT_DHCP:     "dhcp",
+}
+
+var routeScopeStrings = map[netlink.Scope]string{
+	syscall.RT_SCOPE_UNIVERSE: "global",
+	syscall.RT_SCOPE_SITE:     "site",
+	syscall.RT_SCOPE_LINK:     "link",
+	syscall.RT_SCOPE_HOST:     "host",
+	syscall.RT_SCOPE_NOWHERE:  "nowhere",
+}
+
+var routeTypeStrings = map[int]string{
+	syscall.RTN_UNSPEC:      "unspec",
+	syscall.RTN_UNICAST:     "unicast",
+	syscall.RTN_LOCAL:       "local",
+	syscall.RTN_BROADCAST:   "broadcast",
+	syscall.RTN_ANYCAST:     "anycast",
+	syscall.RTN_MULTICAST:   "multicast",
+	syscall.RTN_BLACKHOLE:   "blackhole",
+	syscall.RTN_UNREACHABLE: "unreachable",
+	syscall.RTN_PROHIBIT:    "prohibit",
+	syscall.RTN_THROW:       "throw",
+	syscall.RTN_NAT:         "nat",
+}
+
+// Route is an entry of one of the routing tables of a namespace. VRF names
+// the VRF device routing through the table, if any. It keeps the netlink
+// route it was built from so that deletes can be matched.
+type Route struct {
+	Table           int    `json:"table"`
+	VRF             string `json:"vrf,omitempty"`
+	Protocol        string `json:"protocol"`
+	Scope           string `json:"scope"`
+	Metric          int    `json:"metric"`
+	Type            string `json:"type"`
+	OutputIndex     int    `json:"oifIndex"`
+	OutputInterface string `json:"oif"`
+	Source          string `json:"source,omitempty"`
+	Destination     string `json:"destination"`
+	Gateway         string `json:"gateway,omitempty"`
+	// GatewayNamespace and GatewayIndex place the device owning Gateway.
+	GatewayNamespace string `json:"gatewayNamespace,omitempty"`
+	GatewayIndex     int    `json:"gatewayIndex,omitempty"`
+	// Nexthops are the paths of a multipath route, or those of the
+	// nexthop object NexthopID the route uses.
+	NexthopID int             `json:"nhid,omitempty"`
+	Nexthops  []*RouteNexthop `json:"nexthops,omitempty"`
+	route     netlink.Route
+}
+
+func NewRoute(route netlink.Route, oif string) *Route {
+	r := &Route{
+		Table:           route.Table,
+		Protocol:        lookupString(routeProtocolStrings, int(route.Protocol)),
+		Scope:           routeScopeStrings[route.Scope],
+		Metric:          route.Priority,
+		Type:            lookupString(routeTypeStrings, route.Type),
+		OutputIndex:     route.LinkIndex,
+		OutputInterface: oif,
+		Destination:     "default",
+		route:           route,
+	}
+	if r.Scope == "" {
+		r.Scope = strconv.Itoa(int(route.Scope))
+	}
+	if route.Dst != nil {
+		r.Destination = route.Dst.String()
+	}
+	if route.Src != nil {
+		r.Source = route.Src.String()
+	}
+	if route.Gw != nil {
+		r.Gateway = route.Gw.String()
+	}
+	return r
+}
+
+func lookupString(m map[int]string, key int) string {
+	if s, ok := m[key]; ok {
+		return s
+	}
+	return strconv.Itoa(key)
+}
+
+// Matches reports whether route identifies the same kernel route as r. Only
+// the attributes the kernel uses to tell routes apart are compared, since
+// flags and cache info differ between a dump and a later RTM_DELROUTE.
+func (r *Route) Matches(route netlink.Route) bool {
+	return r.route.Table == route.Table &&
+		r.route.Tos == route.Tos &&
+		r.route.Priority == route.Priority &&
+		r.route.Type == route.Type &&
+		r.route.LinkIndex == route.LinkIndex &&
+		r.route.Gw.Equal(route.Gw) &&
+		ipNetEqual(r.route.Dst, route.Dst)
+}
+
+func (r *Route) NetlinkRoute() netlink.Route {
+	return r.route
+}
+
+func (r *Route) String() string {
+	s := r.Destination
+	if r.Gateway != "" {
+		s += " via " + r.Gateway
+		if r.GatewayNamespace != "" {
+			s += " (" + r.GatewayNamespace + ")"
+		}
+	}
+	if r.OutputInterface != "" {
+		s += " dev " + r.OutputInterface
+	}
+	s += " table " + TableName(r.Table)
+	if r.VRF != "" {
+		s += " vrf " + r.VRF
+	}
+	if r.NexthopID != 0 {
+		s += fmt.Sprintf(" nhid %d", r.NexthopID)
+	}
+	for _, p := range r.Nexthops {
+		s += " nexthop"
+		if p.Gateway != "" {
+			s += " via " + p.Gateway
+		}
+		s += fmt.Sprintf(" dev %s weight %d", p.OutputInterface, p.Weight)
+		if p.GatewayNamespace != "" {
+			s += " (" + p.GatewayNamespace + ")"
+		}
+	}
+	return s + fmt.Sprintf(" proto %s scope %s metric %d type %s", r.Protocol, r.Scope, r.Metric, r.Type)
+}
+
+func ipNetEqual(a, b *net.IPNet) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	aSize, _ := a.Mask.Size()
+	bSize, _ := b.Mask.Size()
+	return a.IP.Equal(b.IP) && aSize == bSize
+}
@@ -0,0 +1,199 @@
+package devices
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	ipNet.IP = ip
+	return ipNet
+}
+
+func TestIpNetEqual(t *testing.T) {
+	if !ipNetEqual(nil, nil) {
+		t.Error("ipNetEqual(nil, nil) = false")
+	}
+	if ipNetEqual(mustCIDR("10.0.0.0/24"), nil) {
+		t.Error("ipNetEqual() of a prefix and nil = true")
+	}
+	if !ipNetEqual(mustCIDR("10.0.0.0/24"), mustCIDR("10.0.0.0/24")) {
+		t.Error("ipNetEqual() of the same prefix = false")
+	}
+	if ipNetEqual(mustCIDR("10.0.0.0/24"), mustCIDR("10.0.0.0/16")) ||
+		ipNetEqual(mustCIDR("10.0.0.0/24"), mustCIDR("10.0.1.0/24")) {
+		t.Error("ipNetEqual() of different prefixes = true")
+	}
+	ip4 := &net.IPNet{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.CIDRMask(24, 32)}
+	ip16 := &net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(24, 32)}
+	if !ipNetEqual(ip4, ip16) {
+		t.Error("ipNetEqual() tells the 4 and 16 byte forms of an address apart")
+	}
+}
+
+func TestRoute_Matches(t *testing.T) {
+	route := netlink.Route{
+		LinkIndex: 2,
+		Dst:       mustCIDR("10.0.0.0/24"),
+		Gw:        net.ParseIP("192.168.0.1"),
+		Priority:  100,
+		Table:     syscall.RT_TABLE_MAIN,
+		Type:      syscall.RTN_UNICAST,
+		Protocol:  syscall.RTPROT_STATIC,
+	}
+	r := NewRoute(route, "eth0")
+	if !r.Matches(route) {
+		t.Error("Matches() of the route itself = false")
+	}
+	// A RTM_DELROUTE carries other flags than the dump.
+	deleted := route
+	deleted.Flags = syscall.RTM_F_NOTIFY
+	deleted.Protocol = syscall.RTPROT_BOOT
+	if !r.Matches(deleted) {
+		t.Error("Matches() compares flags and protocol")
+	}
+
+	other := route
+	other.Table = 100
+	if r.Matches(other) {
+		t.Error("Matches() of another table = true")
+	}
+	other = route
+	other.Priority = 200
+	if r.Matches(other) {
+		t.Error("Matches() of another metric = true")
+	}
+	other = route
+	other.LinkIndex = 3
+	if r.Matches(other) {
+		t.Error("Matches() of another device = true")
+	}
+	other = route
+	other.Gw = net.ParseIP("192.168.0.2")
+	if r.Matches(other) {
+		t.Error("Matches() of another gateway = true")
+	}
+	other = route
+	other.Dst = mustCIDR("10.0.1.0/24")
+	if r.Matches(other) {
+		t.Error("Matches() of another destination = true")
+	}
+	other.Dst = nil
+	if r.Matches(other) {
+		t.Error("Matches() of the default route = true")
+	}
+	other = route
+	other.Type = syscall.RTN_BLACKHOLE
+	if r.Matches(other) {
+		t.Error("Matches() of another type = true")
+	}
+}
+
+func TestNewRoute(t *testing.T) {
+	r := NewRoute(netlink.Route{LinkIndex: 2, Gw: net.ParseIP("192.168.0.1"), Table: syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_DHCP, Type: syscall.RTN_UNICAST, Priority: 100}, "eth0")
+	if want := "default via 192.168.0.1 dev eth0 table main proto dhcp scope global metric 100 type unicast"; r.String() != want {
+		t.Errorf("String() = %q, want %q", r.String(), want)
+	}
+	r = NewRoute(netlink.Route{LinkIndex: 2, Dst: mustCIDR("192.168.0.0/24"), Table: syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_KERNEL, Scope: netlink.SCOPE_LINK, Type: syscall.RTN_UNICAST}, "eth0")
+	if want := "192.168.0.0/24 dev eth0 table main proto kernel scope link metric 0 type unicast"; r.String() != want {
+		t.Errorf("String() = %q, want %q", r.String(), want)
+	}
+	r = NewRoute(netlink.Route{LinkIndex: 2, Dst: mustCIDR("10.0.0.0/8"), Table: 100, Protocol: 99,
+		Type: syscall.RTN_BLACKHOLE}, "eth0")
+	if want := "10.0.0.0/8 dev eth0 table 100 proto 99 scope global metric 0 type blackhole"; r.String() != want {
+		t.Errorf("String() = %q, want %q", r.String(), want)
+	}
+}
+
+func TestNamespace_AddRoute(t *testing.T) {
+	n := NewNamespace("test", NewTopology(), nil)
+	events := make([]string, 0)
+	record := func(n *Namespace, event NSEvent, item interface{}) {
+		events = append(events, event.String()+" "+item.(*Route).Destination)
+	}
+	n.OnChange(NSRouteAdd, record)
+	n.OnChange(NSRouteDelete, record)
+
+	connected := netlink.Route{LinkIndex: 2, Dst: mustCIDR("192.168.0.0/24"), Table: syscall.RT_TABLE_MAIN,
+		Type: syscall.RTN_UNICAST}
+	gateway := netlink.Route{LinkIndex: 2, Gw: net.ParseIP("192.168.0.1"), Table: syscall.RT_TABLE_MAIN,
+		Type: syscall.RTN_UNICAST}
+	n.AddRoute(connected)
+	n.AddRoute(gateway)
+	// A dump after a listener error repeats the routes.
+	n.AddRoute(connected)
+	cached := gateway
+	cached.Dst = mustCIDR("8.8.8.8/32")
+	cached.Flags = syscall.RTM_F_CLONED
+	n.AddRoute(cached)
+	n.DeleteRoute(connected)
+	n.DeleteRoute(connected)
+
+	want := []string{"NSRouteAdd 192.168.0.0/24", "NSRouteAdd default", "NSRouteDelete 192.168.0.0/24"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+	if len(n.Routes) != 1 || !n.Routes[0].Matches(gateway) {
+		t.Errorf("Routes = %v, want the default route", n.Routes)
+	}
+}
+
+func TestNamespace_DeleteRemovesRoutes(t *testing.T) {
+	n := NewNamespace("test", NewTopology(), nil)
+	events := make([]string, 0)
+	n.OnChange(NSRouteDelete, func(n *Namespace, event NSEvent, item interface{}) {
+		events = append(events, event.String()+" "+item.(*Route).Destination)
+	})
+	n.OnChange(NSDelete, func(n *Namespace, event NSEvent, item interface{}) {
+		events = append(events, event.String())
+	})
+	n.AddRoute(netlink.Route{LinkIndex: 2, Dst: mustCIDR("192.168.0.0/24"), Table: syscall.RT_TABLE_MAIN,
+		Type: syscall.RTN_UNICAST})
+	n.AddRoute(netlink.Route{LinkIndex: 3, Dst: mustCIDR("10.0.0.0/8"), Table: 100, Type: syscall.RTN_UNICAST})
+
+	n.Delete()
+	want := []string{"NSRouteDelete 192.168.0.0/24", "NSRouteDelete 10.0.0.0/8", "NSDelete"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+	if len(n.Routes) != 0 {
+		t.Errorf("len(Routes) = %d, want 0", len(n.Routes))
+	}
+}
+
+func TestNamespace_AddRouteWhileAddingDevices(t *testing.T) {
+	n := NewNamespace("test", NewTopology(), nil)
+	stop, done := make(chan bool), make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+				index := 1000 + i%100
+				n.setL2Device(index, &Veth{L2Device: &L2Device{Name: "eth" + strconv.Itoa(i), Index: index}})
+			}
+		}
+	}()
+	for i := 1; i <= 300; i++ {
+		dst := mustCIDR("10." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256) + ".0/24")
+		n.AddRoute(netlink.Route{LinkIndex: i, Dst: dst, Table: syscall.RT_TABLE_MAIN, Type: syscall.RTN_UNICAST})
+	}
+	stop <- true
+	<-done
+	if len(n.Routes) != 300 {
+		t.Errorf("got %d routes, want 300", len(n.Routes))
+	}
+}
@@ -0,0 +1,350 @@
+package devices
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// FRA_* attributes of FIB rules the netlink package does not know about.
+const (
+	fraL3mdev   = 19
+	fraUIDRange = 20
+)
+
+// FR_ACT_* values of the action of a FIB rule.
+var ruleActionStrings = map[int]string{
+	0: "unspec",
+	1: "lookup",
+	2: "goto",
+	3: "nop",
+	6: "blackhole",
+	7: "unreachable",
+	8: "prohibit",
+}
+
+// Names iproute2 gives to the reserved routing tables.
+var routeTableStrings = map[int]string{
+	syscall.RT_TABLE_DEFAULT: "default",
+	syscall.RT_TABLE_MAIN:    "main",
+	syscall.RT_TABLE_LOCAL:   "local",
+}
+
+// TableName returns the name of routing table table, or its number.
+func TableName(table int) string {
+	return lookupString(routeTableStrings, table)
+}
+
+// Rule is a FIB rule of a namespace, as listed by ip rule. Rules are
+// matched in Priority order, the first one whose selector matches decides
+// which Table is looked up. L3mdev rules look up the table of the VRF the
+// packet is in.
+type Rule struct {
+	Priority int    `json:"priority"`
+	Family   string `json:"family"`
+	Invert   bool   `json:"not,omitempty"`
+	From     string `json:"from"`
+	To       string `json:"to,omitempty"`
+	Iif      string `json:"iif,omitempty"`
+	Oif      string `json:"oif,omitempty"`
+	Fwmark   string `json:"fwmark,omitempty"`
+	UIDRange string `json:"uidrange,omitempty"`
+	L3mdev   bool   `json:"l3mdev,omitempty"`
+	Action   string `json:"action"`
+	Table    int    `json:"table,omitempty"`
+	Goto     int    `json:"goto,omitempty"`
+}
+
+// ParseRule decodes the payload of an RTM_NEWRULE or RTM_DELRULE message.
+// The fib_rule_hdr it starts with has the layout of an rtmsg, with the
+// action where the route type would be.
+func ParseRule(b []byte) (*Rule, error) {
+	if len(b) < syscall.SizeofRtMsg {
+		return nil, syscall.EINVAL
+	}
+	msg := nl.DeserializeRtMsg(b)
+	attrs, err := nl.ParseRouteAttr(b[msg.Len():])
+	if err != nil {
+		return nil, err
+	}
+	r := &Rule{
+		Family: "inet",
+		Invert: msg.Flags&netlink.FibRuleInvert != 0,
+		From:   "all",
+		Action: lookupString(ruleActionStrings, int(msg.Type)),
+		Table:  int(msg.Table),
+	}
+	if msg.Family == unix.AF_INET6 {
+		r.Family = "inet6"
+	}
+	native := nl.NativeEndian()
+	var mark, mask uint32
+	hasMark, hasMask := false, false
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nl.FRA_PRIORITY:
+			r.Priority = int(native.Uint32(attr.Value))
+		case nl.FRA_SRC:
+			r.From = (&net.IPNet{IP: attr.Value, Mask: net.CIDRMask(int(msg.Src_len), 8*len(attr.Value))}).String()
+		case nl.FRA_DST:
+			r.To = (&net.IPNet{IP: attr.Value, Mask: net.CIDRMask(int(msg.Dst_len), 8*len(attr.Value))}).String()
+		case nl.FRA_IIFNAME:
+			r.Iif = string(attr.Value[:len(attr.Value)-1])
+		case nl.FRA_OIFNAME:
+			r.Oif = string(attr.Value[:len(attr.Value)-1])
+		case nl.FRA_FWMARK:
+			mark, hasMark = native.Uint32(attr.Value), true
+		case nl.FRA_FWMASK:
+			mask, hasMask = native.Uint32(attr.Value), true
+		case nl.FRA_TABLE:
+			r.Table = int(native.Uint32(attr.Value))
+		case nl.FRA_GOTO:
+			r.Goto = int(native.Uint32(attr.Value))
+		case fraL3mdev:
+			r.L3mdev = len(attr.Value) > 0 && attr.Value[0] != 0
+		case fraUIDRange:
+			if len(attr.Value) >= 8 {
+				r.UIDRange = fmt.Sprintf("%d-%d", native.Uint32(attr.Value[0:4]), native.Uint32(attr.Value[4:8]))
+			}
+		}
+	}
+	if hasMark {
+		r.Fwmark = fmt.Sprintf("%#x", mark)
+		if hasMask && mask != 0xffffffff {
+			r.Fwmark += fmt.Sprintf("/%#x", mask)
+		}
+	}
+	if r.L3mdev {
+		r.Table = 0
+	}
+	return r, nil
+}
+
+// String formats r the way ip rule shows it.
+func (r *Rule) String() string {
+	s := strconv.Itoa(r.Priority) + ":"
+	if r.Invert {
+		s += " not"
+	}
+	s += " from " + r.From
+	if r.To != "" {
+		s += " to " + r.To
+	}
+	if r.Fwmark != "" {
+		s += " fwmark " + r.Fwmark
+	}
+	if r.Iif != "" {
+		s += " iif " + r.Iif
+	}
+	if r.Oif != "" {
+		s += " oif " + r.Oif
+	}
+	if r.UIDRange != "" {
+		s += " uidrange " + r.UIDRange
+	}
+	switch {
+	case r.L3mdev:
+		s += " lookup [l3mdev-table]"
+	case r.Action == "lookup":
+		s += " lookup " + TableName(r.Table)
+	case r.Action == "goto":
+		s += " goto " + strconv.Itoa(r.Goto)
+	default:
+		s += " " + r.Action
+	}
+	return s
+}
+
+// Selects reports whether r sends lookups to table.
+func (r *Rule) Selects(table int) bool {
+	return r.Action == "lookup" && !r.L3mdev && r.Table == table
+}
+
+// AddRule records r, keeping Rules in the order the kernel evaluates them,
+// and fires NSRuleAdd with it.
+func (n *Namespace) AddRule(r *Rule) {
+	for _, rule := range n.Rules {
+		if *rule == *r {
+			return
+		}
+	}
+	n.topology.lockState()
+	n.Rules = append(n.Rules, r)
+	sort.SliceStable(n.Rules, func(i, j int) bool { return n.Rules[i].Priority < n.Rules[j].Priority })
+	n.topology.unlockState()
+	n.fire(NSRuleAdd, r)
+}
+
+// DeleteRule removes r and fires NSRuleDelete with the removed entry.
+func (n *Namespace) DeleteRule(r *Rule) {
+	for i, rule := range n.Rules {
+		if *rule == *r {
+			n.topology.lockState()
+			n.Rules = append(n.Rules[0:i], n.Rules[i+1:]...)
+			n.topology.unlockState()
+			n.fire(NSRuleDelete, rule)
+			return
+		}
+	}
+}
+
+// RefreshRules dumps the IPv4 and IPv6 rules of n. Later changes are picked
+// up from RTNLGRP_IPV4_RULE and RTNLGRP_IPV6_RULE notifications.
+func (n *Namespace) RefreshRules() error {
+	req := nl.NewNetlinkRequest(unix.RTM_GETRULE, unix.NLM_F_DUMP)
+	req.AddData(&nl.RtMsg{RtMsg: unix.RtMsg{Family: unix.AF_UNSPEC}})
+	msgs, err := n.execute(req, unix.RTM_NEWRULE)
+	if err != nil {
+		return err
+	}
+	rules := make([]*Rule, 0, len(msgs))
+	for _, m := range msgs {
+		r, err := ParseRule(m)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	n.syncRules(rules)
+	return nil
+}
+
+// syncRules makes the rules of n those of a dump, deleting those the kernel
+// no longer has. It makes up for the notifications a rule listener lost.
+func (n *Namespace) syncRules(rules []*Rule) {
+	stale := make([]*Rule, 0)
+	for _, rule := range n.Rules {
+		found := false
+		for _, r := range rules {
+			if *rule == *r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, rule)
+		}
+	}
+	for _, r := range stale {
+		n.DeleteRule(r)
+	}
+	for _, r := range rules {
+		n.AddRule(r)
+	}
+}
+
+// TableRules returns the rules of n that look up table.
+func (n *Namespace) TableRules(table int) []*Rule {
+	rules := make([]*Rule, 0)
+	for _, r := range n.Rules {
+		if r.Selects(table) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// Rules the kernel starts a namespace with, used while its own rules are
+// not known.
+var defaultRules = []*Rule{
+	{Priority: 0, From: "all", Action: "lookup", Table: syscall.RT_TABLE_LOCAL},
+	{Priority: 32766, From: "all", Action: "lookup", Table: syscall.RT_TABLE_MAIN},
+	{Priority: 32767, From: "all", Action: "lookup", Table: syscall.RT_TABLE_DEFAULT},
+}
+
+// matches reports whether a packet to dst is selected by r. Selectors that
+// depend on more than the destination, such as the source, a mark or the
+// incoming device, never match.
+func (r *Rule) matches(dst net.IP) bool {
+	if r.From != "all" || r.Iif != "" || r.Oif != "" || r.Fwmark != "" || r.UIDRange != "" {
+		return false
+	}
+	selected := true
+	if r.To != "" {
+		_, to, err := net.ParseCIDR(r.To)
+		selected = err == nil && to.Contains(dst)
+	}
+	return selected != r.Invert
+}
+
+// lookupRoute returns the route n sends packets to dst through, the way
+// the kernel picks it: the rules in priority order choose the tables, and
+// within a table the longest prefix with the lowest metric wins. With oif
+// set only routes through that device are considered. The reason tells
+// which rule selected the route, or why there is none.
+func (n *Namespace) lookupRoute(dst net.IP, oif int) (*Route, string) {
+	family := "inet"
+	if dst.To4() == nil {
+		family = "inet6"
+	}
+	rules := make([]*Rule, 0, len(n.Rules))
+	for _, r := range n.Rules {
+		if r.Family == family {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		rules = defaultRules
+	}
+	next := 0
+	for _, rule := range rules {
+		if rule.Priority < next || !rule.matches(dst) {
+			continue
+		}
+		switch rule.Action {
+		case "lookup":
+			if rule.L3mdev {
+				continue
+			}
+			if r := n.tableLookup(rule.Table, dst, oif); r != nil && r.Type != "throw" {
+				return r, "rule " + rule.String()
+			}
+		case "goto":
+			next = rule.Goto
+		case "nop":
+		default:
+			return nil, "rule " + rule.String()
+		}
+	}
+	return nil, "no route to " + dst.String()
+}
+
+// tableLookup returns the most specific route of table matching dst.
+func (n *Namespace) tableLookup(table int, dst net.IP, oif int) *Route {
+	var best *Route
+	bestLen := -1
+	for _, r := range n.Routes {
+		if r.Table != table || (oif != 0 && !r.uses(oif)) {
+			continue
+		}
+		length := 0
+		if r.route.Dst != nil {
+			if !r.route.Dst.Contains(dst) {
+				continue
+			}
+			length, _ = r.route.Dst.Mask.Size()
+		} else if gw := routeGateway(r.route); gw != nil && (gw.To4() == nil) != (dst.To4() == nil) {
+			continue
+		}
+		if length > bestLen || length == bestLen && r.Metric < best.Metric {
+			best, bestLen = r, length
+		}
+	}
+	return best
+}
+
+// uses reports whether a path of r goes out of device index.
+func (r *Route) uses(index int) bool {
+	for _, p := range r.Paths() {
+		if p.OutputIndex == index {
+			return true
+		}
+	}
+	return false
+}
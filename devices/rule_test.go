@@ -0,0 +1,235 @@
+package devices
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func ruleMessage(msg unix.RtMsg, attrs ...*nl.RtAttr) []byte {
+	b := (&nl.RtMsg{RtMsg: msg}).Serialize()
+	for _, attr := range attrs {
+		b = append(b, attr.Serialize()...)
+	}
+	return b
+}
+
+// parsedRule returns the rule of msg as ip rule shows it.
+func parsedRule(t *testing.T, msg []byte) string {
+	r, err := ParseRule(msg)
+	if err != nil {
+		t.Fatalf("ParseRule() error = %v", err)
+	}
+	return r.String()
+}
+
+func TestParseRule(t *testing.T) {
+	priority := func(p uint32) *nl.RtAttr { return nl.NewRtAttr(nl.FRA_PRIORITY, nl.Uint32Attr(p)) }
+
+	got := parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET, Table: syscall.RT_TABLE_MAIN, Type: 1},
+		priority(32766)))
+	if want := "32766: from all lookup main"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	// Tables above 255 only fit FRA_TABLE.
+	got = parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET, Src_len: 24, Type: 1}, priority(100),
+		nl.NewRtAttr(nl.FRA_SRC, net.ParseIP("10.0.0.0").To4()),
+		nl.NewRtAttr(nl.FRA_TABLE, nl.Uint32Attr(1000))))
+	if want := "100: from 10.0.0.0/24 lookup 1000"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET6, Dst_len: 64, Table: 10, Type: 1}, priority(5),
+		nl.NewRtAttr(nl.FRA_DST, net.ParseIP("2001:db8::"))))
+	if want := "5: from all to 2001:db8::/64 lookup 10"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET, Table: 10, Type: 1}, priority(10),
+		nl.NewRtAttr(nl.FRA_FWMARK, nl.Uint32Attr(1)),
+		nl.NewRtAttr(nl.FRA_FWMASK, nl.Uint32Attr(0xff))))
+	if want := "10: from all fwmark 0x1/0xff lookup 10"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET, Table: 10, Type: 1}, priority(10),
+		nl.NewRtAttr(nl.FRA_FWMARK, nl.Uint32Attr(1)),
+		nl.NewRtAttr(nl.FRA_FWMASK, nl.Uint32Attr(0xffffffff))))
+	if want := "10: from all fwmark 0x1 lookup 10"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET, Table: syscall.RT_TABLE_MAIN, Type: 1,
+		Flags: netlink.FibRuleInvert}, priority(200),
+		nl.NewRtAttr(nl.FRA_IIFNAME, nl.ZeroTerminated("eth0")),
+		nl.NewRtAttr(nl.FRA_OIFNAME, nl.ZeroTerminated("eth1"))))
+	if want := "200: not from all iif eth0 oif eth1 lookup main"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET, Type: 1}, priority(1000),
+		nl.NewRtAttr(fraL3mdev, []byte{1})))
+	if want := "1000: from all lookup [l3mdev-table]"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET, Table: 10, Type: 1}, priority(7),
+		nl.NewRtAttr(fraUIDRange, append(nl.Uint32Attr(1000), nl.Uint32Attr(2000)...))))
+	if want := "7: from all uidrange 1000-2000 lookup 10"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET, Type: 2}, priority(10),
+		nl.NewRtAttr(nl.FRA_GOTO, nl.Uint32Attr(300))))
+	if want := "10: from all goto 300"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	got = parsedRule(t, ruleMessage(unix.RtMsg{Family: unix.AF_INET, Type: 6}, priority(20)))
+	if want := "20: from all blackhole"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	if _, err := ParseRule([]byte{unix.AF_INET}); err == nil {
+		t.Error("ParseRule() of a truncated message succeeded")
+	}
+}
+
+// lookupNamespace returns a namespace with a default route through eth0,
+// index 2, more specific routes through devices 3 and 4, and table 100
+// through device 5.
+func lookupNamespace(rules ...*Rule) *Namespace {
+	main := syscall.RT_TABLE_MAIN
+	n := &Namespace{Name: "test", Rules: rules}
+	for _, route := range []netlink.Route{
+		{LinkIndex: 2, Gw: net.ParseIP("192.168.0.1"), Table: main, Priority: 100},
+		{LinkIndex: 2, Dst: mustCIDR("192.168.0.0/24"), Table: main},
+		{LinkIndex: 3, Dst: mustCIDR("10.0.0.0/8"), Table: main, Priority: 20},
+		{LinkIndex: 4, Dst: mustCIDR("10.0.0.0/8"), Table: main, Priority: 10},
+		{LinkIndex: 3, Dst: mustCIDR("10.1.0.0/16"), Table: main},
+		{LinkIndex: 5, Gw: net.ParseIP("172.16.0.1"), Table: 100},
+		{LinkIndex: 5, Dst: mustCIDR("172.16.0.0/24"), Table: 100, Type: syscall.RTN_THROW},
+	} {
+		n.Routes = append(n.Routes, NewRoute(route, ""))
+	}
+	return n
+}
+
+// lookupDevice returns the output device of the route n picks for dst and
+// the reason it gives.
+func lookupDevice(n *Namespace, dst string, oif int) (int, string) {
+	r, reason := n.lookupRoute(net.ParseIP(dst), oif)
+	if r == nil {
+		return 0, reason
+	}
+	return r.OutputIndex, reason
+}
+
+func TestNamespace_lookupRoute(t *testing.T) {
+	mainRule := &Rule{Priority: 32766, Family: "inet", From: "all", Action: "lookup", Table: syscall.RT_TABLE_MAIN}
+	viaMain := "rule 32766: from all lookup main"
+
+	// Without rules only the main table is looked up.
+	n := lookupNamespace()
+	if device, reason := lookupDevice(n, "192.168.0.7", 0); device != 2 || reason != viaMain {
+		t.Errorf("connected: lookupRoute() = %d, %q", device, reason)
+	}
+	if device, reason := lookupDevice(n, "8.8.8.8", 0); device != 2 || reason != viaMain {
+		t.Errorf("default: lookupRoute() = %d, %q", device, reason)
+	}
+	if device, _ := lookupDevice(n, "10.1.2.3", 0); device != 3 {
+		t.Errorf("lookupRoute() = device %d, want the longest prefix through 3", device)
+	}
+	if device, _ := lookupDevice(n, "10.2.3.4", 0); device != 4 {
+		t.Errorf("lookupRoute() = device %d, want the lowest metric through 4", device)
+	}
+	if device, _ := lookupDevice(n, "10.2.3.4", 3); device != 3 {
+		t.Errorf("lookupRoute() = device %d, want the output device 3", device)
+	}
+	if device, reason := lookupDevice(n, "2001:db8::1", 0); device != 0 || reason != "no route to 2001:db8::1" {
+		t.Errorf("lookupRoute() without IPv6 routes = %d, %q", device, reason)
+	}
+
+	n = lookupNamespace(&Rule{Priority: 100, Family: "inet", From: "all", To: "8.8.0.0/16", Action: "lookup",
+		Table: 100}, mainRule)
+	if device, reason := lookupDevice(n, "8.8.8.8", 0); device != 5 ||
+		reason != "rule 100: from all to 8.8.0.0/16 lookup 100" {
+		t.Errorf("rule to table 100: lookupRoute() = %d, %q", device, reason)
+	}
+	n = lookupNamespace(&Rule{Priority: 100, Family: "inet", From: "all", To: "8.8.0.0/16", Invert: true,
+		Action: "lookup", Table: 100}, mainRule)
+	if device, reason := lookupDevice(n, "8.8.8.8", 0); device != 2 || reason != viaMain {
+		t.Errorf("inverted rule: lookupRoute() = %d, %q", device, reason)
+	}
+	n = lookupNamespace(&Rule{Priority: 100, Family: "inet", From: "all", Action: "lookup", Table: 100}, mainRule)
+	if device, reason := lookupDevice(n, "172.16.0.9", 0); device != 2 || reason != viaMain {
+		t.Errorf("throw route: lookupRoute() = %d, %q, want to fall through to main", device, reason)
+	}
+	// Rules on the source never match, since the source is not known.
+	n = lookupNamespace(&Rule{Priority: 100, Family: "inet", From: "10.0.0.0/8", Action: "lookup", Table: 100},
+		mainRule)
+	if device, reason := lookupDevice(n, "8.8.8.8", 0); device != 2 || reason != viaMain {
+		t.Errorf("source rule: lookupRoute() = %d, %q", device, reason)
+	}
+	n = lookupNamespace(&Rule{Priority: 10, Family: "inet", From: "all", Action: "goto", Goto: 200},
+		&Rule{Priority: 100, Family: "inet", From: "all", Action: "lookup", Table: 100}, mainRule)
+	if device, reason := lookupDevice(n, "8.8.8.8", 0); device != 2 || reason != viaMain {
+		t.Errorf("goto: lookupRoute() = %d, %q", device, reason)
+	}
+	n = lookupNamespace(&Rule{Priority: 50, Family: "inet", From: "all", To: "8.8.8.8/32", Action: "blackhole"},
+		mainRule)
+	if device, reason := lookupDevice(n, "8.8.8.8", 0); device != 0 ||
+		reason != "rule 50: from all to 8.8.8.8/32 blackhole" {
+		t.Errorf("blackhole: lookupRoute() = %d, %q", device, reason)
+	}
+}
+
+func TestNamespace_AddRule(t *testing.T) {
+	n := NewNamespace("test", NewTopology(), nil)
+	events := make([]string, 0)
+	record := func(n *Namespace, event NSEvent, item interface{}) {
+		events = append(events, event.String()+" "+item.(*Rule).String())
+	}
+	n.OnChange(NSRuleAdd, record)
+	n.OnChange(NSRuleDelete, record)
+	main := &Rule{Priority: 32766, Family: "inet", From: "all", Action: "lookup", Table: syscall.RT_TABLE_MAIN}
+	vrf := &Rule{Priority: 1000, Family: "inet", From: "all", Action: "lookup", L3mdev: true}
+
+	n.AddRule(main)
+	n.AddRule(vrf)
+	n.AddRule(&Rule{Priority: 32766, Family: "inet", From: "all", Action: "lookup", Table: syscall.RT_TABLE_MAIN})
+	if len(n.Rules) != 2 || n.Rules[0] != vrf || n.Rules[1] != main {
+		t.Errorf("Rules = %v, want rules 1000 and 32766 in order", n.Rules)
+	}
+	n.DeleteRule(&Rule{Priority: 1000, Family: "inet", From: "all", Action: "lookup", L3mdev: true})
+	n.DeleteRule(vrf)
+	want := []string{"NSRuleAdd " + main.String(), "NSRuleAdd " + vrf.String(), "NSRuleDelete " + vrf.String()}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestNamespace_syncRules(t *testing.T) {
+	n := NewNamespace("test", NewTopology(), nil)
+	events := make([]string, 0)
+	record := func(n *Namespace, event NSEvent, item interface{}) {
+		events = append(events, event.String()+" "+item.(*Rule).String())
+	}
+	n.OnChange(NSRuleAdd, record)
+	n.OnChange(NSRuleDelete, record)
+	main := &Rule{Priority: 32766, Family: "inet", From: "all", Action: "lookup", Table: syscall.RT_TABLE_MAIN}
+	vrf := &Rule{Priority: 100, Family: "inet", From: "10.0.0.0/8", Action: "lookup", Table: 100}
+	n.AddRule(main)
+	n.AddRule(vrf)
+
+	// The listener lost the deletion of rule 100 and the addition of
+	// rule 200.
+	added := &Rule{Priority: 200, Family: "inet", From: "all", To: "8.8.0.0/16", Action: "lookup", Table: 200}
+	events = events[:0]
+	n.syncRules([]*Rule{{Priority: 32766, Family: "inet", From: "all", Action: "lookup", Table: syscall.RT_TABLE_MAIN},
+		added})
+	want := []string{"NSRuleDelete " + vrf.String(), "NSRuleAdd " + added.String()}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("syncRules() fired %q, want %q", events, want)
+	}
+	if len(n.Rules) != 2 || n.Rules[0] != added || n.Rules[1] != main {
+		t.Errorf("Rules = %v, want rules 200 and 32766", n.Rules)
+	}
+}
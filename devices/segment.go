@@ -0,0 +1,577 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type SegmentEvent int
+
+const (
+	SegmentCreate SegmentEvent = iota
+	SegmentJoin
+	SegmentLeave
+	SegmentDelete
+)
+
+var SegmentEventStrings = []string{
+	"SegmentCreate",
+	"SegmentJoin",
+	"SegmentLeave",
+	"SegmentDelete",
+}
+
+func (e SegmentEvent) String() string {
+	for i, str := range SegmentEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+// Segment is a broadcast domain: the interfaces, as "namespace:index"
+// nodes, an untagged broadcast sent by any of them reaches.
+type Segment struct {
+	ID      string   `json:"id"`
+	Members []string `json:"members"`
+}
+
+// Segment callbacks get the node joining or leaving of SegmentJoin and
+// SegmentLeave, nil otherwise.
+var defaultSegmentSubscriber []func(*Segment, SegmentEvent, interface{})
+
+func SubscribeAllSegmentEvents(callback func(*Segment, SegmentEvent, interface{})) {
+	defaultSegmentSubscriber = append(defaultSegmentSubscriber, callback)
+}
+
+func (t *Topology) OnSegmentChange(event SegmentEvent, callback func(*Segment, SegmentEvent, interface{})) error {
+	if int(event) >= len(SegmentEventStrings) || int(event) < 0 {
+		return errors.New("Topology OnSegmentChange: SegmentEvent unrecognized")
+	}
+	t.segmentOnChange[event] = append(t.segmentOnChange[event], callback)
+	return nil
+}
+
+func (t *Topology) fireSegmentEvent(s *Segment, event SegmentEvent, member interface{}) {
+	for _, f := range defaultSegmentSubscriber {
+		f(s, event, member)
+	}
+	for _, f := range t.segmentOnChange[event] {
+		f(s, event, member)
+	}
+	for _, node := range s.Members {
+		t.reachabilityChanged(nodeNamespace(node))
+	}
+	if node, ok := member.(string); ok {
+		t.reachabilityChanged(nodeNamespace(node))
+	}
+}
+
+// segmentKey is the traffic of node tagged with vid, 0 for untagged
+// traffic. The VLANs of a VLAN filtering bridge are keys of their own,
+// with the node of the bridge suffixed by "/vlan".
+type segmentKey struct {
+	node string
+	vid  int
+}
+
+// owner returns the node whose devices or VLANs k is the traffic of.
+func (k segmentKey) owner() string {
+	return strings.TrimSuffix(k.node, "/vlan")
+}
+
+// segmentSet is a union-find over segmentKeys.
+type segmentSet map[segmentKey]segmentKey
+
+func (s segmentSet) find(k segmentKey) segmentKey {
+	if _, ok := s[k]; !ok {
+		s[k] = k
+	}
+	for s[k] != k {
+		s[k] = s[s[k]]
+		k = s[k]
+	}
+	return k
+}
+
+func (s segmentSet) union(a, b segmentKey) {
+	ra, rb := s.find(a), s.find(b)
+	if ra != rb {
+		s[ra] = rb
+	}
+}
+
+// segmentState is what the segments were last computed from, and the
+// components of the traffic of every node, so that a change only has the
+// components it touches computed again.
+type segmentState struct {
+	devices map[string]segmentDevice
+	views   map[string]bridgeView
+	// roots holds the component of every key, nodes the nodes owning the
+	// keys of a component and keys the keys owned by a node.
+	roots map[segmentKey]segmentKey
+	nodes map[segmentKey][]string
+	keys  map[string][]segmentKey
+	// ports holds the nodes of the ports of every bridge or bond.
+	ports map[string]map[string]bool
+	// bridges are the bridges whose VLANs changed since, guarded by
+	// segmentLock.
+	bridges map[string]bool
+	// The Mutex is held by UpdateSegments from copying the devices to
+	// publishing the segments, so that runs do not interleave. It is not
+	// held while firing events.
+	sync.Mutex
+}
+
+func newSegmentState() *segmentState {
+	return &segmentState{
+		devices: make(map[string]segmentDevice),
+		views:   make(map[string]bridgeView),
+		roots:   make(map[segmentKey]segmentKey),
+		nodes:   make(map[segmentKey][]string),
+		keys:    make(map[string][]segmentKey),
+		ports:   make(map[string]map[string]bool),
+		bridges: make(map[string]bool),
+	}
+}
+
+// segmentsChanged asks for the segments to be computed again. Requests
+// made while a computation is pending are merged into it.
+func (t *Topology) segmentsChanged() {
+	select {
+	case t.segmentChannel <- true:
+	default:
+	}
+}
+
+// bridgeSegmentsChanged is segmentsChanged for a change of the VLANs of
+// bridge, which the copy of the devices does not show.
+func (t *Topology) bridgeSegmentsChanged(bridge string) {
+	t.segmentLock.Lock()
+	t.segmentState.bridges[bridge] = true
+	t.segmentLock.Unlock()
+	t.segmentsChanged()
+}
+
+func (t *Topology) receiveSegmentUpdates() {
+	for range t.segmentChannel {
+		t.UpdateSegments()
+	}
+}
+
+// segmentDevice is what the segment of a device depends on, copied from
+// the topology so that segments are computed without holding stateLock.
+type segmentDevice struct {
+	node string
+	// peer is the node of the other end of a veth.
+	peer string
+	// parent is the node a VLAN, macvlan or ipvlan device rides on, vid
+	// the VLAN ID of a VLAN device.
+	parent string
+	vid    int
+	// master is the node of the bridge or bond the device is a port of.
+	master     string
+	masterBond bool
+}
+
+// segmentDevices returns the devices of every namespace, and their bridges,
+// by node.
+func (t *Topology) segmentDevices() (map[string]segmentDevice, map[string]*L2Bridge) {
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	devices := make(map[string]segmentDevice)
+	bridges := make(map[string]*L2Bridge)
+	for _, n := range t.Namespaces {
+		for index, d := range n.L2Devices {
+			sd := segmentDevice{node: getNSIndex(n.Name, index)}
+			switch dev := d.(type) {
+			case *Veth:
+				if dev.linkResolved() {
+					sd.peer = getNSIndex(dev.PeerNamespace, dev.PeerIndex)
+				}
+			case *VlanDevice:
+				if dev.linkResolved() {
+					sd.parent, sd.vid = getNSIndex(dev.ParentNamespace, dev.ParentIndex), dev.VlanID
+				}
+			case *Macvlan:
+				if dev.linkResolved() {
+					sd.parent = getNSIndex(dev.ParentNamespace, dev.ParentIndex)
+				}
+			case *Ipvlan:
+				if dev.linkResolved() {
+					sd.parent = getNSIndex(dev.ParentNamespace, dev.ParentIndex)
+				}
+			case *L2Bridge:
+				bridges[sd.node] = dev
+			}
+			if master := d.Attrs().Master; master != 0 {
+				switch n.L2Devices[master].(type) {
+				case *L2Bridge:
+					sd.master = getNSIndex(n.Name, master)
+				case *L2Bond:
+					sd.master, sd.masterBond = getNSIndex(n.Name, master), true
+				}
+			}
+			devices[sd.node] = sd
+		}
+	}
+	return devices, bridges
+}
+
+// uniteSegments unites the traffic of devices. Veth peers, bond members and
+// the ports of a bridge without VLAN filtering share all their traffic. A
+// VLAN sub-interface carries the traffic of its parent tagged with its VLAN
+// ID, and macvlan and ipvlan devices the untagged traffic of their parent.
+// Ports of a VLAN filtering bridge, as told by its view, join the VLANs
+// they are members of, untagged for their PVID and untagged VLANs, tagged
+// for the others.
+func uniteSegments(devices []segmentDevice, views map[string]bridgeView) segmentSet {
+	set := make(segmentSet)
+	vids := map[int]bool{0: true}
+	type pair struct{ a, b string }
+	shared := make([]pair, 0)
+
+	for _, d := range devices {
+		set.find(segmentKey{d.node, 0})
+		if d.peer != "" {
+			shared = append(shared, pair{d.node, d.peer})
+		}
+		if d.parent != "" {
+			vids[d.vid] = true
+			set.union(segmentKey{d.node, 0}, segmentKey{d.parent, d.vid})
+		}
+		if d.master != "" && (d.masterBond || !views[d.master].filtering) {
+			shared = append(shared, pair{d.node, d.master})
+		}
+	}
+	for bridge, v := range views {
+		if !v.filtering {
+			continue
+		}
+		namespace := nodeNamespace(bridge)
+		for port, vlans := range v.vlans {
+			node := getNSIndex(namespace, port)
+			for _, vlan := range vlans {
+				vids[vlan.Vid] = true
+				key := segmentKey{bridge + "/vlan", vlan.Vid}
+				if vlan.PVID || vlan.Untagged {
+					set.union(segmentKey{node, 0}, key)
+				} else {
+					set.union(segmentKey{node, vlan.Vid}, key)
+				}
+			}
+		}
+	}
+	for _, p := range shared {
+		for vid := range vids {
+			set.union(segmentKey{p.a, vid}, segmentKey{p.b, vid})
+		}
+	}
+	return set
+}
+
+// segmentRoots returns the untagged segment of every device, see
+// uniteSegments.
+func segmentRoots(devices []segmentDevice, views map[string]bridgeView) map[string]segmentKey {
+	set := uniteSegments(devices, views)
+	roots := make(map[string]segmentKey, len(devices))
+	for _, d := range devices {
+		roots[d.node] = set.find(segmentKey{d.node, 0})
+	}
+	return roots
+}
+
+// segmentRegion returns the nodes whose segments dirty may change: the
+// nodes of every component with traffic of a dirty node, the nodes a dirty
+// device is now linked to, and so on until no component is left out. The
+// keys of the other nodes only unite with keys of their own components, so
+// uniting the devices of the region alone gives its components.
+func (s *segmentState) segmentRegion(dirty map[string]bool) map[string]bool {
+	region := make(map[string]bool)
+	seen := make(map[segmentKey]bool)
+	queue := make([]string, 0, len(dirty))
+	for node := range dirty {
+		queue = append(queue, node)
+	}
+	for len(queue) != 0 {
+		node := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if region[node] {
+			continue
+		}
+		region[node] = true
+		for _, k := range s.keys[node] {
+			if root := s.roots[k]; !seen[root] {
+				seen[root] = true
+				queue = append(queue, s.nodes[root]...)
+			}
+		}
+		if d, ok := s.devices[node]; ok {
+			for _, linked := range []string{d.peer, d.parent, d.master} {
+				if linked != "" {
+					queue = append(queue, linked)
+				}
+			}
+		}
+		// Whether a port shares the traffic of its bridge depends on the
+		// view of the bridge.
+		for port := range s.ports[node] {
+			queue = append(queue, port)
+		}
+		if v, ok := s.views[node]; ok {
+			namespace := nodeNamespace(node)
+			for port := range v.vlans {
+				queue = append(queue, getNSIndex(namespace, port))
+			}
+		}
+	}
+	return region
+}
+
+// update makes devices and views the state, computes the components of the
+// region of the devices and bridges that changed again, and returns the
+// untagged segment of the devices of the region.
+func (s *segmentState) update(devices map[string]segmentDevice, views map[string]bridgeView) map[string]segmentKey {
+	dirty := make(map[string]bool)
+	for node, d := range devices {
+		if old, ok := s.devices[node]; !ok || old != d {
+			dirty[node] = true
+			if ok && old.master != "" {
+				delete(s.ports[old.master], node)
+			}
+			if d.master != "" {
+				if s.ports[d.master] == nil {
+					s.ports[d.master] = make(map[string]bool)
+				}
+				s.ports[d.master][node] = true
+			}
+		}
+	}
+	for node, old := range s.devices {
+		if _, ok := devices[node]; !ok {
+			dirty[node] = true
+			if old.master != "" {
+				delete(s.ports[old.master], node)
+			}
+		}
+	}
+	for node := range views {
+		dirty[node] = true
+	}
+	s.devices = devices
+	for node, v := range views {
+		s.views[node] = v
+	}
+	for node := range s.views {
+		if _, ok := devices[node]; !ok {
+			delete(s.views, node)
+		}
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	region := s.segmentRegion(dirty)
+	regionDevices := make([]segmentDevice, 0, len(region))
+	regionViews := make(map[string]bridgeView)
+	for node := range region {
+		if d, ok := s.devices[node]; ok {
+			regionDevices = append(regionDevices, d)
+		}
+		if v, ok := s.views[node]; ok {
+			regionViews[node] = v
+		}
+		for _, k := range s.keys[node] {
+			delete(s.nodes, s.roots[k])
+		}
+	}
+	for node := range region {
+		for _, k := range s.keys[node] {
+			delete(s.roots, k)
+		}
+		delete(s.keys, node)
+	}
+
+	set := uniteSegments(regionDevices, regionViews)
+	owners := make(map[segmentKey]map[string]bool)
+	for k := range set {
+		root := set.find(k)
+		s.roots[k] = root
+		owner := k.owner()
+		s.keys[owner] = append(s.keys[owner], k)
+		if owners[root] == nil {
+			owners[root] = make(map[string]bool)
+		}
+		owners[root][owner] = true
+	}
+	for root, nodes := range owners {
+		for node := range nodes {
+			s.nodes[root] = append(s.nodes[root], node)
+		}
+	}
+	roots := make(map[string]segmentKey, len(regionDevices))
+	for _, d := range regionDevices {
+		roots[d.node] = s.roots[segmentKey{d.node, 0}]
+	}
+	// Nodes of the region that are gone have no segment anymore.
+	for node := range region {
+		if _, ok := roots[node]; !ok {
+			roots[node] = segmentKey{}
+		}
+	}
+	return roots
+}
+
+// UpdateSegments computes the segments the changes since the last call may
+// have changed again, and fires events for the differences. Only the
+// components of the traffic of the devices and bridges that changed are
+// computed again, see segmentRegion. A segment keeps its ID as long as it
+// keeps the majority of its members, so that joins and leaves are reported
+// as such.
+func (t *Topology) UpdateSegments() {
+	state := t.segmentState
+	state.Lock()
+	devices, bridges := t.segmentDevices()
+	t.segmentLock.Lock()
+	changed := state.bridges
+	state.bridges = make(map[string]bool)
+	t.segmentLock.Unlock()
+	views := make(map[string]bridgeView)
+	for node, b := range bridges {
+		if _, ok := state.views[node]; !ok || changed[node] {
+			views[node] = b.view()
+		}
+	}
+	roots := state.update(devices, views)
+	if len(roots) == 0 {
+		state.Unlock()
+		return
+	}
+
+	groups := make(map[segmentKey][]string)
+	for node, root := range roots {
+		if root != (segmentKey{}) {
+			groups[root] = append(groups[root], node)
+		}
+	}
+	members := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		sort.Strings(g)
+		members = append(members, g)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if len(members[i]) != len(members[j]) {
+			return len(members[i]) > len(members[j])
+		}
+		return members[i][0] < members[j][0]
+	})
+
+	t.segmentLock.Lock()
+	// The segments of the region only have members in the region.
+	old := make(map[string]*Segment)
+	for node := range roots {
+		if id, ok := t.segmentOf[node]; ok {
+			old[id] = t.segments[id]
+		}
+	}
+	taken := make(map[string]bool)
+	segments := make(map[string]*Segment, len(members))
+	for _, g := range members {
+		counts := make(map[string]int)
+		for _, node := range g {
+			if id, ok := t.segmentOf[node]; ok && !taken[id] {
+				counts[id]++
+			}
+		}
+		id := ""
+		for candidate, c := range counts {
+			if id == "" || c > counts[id] || c == counts[id] && candidate < id {
+				id = candidate
+			}
+		}
+		if id == "" {
+			t.segmentSeq++
+			id = fmt.Sprintf("segment-%d", t.segmentSeq)
+		}
+		taken[id] = true
+		segments[id] = &Segment{ID: id, Members: g}
+	}
+	for id := range old {
+		delete(t.segments, id)
+	}
+	for node := range roots {
+		delete(t.segmentOf, node)
+	}
+	for id, s := range segments {
+		// Unchanged segments of the region are kept as they are.
+		if before, ok := old[id]; ok && reflect.DeepEqual(before.Members, s.Members) {
+			segments[id] = before
+		}
+		t.segments[id] = segments[id]
+		for _, node := range s.Members {
+			t.segmentOf[node] = id
+		}
+	}
+	t.segmentLock.Unlock()
+	state.Unlock()
+
+	for id, s := range old {
+		if _, ok := segments[id]; !ok {
+			t.fireSegmentEvent(s, SegmentDelete, nil)
+		}
+	}
+	for id, s := range segments {
+		before, ok := old[id]
+		if !ok {
+			t.fireSegmentEvent(s, SegmentCreate, nil)
+			continue
+		}
+		was := make(map[string]bool, len(before.Members))
+		for _, node := range before.Members {
+			was[node] = true
+		}
+		for _, node := range s.Members {
+			if !was[node] {
+				t.fireSegmentEvent(s, SegmentJoin, node)
+			}
+			delete(was, node)
+		}
+		for _, node := range before.Members {
+			if was[node] {
+				t.fireSegmentEvent(s, SegmentLeave, node)
+			}
+		}
+	}
+}
+
+// Segments returns the current segments sorted by ID.
+func (t *Topology) Segments() []*Segment {
+	t.segmentLock.Lock()
+	defer t.segmentLock.Unlock()
+	segments := make([]*Segment, 0, len(t.segments))
+	for _, s := range t.segments {
+		segments = append(segments, s)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].ID < segments[j].ID })
+	return segments
+}
+
+// SegmentOf returns the segment of node, "namespace:index", or nil.
+func (t *Topology) SegmentOf(node string) *Segment {
+	t.segmentLock.Lock()
+	defer t.segmentLock.Unlock()
+	return t.segments[t.segmentOf[node]]
+}
+
+// SameSegment reports whether nodes a and b share a broadcast domain.
+func (t *Topology) SameSegment(a, b string) bool {
+	t.segmentLock.Lock()
+	defer t.segmentLock.Unlock()
+	id, ok := t.segmentOf[a]
+	return ok && id == t.segmentOf[b]
+}
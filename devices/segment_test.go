@@ -0,0 +1,381 @@
+package devices
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// segmentGroups returns the nodes of roots grouped by segment, as sorted
+// comma separated lists.
+func segmentGroups(roots map[string]segmentKey) []string {
+	groups := make(map[segmentKey][]string)
+	for node, root := range roots {
+		groups[root] = append(groups[root], node)
+	}
+	s := make([]string, 0, len(groups))
+	for _, g := range groups {
+		sort.Strings(g)
+		s = append(s, strings.Join(g, ","))
+	}
+	sort.Strings(s)
+	return s
+}
+
+func TestSegmentSet(t *testing.T) {
+	set := make(segmentSet)
+	a, b, c, d := segmentKey{"a:1", 0}, segmentKey{"b:1", 0}, segmentKey{"c:1", 0}, segmentKey{"a:1", 10}
+	if set.find(a) != a {
+		t.Error("find() of a new key is not the key itself")
+	}
+	set.union(a, b)
+	set.union(c, b)
+	if set.find(a) != set.find(c) {
+		t.Error("union() is not transitive")
+	}
+	if set.find(d) == set.find(a) {
+		t.Error("the tagged traffic of a node joined its untagged traffic")
+	}
+	set.union(a, c)
+	if set.find(a) != set.find(b) || set.find(d) != d {
+		t.Error("union() of keys of one set changed the sets")
+	}
+}
+
+func TestSegmentRoots(t *testing.T) {
+	veths := []segmentDevice{
+		{node: "a:2", peer: "b:2"},
+		{node: "b:2", peer: "a:2"},
+		{node: "c:1"},
+	}
+	if got, want := segmentGroups(segmentRoots(veths, nil)), []string{"a:2,b:2", "c:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segmentRoots() of a veth pair = %v, want %v", got, want)
+	}
+
+	// Tagged traffic crosses the veth in its own segment.
+	vlans := []segmentDevice{
+		{node: "a:2", peer: "b:2"},
+		{node: "b:2", peer: "a:2"},
+		{node: "a:3", parent: "a:2", vid: 10},
+		{node: "b:3", parent: "b:2", vid: 10},
+		{node: "a:4", parent: "a:2", vid: 20},
+	}
+	got := segmentGroups(segmentRoots(vlans, nil))
+	if want := []string{"a:2,b:2", "a:3,b:3", "a:4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segmentRoots() of VLANs across a veth = %v, want %v", got, want)
+	}
+
+	macvlan := []segmentDevice{{node: "a:2"}, {node: "a:3", parent: "a:2"}}
+	if got, want := segmentGroups(segmentRoots(macvlan, nil)), []string{"a:2,a:3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segmentRoots() of a macvlan = %v, want %v", got, want)
+	}
+
+	bridge := []segmentDevice{
+		{node: "a:1"},
+		{node: "a:2", master: "a:1"},
+		{node: "a:3", master: "a:1"},
+		{node: "a:4"},
+	}
+	got = segmentGroups(segmentRoots(bridge, map[string]bridgeView{"a:1": {}}))
+	if want := []string{"a:1,a:2,a:3", "a:4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segmentRoots() of a bridge = %v, want %v", got, want)
+	}
+
+	bond := []segmentDevice{
+		{node: "a:1"},
+		{node: "a:2", master: "a:1", masterBond: true},
+		{node: "a:3", master: "a:1", masterBond: true},
+	}
+	if got, want := segmentGroups(segmentRoots(bond, nil)), []string{"a:1,a:2,a:3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segmentRoots() of a bond = %v, want %v", got, want)
+	}
+
+	// A VLAN filtering bridge joins the ports untagged in the same VLAN,
+	// and the VLAN devices on its tagged ports.
+	filtering := []segmentDevice{
+		{node: "a:1"},
+		{node: "a:2", master: "a:1"},
+		{node: "a:3", master: "a:1"},
+		{node: "a:4", master: "a:1"},
+		{node: "a:5", master: "a:1"},
+		{node: "a:6", parent: "a:5", vid: 10},
+	}
+	views := map[string]bridgeView{"a:1": {filtering: true, vlans: map[int][]BridgeVlan{
+		2: {{Vid: 10, PVID: true, Untagged: true}},
+		3: {{Vid: 10, Untagged: true}},
+		4: {{Vid: 20, PVID: true, Untagged: true}},
+		5: {{Vid: 10}, {Vid: 20}},
+	}}}
+	got = segmentGroups(segmentRoots(filtering, views))
+	if want := []string{"a:1", "a:2,a:3,a:6", "a:4", "a:5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segmentRoots() of a VLAN filtering bridge = %v, want %v", got, want)
+	}
+
+	trunk := []segmentDevice{
+		{node: "a:1"},
+		{node: "a:2", master: "a:1", peer: "b:2"},
+		{node: "b:2", peer: "a:2"},
+		{node: "b:3", parent: "b:2", vid: 20},
+		{node: "a:4", master: "a:1"},
+	}
+	views = map[string]bridgeView{"a:1": {filtering: true, vlans: map[int][]BridgeVlan{
+		2: {{Vid: 20}},
+		4: {{Vid: 20, PVID: true, Untagged: true}},
+	}}}
+	got = segmentGroups(segmentRoots(trunk, views))
+	if want := []string{"a:1", "a:2,b:2", "a:4,b:3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segmentRoots() of a trunk to a veth = %v, want %v", got, want)
+	}
+}
+
+// expectSegmentEvents checks that the events recorded are want, in any
+// order, since segments are compared in no particular order.
+func expectSegmentEvents(t *testing.T, events chan string, want ...string) {
+	got := make([]string, 0, len(want))
+	for range want {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(time.Second):
+		}
+	}
+	select {
+	case e := <-events:
+		got = append(got, e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+}
+
+func TestTopology_UpdateSegments(t *testing.T) {
+	topology := NewTopology()
+	a := &Namespace{Name: "a", topology: topology, L2Devices: make(map[int]LinkUpdateReceiver)}
+	b := &Namespace{Name: "b", topology: topology, L2Devices: make(map[int]LinkUpdateReceiver)}
+	topology.Namespaces["a"] = a
+	topology.Namespaces["b"] = b
+	events := make(chan string, 20)
+	for event := range SegmentEventStrings {
+		topology.OnSegmentChange(SegmentEvent(event), func(s *Segment, event SegmentEvent, member interface{}) {
+			e := event.String() + " " + s.ID
+			if node, ok := member.(string); ok {
+				e += " " + node
+			}
+			events <- e
+		})
+	}
+
+	bridge := NewL2Bridge(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0", Index: 1}}, topology, "a", false)
+	bridge.AddPort(2)
+	bridge.AddPort(5)
+	go bridge.ReceiveLinkUpdate()
+	defer func() { *(bridge.deleteChannel) <- true }()
+	a.setL2Device(1, bridge)
+	a.setL2Device(2, &Veth{L2Device: &L2Device{Index: 2, Namespace: "a", Master: 1}, PeerNamespace: "b", PeerIndex: 2})
+	b.setL2Device(2, &Veth{L2Device: &L2Device{Index: 2, Namespace: "b"}, PeerNamespace: "a", PeerIndex: 2})
+	b.setL2Device(3, &VlanDevice{stackedDevice: stackedDevice{L2Device: &L2Device{Index: 3, Namespace: "b"},
+		parentLink: parentLink{ParentIndex: 2, ParentNamespace: "b"}}, VlanID: 10})
+	// The peer of an unresolved veth is not known yet.
+	b.setL2Device(4, &Veth{L2Device: &L2Device{Index: 4, Namespace: "b"}, PeerIndex: 5})
+	topology.UpdateSegments()
+	expectSegmentEvents(t, events, "SegmentCreate segment-1", "SegmentCreate segment-2", "SegmentCreate segment-3")
+	if s := topology.SegmentOf("b:2"); s == nil || s.ID != "segment-1" ||
+		!reflect.DeepEqual(s.Members, []string{"a:1", "a:2", "b:2"}) {
+		t.Errorf("SegmentOf(b:2) = %+v, want segment-1 of a:1, a:2 and b:2", s)
+	}
+	vlan := topology.SegmentOf("b:3")
+
+	// The peer of b:4 shows up as a port of the bridge.
+	a.setL2Device(5, &Veth{L2Device: &L2Device{Index: 5, Namespace: "a", Master: 1}, PeerNamespace: "b", PeerIndex: 4})
+	b.setL2Device(4, &Veth{L2Device: &L2Device{Index: 4, Namespace: "b"}, PeerNamespace: "a", PeerIndex: 5})
+	topology.UpdateSegments()
+	expectSegmentEvents(t, events, "SegmentJoin segment-1 a:5", "SegmentJoin segment-1 b:4", "SegmentDelete segment-3")
+
+	// Deleting a:2 splits b:2 off, the segment of b:3 is left alone.
+	topology.lockState()
+	delete(a.L2Devices, 2)
+	topology.unlockState()
+	topology.UpdateSegments()
+	expectSegmentEvents(t, events, "SegmentLeave segment-1 a:2", "SegmentLeave segment-1 b:2",
+		"SegmentCreate segment-4")
+	if topology.SegmentOf("b:3") != vlan {
+		t.Error("the segment of b:3 was computed again")
+	}
+	if topology.SegmentOf("a:2") != nil {
+		t.Error("a deleted device kept its segment")
+	}
+
+	// VLAN filtering puts a:5 alone in VLAN 10 with the bridge out of it,
+	// which only the bridge knows.
+	*bridge.stateChannel <- bridgeState{filtering: true, ports: map[int][]BridgeVlan{
+		5: {{Vid: 10, PVID: true, Untagged: true}},
+	}}
+	expectSegmentEvents(t, events, "SegmentLeave segment-1 a:1", "SegmentCreate segment-5")
+	if got := len(topology.Segments()); got != 4 {
+		t.Errorf("got %d segments, want 4", got)
+	}
+}
+
+// TestSegmentState_update checks that computing only the components a
+// change touches gives the segments computing all of them gives.
+func TestSegmentState_update(t *testing.T) {
+	rand := rand.New(rand.NewSource(1))
+	nodes := []string{"a:1", "a:2", "a:3", "a:4", "a:5", "b:1", "b:2", "b:3", "b:4", "c:1", "c:2", "c:3"}
+	bridges := []string{"a:1", "b:1"}
+	devices := make(map[string]segmentDevice)
+	views := make(map[string]bridgeView)
+	for _, bridge := range bridges {
+		views[bridge] = bridgeView{}
+	}
+	s := newSegmentState()
+	for i := 0; i < 2000; i++ {
+		changed := make(map[string]bridgeView)
+		node := nodes[rand.Intn(len(nodes))]
+		switch rand.Intn(6) {
+		case 0:
+			delete(devices, node)
+		case 1:
+			devices[node] = segmentDevice{node: node}
+		case 2:
+			devices[node] = segmentDevice{node: node, peer: nodes[rand.Intn(len(nodes))]}
+		case 3:
+			devices[node] = segmentDevice{node: node, parent: nodes[rand.Intn(len(nodes))], vid: rand.Intn(3) * 10}
+		case 4:
+			master := bridges[rand.Intn(len(bridges))]
+			devices[node] = segmentDevice{node: node, master: master, masterBond: rand.Intn(4) == 0}
+		case 5:
+			bridge := bridges[rand.Intn(len(bridges))]
+			v := bridgeView{filtering: rand.Intn(2) == 0, vlans: make(map[int][]BridgeVlan)}
+			for port := 1; port <= 5; port++ {
+				if rand.Intn(2) == 0 {
+					vid := 10 + rand.Intn(2)*10
+					v.ports = append(v.ports, port)
+					v.vlans[port] = []BridgeVlan{{Vid: vid, PVID: rand.Intn(2) == 0}}
+				}
+			}
+			views[bridge] = v
+			changed[bridge] = v
+		}
+		for _, bridge := range bridges {
+			if _, ok := devices[bridge]; !ok {
+				devices[bridge] = segmentDevice{node: bridge}
+			}
+		}
+		copied := make(map[string]segmentDevice, len(devices))
+		all := make([]segmentDevice, 0, len(devices))
+		for node, d := range devices {
+			copied[node] = d
+			all = append(all, d)
+		}
+		if i == 0 {
+			changed = views
+		}
+		s.update(copied, changed)
+
+		roots := make(map[string]segmentKey, len(devices))
+		for node := range devices {
+			roots[node] = s.roots[segmentKey{node, 0}]
+		}
+		if got, want := segmentGroups(roots), segmentGroups(segmentRoots(all, views)); !reflect.DeepEqual(got, want) {
+			t.Fatalf("step %d: update() = %v, want %v", i, got, want)
+		}
+	}
+}
+
+// segmentTopology returns a ring of size namespaces, each with a bridge,
+// eight veths to the next namespace as its ports, the eight peers of the
+// previous namespace and a VLAN on the first port: 18 devices each.
+func segmentTopology(size int) *Topology {
+	topology := NewTopology()
+	name := func(i int) string { return "ns" + strconv.Itoa((i+size)%size) }
+	for i := 0; i < size; i++ {
+		n := &Namespace{Name: name(i), topology: topology, L2Devices: make(map[int]LinkUpdateReceiver)}
+		topology.Namespaces[n.Name] = n
+		bridge := NewL2Bridge(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0", Index: 1}}, topology, n.Name,
+			false)
+		n.L2Devices[1] = bridge
+		for k := 0; k < 8; k++ {
+			bridge.AddPort(2 + k)
+			n.L2Devices[2+k] = &Veth{L2Device: &L2Device{Index: 2 + k, Namespace: n.Name, Master: 1},
+				PeerNamespace: name(i + 1), PeerIndex: 10 + k}
+			n.L2Devices[10+k] = &Veth{L2Device: &L2Device{Index: 10 + k, Namespace: n.Name},
+				PeerNamespace: name(i - 1), PeerIndex: 2 + k}
+		}
+		n.L2Devices[18] = &VlanDevice{stackedDevice: stackedDevice{L2Device: &L2Device{Index: 18, Namespace: n.Name},
+			parentLink: parentLink{ParentIndex: 2, ParentNamespace: n.Name}}, VlanID: 10}
+		go bridge.ReceiveLinkUpdate()
+	}
+	return topology
+}
+
+// BenchmarkTopology_UpdateSegments takes a port of a bridge out of it and
+// puts it back, one change per call.
+func BenchmarkTopology_UpdateSegments(b *testing.B) {
+	for _, size := range []int{10, 100, 1000} {
+		topology := segmentTopology(size)
+		topology.UpdateSegments()
+		n := topology.Namespaces["ns0"]
+		b.Run(strconv.Itoa(size*18)+" devices", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				port := &Veth{L2Device: &L2Device{Index: 9, Namespace: "ns0", Master: 1}, PeerNamespace: "ns1",
+					PeerIndex: 17}
+				if i%2 == 0 {
+					port.Master = 0
+				}
+				n.setL2Device(9, port)
+				topology.UpdateSegments()
+			}
+		})
+	}
+}
+
+func TestTopology_UpdateSegmentsConcurrently(t *testing.T) {
+	topology := segmentTopology(4)
+	n := topology.Namespaces["ns0"]
+	done := make(chan bool)
+	for k := 0; k < 4; k++ {
+		go func(k int) {
+			for i := 0; i < 50; i++ {
+				port := &Veth{L2Device: &L2Device{Index: 2 + k, Namespace: "ns0", Master: 1}, PeerNamespace: "ns1",
+					PeerIndex: 10 + k}
+				if i%2 == 0 {
+					port.Master = 0
+				}
+				n.setL2Device(2+k, port)
+				topology.UpdateSegments()
+			}
+			done <- true
+		}(k)
+	}
+	for k := 0; k < 4; k++ {
+		<-done
+	}
+	topology.UpdateSegments()
+
+	// Every port is back in its bridge.
+	fresh := segmentTopology(4)
+	fresh.UpdateSegments()
+	if got, want := segmentMembers(topology), segmentMembers(fresh); !reflect.DeepEqual(got, want) {
+		t.Errorf("segments = %v, want %v", got, want)
+	}
+}
+
+// segmentMembers returns the members of every segment of t, as sorted comma
+// separated lists.
+func segmentMembers(t *Topology) []string {
+	s := make([]string, 0)
+	for _, segment := range t.Segments() {
+		s = append(s, strings.Join(segment.Members, ","))
+	}
+	sort.Strings(s)
+	return s
+}
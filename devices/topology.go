@@ -14,20 +14,118 @@ import (
 
 type Topology struct {
 	Namespaces map[string]*Namespace
-	buffer     map[string]PeerEvent
+	// names maps every name a namespace is known by, including aliases, to
+	// the namespace. inodes maps the nsfs inode, which is the identity of a
+	// namespace, to the namespace.
+	names  map[string]*Namespace
+	inodes map[uint64]*Namespace
+	// stateLock guards Namespaces, names and inodes, the aliases and PIDs
+	// of every namespace, and the state other goroutines read to compute
+	// segments, traces, reachability and snapshots: the type, metadata,
+	// devices, routes, rules, nexthops and connections of every namespace,
+	// the name, status, master, peer and parent of every device, and the
+	// addresses, allowed IPs and neighbours of every L3 device.
+	// The goroutine owning that state reads it freely and locks to write.
+	// It is never held while firing events or waiting on a device.
+	stateLock sync.RWMutex
+	// nsidRefreshed is when the nsids of a namespace were last dumped
+	// because an id was not known, see NamespaceByNsid.
+	nsidRefreshed map[string]time.Time
+	// nsids maps a namespace name to the nsids the kernel assigned inside
+	// that namespace and the namespace each refers to, "" when untracked.
+	// peerNsids is the reverse mapping.
+	nsids     map[string]map[int]string
+	peerNsids map[string]map[string]int
+	// edges holds the typed relations between devices, see Edge.
+	edges        map[Edge]bool
+	edgeOnChange map[EdgeEvent][]func(Edge, EdgeEvent)
+	// segments holds the broadcast domains by ID and segmentOf the ID of
+	// the segment of every device, see UpdateSegments, computed from
+	// segmentState. segmentChannel wakes the goroutine computing them.
+	segments        map[string]*Segment
+	segmentOf       map[string]string
+	segmentSeq      int
+	segmentState    *segmentState
+	segmentChannel  chan bool
+	segmentOnChange map[SegmentEvent][]func(*Segment, SegmentEvent, interface{})
+	segmentLock     sync.Mutex
+	// reachability is the namespace to namespace matrix, see
+	// UpdateReachability.
+	reachability *reachabilityState
 	sync.Mutex
 }
 
 func NewTopology() *Topology {
 	t := Topology{
-		Namespaces: make(map[string]*Namespace),
-		buffer:     make(map[string]PeerEvent),
+		Namespaces:      make(map[string]*Namespace),
+		names:           make(map[string]*Namespace),
+		inodes:          make(map[uint64]*Namespace),
+		nsids:           make(map[string]map[int]string),
+		peerNsids:       make(map[string]map[string]int),
+		nsidRefreshed:   make(map[string]time.Time),
+		edges:           make(map[Edge]bool),
+		edgeOnChange:    make(map[EdgeEvent][]func(Edge, EdgeEvent)),
+		segments:        make(map[string]*Segment),
+		segmentOf:       make(map[string]string),
+		segmentState:    newSegmentState(),
+		segmentChannel:  make(chan bool, 1),
+		segmentOnChange: make(map[SegmentEvent][]func(*Segment, SegmentEvent, interface{})),
+		reachability:    newReachabilityState(),
 	}
+	go t.receiveSegmentUpdates()
+	go t.receiveReachabilityUpdates()
 	return &t
 }
 
+// GetNamespaces returns a copy of the namespaces by name.
 func (t *Topology) GetNamespaces() map[string]*Namespace {
-	return t.Namespaces
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	namespaces := make(map[string]*Namespace, len(t.Namespaces))
+	for name, n := range t.Namespaces {
+		namespaces[name] = n
+	}
+	return namespaces
+}
+
+// lockState and unlockState guard a write of state read across
+// goroutines, see stateLock. Devices made without a topology need none.
+func (t *Topology) lockState() {
+	if t != nil {
+		t.stateLock.Lock()
+	}
+}
+
+func (t *Topology) unlockState() {
+	if t != nil {
+		t.stateLock.Unlock()
+	}
+}
+
+// rlockState and runlockState guard a read of state another goroutine
+// owns.
+func (t *Topology) rlockState() {
+	if t != nil {
+		t.stateLock.RLock()
+	}
+}
+
+func (t *Topology) runlockState() {
+	if t != nil {
+		t.stateLock.RUnlock()
+	}
+}
+
+// namespaceList returns the namespaces, for walking them without holding
+// stateLock.
+func (t *Topology) namespaceList() []*Namespace {
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	namespaces := make([]*Namespace, 0, len(t.Namespaces))
+	for _, n := range t.Namespaces {
+		namespaces = append(namespaces, n)
+	}
+	return namespaces
 }
 
 var dumper *json.Encoder
@@ -42,7 +140,7 @@ func GetEncoder() *json.Encoder {
 }
 
 func (t *Topology) GetDefaultNamespace() *Namespace {
-	if n, ok := t.Namespaces["default"]; ok {
+	if n := t.Get("default"); n != nil {
 		return n
 	}
 	defaultNS, err := netns.Get()
@@ -55,62 +153,201 @@ func (t *Topology) GetDefaultNamespace() *Namespace {
 
 func (t *Topology) CreateNamespace(namespace string, targetNs *netns.NsHandle) *Namespace {
 	n := NewNamespace(namespace, t, targetNs)
-	t.Namespaces[namespace] = &n
-	return &n
+	t.stateLock.Lock()
+	t.Namespaces[namespace] = n
+	t.names[namespace] = n
+	if n.Inode != 0 {
+		t.inodes[n.Inode] = n
+	}
+	t.stateLock.Unlock()
+	return n
 }
 
 func (t *Topology) Get(namespace string) *Namespace {
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	return t.get(namespace)
+}
+
+// get is Get for callers holding stateLock.
+func (t *Topology) get(namespace string) *Namespace {
 	if n, ok := t.Namespaces[namespace]; ok {
 		return n
 	}
+	if n, ok := t.names[namespace]; ok {
+		return n
+	}
 	return nil
 }
 
-func (t *Topology) DeleteNamespace(namespace string) {
-	if n, ok := t.Namespaces[namespace]; ok {
-		<-time.After(100 * time.Millisecond)
-		for index, _ := range n.L2Devices {
-			n.RemoveDevice(index)
-		}
-		for index, _ := range n.L3Devices {
-			n.RemoveDevice(index)
-		}
-		n.Delete()
+// GetByInode returns the namespace whose nsfs inode is inode, or nil.
+func (t *Topology) GetByInode(inode uint64) *Namespace {
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	if n, ok := t.inodes[inode]; ok {
+		return n
 	}
-	delete(t.Namespaces, namespace)
+	return nil
 }
 
-func (t *Topology) AddToBuffer(event PeerEvent) {
-	t.Lock()
-	t.buffer[event.GetIndex()] = event
-	event.fireChangeEvents(VethUnknown)
-	t.Unlock()
+// AddAlias records name as another name of n, for example when a Docker
+// container namespace is also bind mounted under /var/run/netns.
+func (t *Topology) AddAlias(name string, n *Namespace) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	if _, ok := t.names[name]; ok {
+		return
+	}
+	t.names[name] = n
+	n.Aliases = append(n.Aliases, name)
 }
 
-func (t *Topology) GetPeerEvent(event PeerEvent) (PeerEvent, bool) {
-	t.Lock()
-	if e, ok := t.buffer[event.GetPeerIndex()]; ok {
-		t.Unlock()
-		return e, ok
+// SetPIDs records the processes living in the namespace with the given
+// inode. Unknown inodes are ignored.
+func (t *Topology) SetPIDs(inode uint64, pids []int) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	if n, ok := t.inodes[inode]; ok {
+		n.PIDs = pids
 	}
-	t.Unlock()
-	return PeerEvent{}, false
 }
 
-func (t *Topology) GetEvent(event PeerEvent) (PeerEvent, bool) {
+// DeleteNamespace forgets the name namespace. The namespace itself is only
+// torn down once no name refers to it anymore.
+func (t *Topology) DeleteNamespace(namespace string) {
+	t.stateLock.Lock()
+	n := t.get(namespace)
+	if n == nil {
+		t.stateLock.Unlock()
+		return
+	}
+	delete(t.names, namespace)
+	n.removeAlias(namespace)
+	_, named := t.names[n.Name]
+	aliased := len(n.Aliases) > 0
+	t.stateLock.Unlock()
+	if named || aliased {
+		return
+	}
+	<-time.After(100 * time.Millisecond)
+	for index, _ := range n.L2Devices {
+		n.RemoveDevice(index)
+	}
+	for index, _ := range n.L3Devices {
+		n.RemoveDevice(index)
+	}
+	n.Delete()
+	t.stateLock.Lock()
+	delete(t.Namespaces, n.Name)
+	delete(t.inodes, n.Inode)
+	t.stateLock.Unlock()
+	// Tunnels whose peer was in n are external again, or point to the
+	// namespace that has the address now.
+	t.ResolveTunnels()
 	t.Lock()
-	if e, ok := t.buffer[event.GetIndex()]; ok {
-		t.Unlock()
-		return e, ok
+	delete(t.nsids, n.Name)
+	delete(t.peerNsids, n.Name)
+	delete(t.nsidRefreshed, n.Name)
+	for ns, ids := range t.nsids {
+		for id, name := range ids {
+			if name == n.Name {
+				ids[id] = ""
+				delete(t.peerNsids[ns], name)
+			}
+		}
 	}
 	t.Unlock()
-	return PeerEvent{}, false
 }
 
-func (t *Topology) RemoveFromBuffer(index string) {
-	t.Lock()
-	delete(t.buffer, index)
-	t.Unlock()
+// Snapshot returns every namespace with its devices, addresses, routes,
+// rules, nexthops, connections and device segments encoded to JSON. The
+// devices encode themselves in their goroutines, the rest is encoded while
+// holding stateLock.
+func (t *Topology) Snapshot() json.RawMessage {
+	devices := make(map[*Namespace][]LinkUpdateReceiver)
+	t.stateLock.RLock()
+	for _, n := range t.Namespaces {
+		for _, d := range n.L2Devices {
+			devices[n] = append(devices[n], d)
+		}
+	}
+	t.stateLock.RUnlock()
+	encoded := make(map[*Namespace][]json.RawMessage, len(devices))
+	for n, ds := range devices {
+		for _, d := range ds {
+			encoded[n] = append(encoded[n], d.Attrs().marshal())
+		}
+	}
+
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	namespaces := make([]map[string]interface{}, 0, len(t.Namespaces))
+	for _, n := range t.Namespaces {
+		l2 := encoded[n]
+		if l2 == nil {
+			l2 = make([]json.RawMessage, 0)
+		}
+		addrs := make(map[int][]string)
+		allowedIPs := make(map[int][]string)
+		for index, d := range n.L3Devices {
+			if l3, ok := d.(*L3Device); ok {
+				addrs[index] = l3.IP
+				if len(l3.AllowedIPs) != 0 {
+					allowedIPs[index] = l3.AllowedIPs
+				}
+			}
+		}
+		connections := make([]string, 0, len(n.Connections))
+		for c := range n.Connections {
+			connections = append(connections, c)
+		}
+		edges := make([]Edge, 0)
+		for _, e := range t.Edges() {
+			if nodeNamespace(e.From) == n.Name || nodeNamespace(e.To) == n.Name {
+				edges = append(edges, e)
+			}
+		}
+		segments := make(map[int]string)
+		for index := range n.L2Devices {
+			if s := t.SegmentOf(getNSIndex(n.Name, index)); s != nil {
+				segments[index] = s.ID
+			}
+		}
+		namespaces = append(namespaces, map[string]interface{}{
+			"name":        n.Name,
+			"inode":       n.Inode,
+			"aliases":     n.Aliases,
+			"pids":        n.PIDs,
+			"sources":     n.Sources,
+			"metadata":    n.Metadata,
+			"nsids":       t.Nsids(n.Name),
+			"mode":        n.Type,
+			"devices":     l2,
+			"addresses":   addrs,
+			"allowedIPs":  allowedIPs,
+			"routes":      n.RouteTables(),
+			"rules":       n.Rules,
+			"nexthops":    n.Nexthops,
+			"connections": connections,
+			"edges":       edges,
+			"segments":    segments,
+		})
+	}
+	b, err := json.Marshal(namespaces)
+	if err != nil {
+		fmt.Println("ERROR: ENCODING SNAPSHOT", err)
+		return json.RawMessage("[]")
+	}
+	return b
+}
+
+// ReadState runs f holding stateLock for reading, so that the tracked state
+// f reads, see stateLock, does not change meanwhile. f must neither change
+// the topology nor wait on a device.
+func (t *Topology) ReadState(f func()) {
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	f()
 }
 
 func (t *Topology) Connect(ns1Index, ns2Index string) {
@@ -0,0 +1,432 @@
+package devices
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxTraceHops bounds a trace, so that a routing loop the visited check
+// does not catch still ends.
+const maxTraceHops = 64
+
+// TraceHop is a step of a trace: where the packet is and why it goes on,
+// or why it stops there.
+type TraceHop struct {
+	Namespace string `json:"namespace"`
+	Device    string `json:"device,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// Causes of a packet being dropped, see Trace.Cause.
+const (
+	TraceNoRoute         = "no route"
+	TraceLinkDown        = "link down"
+	TracePortBlocking    = "port blocking"
+	TraceMissingNeighbor = "missing neighbor"
+	TraceNoPath          = "no path"
+	TraceLoop            = "loop"
+	TraceUntracked       = "untracked"
+)
+
+// Trace is the path a packet from Source, a namespace or "namespace:device",
+// to Destination takes through the topology. It is computed from the
+// tracked state only, nothing is sent. Reached tells whether the last hop
+// delivers the packet, Cause otherwise why the last hop drops it.
+type Trace struct {
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	Hops        []TraceHop `json:"hops"`
+	Reached     bool       `json:"reached"`
+	Cause       string     `json:"cause,omitempty"`
+	// bridges are the views of the bridges taken before the trace, since
+	// the bridge goroutines cannot be asked while holding stateLock.
+	bridges map[*L2Bridge]bridgeView
+}
+
+func (tr *Trace) hop(n *Namespace, index int, format string, a ...interface{}) {
+	h := TraceHop{Namespace: n.Name, Reason: fmt.Sprintf(format, a...)}
+	if index != 0 {
+		h.Device = n.DeviceLabel(index)
+	}
+	tr.Hops = append(tr.Hops, h)
+}
+
+func (tr *Trace) drop(n *Namespace, index int, cause, format string, a ...interface{}) {
+	tr.hop(n, index, "dropped: "+format, a...)
+	tr.Cause = cause
+}
+
+// untracked drops the packet at node, whose namespace is not tracked, or no
+// longer.
+func (tr *Trace) untracked(node string) {
+	tr.Hops = append(tr.Hops, TraceHop{Namespace: nodeNamespace(node), Reason: "dropped: namespace is not tracked"})
+	tr.Cause = TraceUntracked
+}
+
+// String formats tr one hop per line.
+func (tr *Trace) String() string {
+	s := "trace from " + tr.Source + " to " + tr.Destination + "\n"
+	for i, h := range tr.Hops {
+		s += fmt.Sprintf("%3d  %s", i+1, h.Namespace)
+		if h.Device != "" {
+			s += " " + h.Device
+		}
+		s += ": " + h.Reason + "\n"
+	}
+	if tr.Reached {
+		return s + "reached"
+	}
+	return s + "not reached: " + tr.Cause
+}
+
+// Trace follows a packet from source to dst: the route lookup in every
+// namespace it crosses, the outgoing device, the veth peer, the bridges
+// and their FDB, until the namespace owning dst or the hop dropping it.
+// A device in source, "namespace:device", restricts the first lookup to
+// routes through that device, like ping -I does.
+func (t *Topology) Trace(source string, dst net.IP) (*Trace, error) {
+	bridges := t.bridgeViews()
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	return t.trace(source, dst, bridges)
+}
+
+// bridgeViews asks every bridge for a view of its ports and FDB.
+func (t *Topology) bridgeViews() map[*L2Bridge]bridgeView {
+	bridges := make([]*L2Bridge, 0)
+	t.stateLock.RLock()
+	for _, n := range t.Namespaces {
+		for _, d := range n.L2Devices {
+			if b, ok := d.(*L2Bridge); ok {
+				bridges = append(bridges, b)
+			}
+		}
+	}
+	t.stateLock.RUnlock()
+	views := make(map[*L2Bridge]bridgeView, len(bridges))
+	for _, b := range bridges {
+		views[b] = b.view()
+	}
+	return views
+}
+
+// trace is Trace for callers holding stateLock, with the views of the
+// bridges taken before.
+func (t *Topology) trace(source string, dst net.IP, bridges map[*L2Bridge]bridgeView) (*Trace, error) {
+	parts := strings.SplitN(source, ":", 2)
+	n := t.get(parts[0])
+	if n == nil {
+		return nil, fmt.Errorf("unknown namespace %s", parts[0])
+	}
+	oif := 0
+	if len(parts) == 2 {
+		if oif = n.deviceIndex(parts[1]); oif == 0 {
+			return nil, fmt.Errorf("unknown device %s in namespace %s", parts[1], n.Name)
+		}
+	}
+	tr := &Trace{Source: source, Destination: dst.String(), Hops: make([]TraceHop, 0), bridges: bridges}
+	visited := make(map[string]bool)
+	for len(tr.Hops) < maxTraceHops {
+		if visited[n.Name] {
+			tr.drop(n, 0, TraceLoop, "loop, %s was crossed already", n.Name)
+			return tr, nil
+		}
+		visited[n.Name] = true
+		if index := n.localDevice(dst); index != 0 {
+			tr.hop(n, index, "%s is a local address", dst)
+			tr.Reached = true
+			return tr, nil
+		}
+		r, reason := n.lookupRoute(dst, oif)
+		if r == nil {
+			tr.drop(n, 0, TraceNoRoute, "%s", reason)
+			return tr, nil
+		}
+		if r.Type == "local" {
+			tr.hop(n, r.OutputIndex, "local route %s (%s)", r, reason)
+			tr.Reached = true
+			return tr, nil
+		}
+		if r.Type != "unicast" {
+			tr.drop(n, r.OutputIndex, TraceNoRoute, "%s route %s (%s)", r.Type, r, reason)
+			return tr, nil
+		}
+		paths := r.Paths()
+		if len(paths) == 0 {
+			tr.drop(n, 0, TraceNoRoute, "route %s has no usable nexthop", r)
+			return tr, nil
+		}
+		p := paths[0]
+		s := "route " + r.String() + " (" + reason + ")"
+		if len(paths) > 1 {
+			s += fmt.Sprintf(", first of %d paths", len(paths))
+		}
+		tr.hop(n, p.OutputIndex, "%s", s)
+		next := t.traceEgress(tr, n, p, dst)
+		if next == nil {
+			return tr, nil
+		}
+		n, oif = next, 0
+	}
+	tr.drop(n, 0, TraceLoop, "more than %d hops", maxTraceHops)
+	return tr, nil
+}
+
+// traceEgress sends the packet out of path p of a route of n, and returns
+// the namespace owning the next hop once the packet got there.
+func (t *Topology) traceEgress(tr *Trace, n *Namespace, p *RouteNexthop, dst net.IP) *Namespace {
+	d, ok := n.L2Devices[p.OutputIndex]
+	if !ok {
+		tr.drop(n, 0, TraceUntracked, "output device %d is not tracked", p.OutputIndex)
+		return nil
+	}
+	if d.Attrs().Status != L2Up {
+		tr.drop(n, p.OutputIndex, TraceLinkDown, "link %s", d.Attrs().Status)
+		return nil
+	}
+	nh := dst
+	if p.gw != nil {
+		nh = p.gw
+	}
+	mac := ""
+	if l3, ok := n.L3Devices[p.OutputIndex].(*L3Device); ok {
+		if nb, ok := l3.Neighbors[nh.String()]; !ok {
+			tr.hop(n, p.OutputIndex, "no neighbor entry for %s, it would be resolved first", nh)
+		} else if nb.Failed() {
+			tr.drop(n, p.OutputIndex, TraceMissingNeighbor, "neighbor %s failed to resolve", nh)
+			return nil
+		} else {
+			mac = nb.MAC
+			tr.hop(n, p.OutputIndex, "neighbor %s is %s, %s", nh, mac, nb.State)
+		}
+	}
+	owner, index := t.gatewayOwner(n, nh)
+	if owner == nil {
+		tr.drop(n, p.OutputIndex, TraceUntracked, "next hop %s is not a tracked device", nh)
+		return nil
+	}
+	if !t.traceL2(tr, getNSIndex(n.Name, p.OutputIndex), mac, getNSIndex(owner.Name, index)) {
+		return nil
+	}
+	return owner
+}
+
+// traceL2 follows a frame to mac sent out of node until it reaches target,
+// the device owning the next hop. It reports whether it got there.
+func (t *Topology) traceL2(tr *Trace, node, mac, target string) bool {
+	for i := 0; i < maxTraceHops; i++ {
+		n, index := t.nodeDevice(node)
+		if n == nil {
+			tr.untracked(node)
+			return false
+		}
+		var next string
+		switch dev := n.L2Devices[index].(type) {
+		case *L2Bridge:
+			// Sent by the bridge itself, it enters through its own port.
+			out, ok := t.traceBridge(tr, n, dev, index, index, mac, target)
+			if !ok || out == "" {
+				return ok
+			}
+			node = out
+			continue
+		case *Veth:
+			if !dev.linkResolved() {
+				tr.drop(n, index, TraceUntracked, "veth peer is not tracked")
+				return false
+			}
+			next = getNSIndex(dev.PeerNamespace, dev.PeerIndex)
+			tr.hop(n, index, "veth to %s", t.nodeLabel(next))
+		case *VlanDevice:
+			if !dev.linkResolved() {
+				tr.drop(n, index, TraceUntracked, "parent is not tracked")
+				return false
+			}
+			node = getNSIndex(dev.ParentNamespace, dev.ParentIndex)
+			tr.hop(n, index, "tagged with vlan %d on %s", dev.VlanID, t.nodeLabel(node))
+			continue
+		case *Macvlan:
+			if next = t.traceStacked(tr, n, index, dev.parentLink, target); next == "" {
+				return false
+			}
+		case *Ipvlan:
+			if next = t.traceStacked(tr, n, index, dev.parentLink, target); next == "" {
+				return false
+			}
+		default:
+			tr.drop(n, index, TraceUntracked, "leaves the tracked topology")
+			return false
+		}
+		out, ok := t.traceIngress(tr, next, mac, target)
+		if !ok || out == "" {
+			return ok
+		}
+		node = out
+	}
+	return false
+}
+
+// traceStacked sends a frame out of a macvlan or ipvlan device. Frames to a
+// sibling on the same parent are switched by the parent, other frames
+// leave through it. It returns the node the frame goes to, or "".
+func (t *Topology) traceStacked(tr *Trace, n *Namespace, index int, parent parentLink, target string) string {
+	if !parent.linkResolved() {
+		tr.drop(n, index, TraceUntracked, "parent is not tracked")
+		return ""
+	}
+	parentNode := getNSIndex(parent.ParentNamespace, parent.ParentIndex)
+	if tn, ti := t.nodeDevice(target); tn != nil {
+		var sibling parentLink
+		switch dev := tn.L2Devices[ti].(type) {
+		case *Macvlan:
+			sibling = dev.parentLink
+		case *Ipvlan:
+			sibling = dev.parentLink
+		}
+		if sibling.linkResolved() && getNSIndex(sibling.ParentNamespace, sibling.ParentIndex) == parentNode {
+			tr.hop(n, index, "switched by parent %s", t.nodeLabel(parentNode))
+			return target
+		}
+	}
+	tr.hop(n, index, "out of parent %s", t.nodeLabel(parentNode))
+	return parentNode
+}
+
+// traceIngress receives a frame to mac on node. It returns "" once the
+// frame reached target, or the node a bridge forwards it out of.
+func (t *Topology) traceIngress(tr *Trace, node, mac, target string) (string, bool) {
+	for i := 0; i < maxTraceHops; i++ {
+		n, index := t.nodeDevice(node)
+		if n == nil {
+			tr.untracked(node)
+			return "", false
+		}
+		if node == target {
+			tr.hop(n, index, "arrives at the next hop")
+			return "", true
+		}
+		d, ok := n.L2Devices[index]
+		if !ok {
+			tr.drop(n, 0, TraceUntracked, "device %d is not tracked", index)
+			return "", false
+		}
+		if d.Attrs().Status != L2Up {
+			tr.drop(n, index, TraceLinkDown, "link %s", d.Attrs().Status)
+			return "", false
+		}
+		master := d.Attrs().Master
+		switch m := n.L2Devices[master].(type) {
+		case *L2Bridge:
+			return t.traceBridge(tr, n, m, master, index, mac, target)
+		case *L2Bond:
+			tr.hop(n, index, "member of bond %s", n.DeviceLabel(master))
+			node = getNSIndex(n.Name, master)
+			continue
+		}
+		if nodeNamespace(node) == nodeNamespace(target) && t.SameSegment(node, target) {
+			tr.hop(n, index, "passed up to %s", t.nodeLabel(target))
+			return "", true
+		}
+		tr.drop(n, index, TraceNoPath, "does not lead to the next hop %s", t.nodeLabel(target))
+		return "", false
+	}
+	return "", false
+}
+
+// traceBridge forwards a frame to mac received on port in of bridge b, by
+// its FDB entry or, for an unknown MAC, by flooding, in which case the port
+// leading to target is followed. It returns the port the frame leaves
+// through, or "" when target is the bridge itself.
+func (t *Topology) traceBridge(tr *Trace, n *Namespace, b *L2Bridge, index, in int, mac, target string) (string, bool) {
+	v := tr.bridges[b]
+	if st, ok := v.stp[in]; ok && in != index && st.State != "forwarding" {
+		tr.drop(n, in, TracePortBlocking, "port of bridge %s is %s", b.Name, st.State)
+		return "", false
+	}
+	if target == getNSIndex(n.Name, index) {
+		tr.hop(n, index, "arrives at the next hop, bridge %s", b.Name)
+		return "", true
+	}
+	out := 0
+	if mac != "" {
+		for _, e := range v.lookup(mac) {
+			if e.Port != in && e.Port != index {
+				out = e.Port
+				tr.hop(n, index, "fdb: %s on port %s vlan %d", mac, n.DeviceLabel(out), e.Vlan)
+				break
+			}
+		}
+	}
+	if out == 0 {
+		for _, port := range v.ports {
+			if port != in && t.SameSegment(getNSIndex(n.Name, port), target) {
+				out = port
+				break
+			}
+		}
+		if out == 0 {
+			tr.drop(n, index, TraceNoPath, "flooded, no port leads to %s", t.nodeLabel(target))
+			return "", false
+		}
+		tr.hop(n, index, "flooded, the next hop is behind port %s", n.DeviceLabel(out))
+	}
+	if st, ok := v.stp[out]; ok && st.State != "forwarding" {
+		tr.drop(n, out, TracePortBlocking, "port of bridge %s is %s", b.Name, st.State)
+		return "", false
+	}
+	return getNSIndex(n.Name, out), true
+}
+
+// nodeDevice splits node, "namespace:index", into its namespace and index.
+func (t *Topology) nodeDevice(node string) (*Namespace, int) {
+	parts := strings.SplitN(node, ":", 2)
+	if len(parts) != 2 {
+		return nil, 0
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, 0
+	}
+	return t.get(parts[0]), index
+}
+
+// nodeLabel names node as "namespace/device".
+func (t *Topology) nodeLabel(node string) string {
+	n, index := t.nodeDevice(node)
+	if n == nil {
+		return node
+	}
+	return n.Name + "/" + n.DeviceLabel(index)
+}
+
+// deviceIndex returns the index of the device named name, or of the device
+// whose index is name, or 0.
+func (n *Namespace) deviceIndex(name string) int {
+	if index, err := strconv.Atoi(name); err == nil {
+		if _, ok := n.L2Devices[index]; ok {
+			return index
+		}
+	}
+	for index, d := range n.L2Devices {
+		if d.Attrs().Name == name {
+			return index
+		}
+	}
+	return 0
+}
+
+// localDevice returns the index of the device of n owning ip, or 0.
+func (n *Namespace) localDevice(ip net.IP) int {
+	for index, d := range n.L3Devices {
+		if l3, ok := d.(*L3Device); ok {
+			for _, addr := range l3.ip {
+				if addr.IP.Equal(ip) {
+					return index
+				}
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+package devices
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// traceTopology builds a <-> b <-> c, every link a veth pair named after
+// the namespace at its other end, with a routing loop between a and b for
+// 172.16.0.0/16 and a device of a that is down.
+func traceTopology() *Topology {
+	t := NewTopology()
+	add := func(name string) *Namespace {
+		n := &Namespace{Name: name, topology: t,
+			L2Devices: make(map[int]LinkUpdateReceiver), L3Devices: make(map[int]LinkAddrUpdateReceiver)}
+		t.Namespaces[name] = n
+		return n
+	}
+	link := func(n *Namespace, index int, name, peer, addr string) {
+		n.L2Devices[index] = &Veth{L2Device: &L2Device{Name: name, Index: index, Namespace: n.Name, Status: L2Up},
+			PeerNamespace: peer, PeerIndex: index}
+		n.L3Devices[index] = &L3Device{Index: index, Namespace: n.Name, IP: []string{addr},
+			ip: []*net.IPNet{mustCIDR(addr)}}
+	}
+	route := func(n *Namespace, dst, gw string, index int) {
+		r := netlink.Route{LinkIndex: index, Table: syscall.RT_TABLE_MAIN, Type: syscall.RTN_UNICAST, Gw: net.ParseIP(gw)}
+		if dst != "" {
+			r.Dst = mustCIDR(dst)
+		}
+		n.Routes = append(n.Routes, NewRoute(r, n.DeviceLabel(index)))
+	}
+
+	a, b, c := add("a"), add("b"), add("c")
+	link(a, 2, "b", "b", "10.0.0.1/24")
+	link(b, 2, "a", "a", "10.0.0.2/24")
+	link(b, 3, "c", "c", "10.1.0.1/24")
+	link(c, 3, "b", "b", "10.1.0.2/24")
+	a.L2Devices[4] = &Veth{L2Device: &L2Device{Name: "down", Index: 4, Namespace: "a", Status: L2Down}}
+	route(a, "10.0.0.0/24", "", 2)
+	route(a, "192.168.0.0/24", "", 4)
+	route(a, "172.16.0.0/16", "10.0.0.2", 2)
+	route(a, "", "10.0.0.2", 2)
+	route(b, "10.0.0.0/24", "", 2)
+	route(b, "10.1.0.0/24", "", 3)
+	route(b, "172.16.0.0/16", "10.0.0.1", 2)
+	route(c, "10.1.0.0/24", "", 3)
+	route(c, "", "10.1.0.1", 3)
+	return t
+}
+
+// traceHops traces dst from source and returns the trace with its hops as
+// namespace/device, or namespace alone for hops inside a namespace.
+func traceHops(t *testing.T, topology *Topology, source, dst string) (*Trace, string) {
+	tr, err := topology.trace(source, net.ParseIP(dst), nil)
+	if err != nil {
+		t.Fatalf("trace(%s, %s) error = %v", source, dst, err)
+	}
+	hops := make([]string, 0, len(tr.Hops))
+	for _, h := range tr.Hops {
+		if h.Device == "" {
+			hops = append(hops, h.Namespace)
+		} else {
+			hops = append(hops, h.Namespace+"/"+h.Device)
+		}
+	}
+	return tr, strings.Join(hops, " ")
+}
+
+func TestTopology_trace(t *testing.T) {
+	topology := traceTopology()
+
+	tr, hops := traceHops(t, topology, "a", "10.0.0.1")
+	if want := "a/b"; hops != want || !tr.Reached {
+		t.Errorf("trace() of a local address = %s, reached %v, want %s\n%s", hops, tr.Reached, want, tr)
+	}
+	tr, hops = traceHops(t, topology, "a", "10.1.0.2")
+	if want := "a/b a/b a/b b/a b/c b/c b/c c/b c/b"; hops != want || !tr.Reached {
+		t.Errorf("trace() two routers away = %s, reached %v, want %s\n%s", hops, tr.Reached, want, tr)
+	}
+	tr, hops = traceHops(t, topology, "c", "10.0.0.1")
+	if want := "c/b c/b c/b b/c b/a b/a b/a a/b a/b"; hops != want || !tr.Reached {
+		t.Errorf("trace() back = %s, reached %v, want %s\n%s", hops, tr.Reached, want, tr)
+	}
+	tr, hops = traceHops(t, topology, "c:b", "10.1.0.1")
+	if want := "c/b c/b c/b b/c b/c"; hops != want || !tr.Reached {
+		t.Errorf("trace() from a device = %s, reached %v, want %s\n%s", hops, tr.Reached, want, tr)
+	}
+
+	tr, hops = traceHops(t, topology, "a", "8.8.8.8")
+	if want := "a/b a/b a/b b/a b"; hops != want || tr.Reached || tr.Cause != TraceNoRoute {
+		t.Errorf("trace() without a route = %s, cause %q, want %s, %q\n%s", hops, tr.Cause, want, TraceNoRoute, tr)
+	}
+	tr, hops = traceHops(t, topology, "a", "192.168.0.1")
+	if want := "a/down a/down"; hops != want || tr.Reached || tr.Cause != TraceLinkDown {
+		t.Errorf("trace() through a device down = %s, cause %q, want %s, %q\n%s", hops, tr.Cause, want,
+			TraceLinkDown, tr)
+	}
+	tr, hops = traceHops(t, topology, "a", "172.16.0.1")
+	if want := "a/b a/b a/b b/a b/a b/a b/a a/b a"; hops != want || tr.Reached || tr.Cause != TraceLoop {
+		t.Errorf("trace() of a loop = %s, cause %q, want %s, %q\n%s", hops, tr.Cause, want, TraceLoop, tr)
+	}
+
+	for _, source := range []string{"d", "a:eth9"} {
+		if _, err := topology.trace(source, net.ParseIP("10.0.0.1"), nil); err == nil {
+			t.Errorf("trace() from unknown source %s succeeded", source)
+		}
+	}
+}
+
+func TestTrace_String(t *testing.T) {
+	tr, _ := traceHops(t, traceTopology(), "a", "10.0.0.2")
+	want := "trace from a to 10.0.0.2\n" +
+		"  1  a b: route 10.0.0.0/24 dev b table main proto unspec scope global metric 0 type unicast (rule 32766: from all lookup main)\n" +
+		"  2  a b: no neighbor entry for 10.0.0.2, it would be resolved first\n" +
+		"  3  a b: veth to b/a\n" +
+		"  4  b a: arrives at the next hop\n" +
+		"  5  b a: 10.0.0.2 is a local address\n" +
+		"reached"
+	if got := tr.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestTopology_TraceWhileAddingDevices(t *testing.T) {
+	topology := traceTopology()
+	a := topology.Namespaces["a"]
+	stop, done := make(chan bool), make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+				index := 1000 + i%100
+				a.setL2Device(index, &Veth{L2Device: &L2Device{Name: "eth" + strconv.Itoa(i), Index: index}})
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if tr, err := topology.Trace("a", net.ParseIP("10.1.0.2")); err != nil || !tr.Reached {
+			t.Fatalf("Trace() = %v, %v, want c reached", tr, err)
+		}
+	}
+	stop <- true
+	<-done
+}
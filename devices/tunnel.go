@@ -0,0 +1,296 @@
+package devices
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	TunnelCreate = iota
+	TunnelUnderlayResolve
+	TunnelPeerResolve
+	TunnelPeerExternal
+	TunnelDelete
+)
+
+var TunnelEventStrings = []string{
+	"TunnelCreate",
+	"TunnelUnderlayResolve",
+	"TunnelPeerResolve",
+	"TunnelPeerExternal",
+	"TunnelDelete",
+}
+
+type TunnelEvent int
+
+func (e TunnelEvent) String() string {
+	for i, str := range TunnelEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+// IFLA_GENEVE_* attributes, which the netlink package does not decode.
+const (
+	iflaGeneveID      = 1
+	iflaGeneveRemote  = 2
+	iflaGenevePort    = 5
+	iflaGeneveRemote6 = 7
+)
+
+// Tunnel is a vxlan, geneve, GRE or IP in IP device. The parent of a tunnel
+// is its underlay device, when it is bound to one. Peer is the node owning
+// Remote: a device of this host when some namespace has that address, an
+// external node otherwise.
+type Tunnel struct {
+	*L2Device
+	parentLink
+	Kind     string `json:"kind"`
+	VNI      int    `json:"vni,omitempty"`
+	Key      uint32 `json:"key,omitempty"`
+	Local    string `json:"local,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Peer     string `json:"peer,omitempty"`
+	remote   net.IP
+	onChange map[TunnelEvent][]func(*Tunnel, TunnelEvent)
+	// peerChannel asks the goroutine of the tunnel to resolve its peer
+	// again, see ResolveTunnels.
+	peerChannel *chan bool
+}
+
+var defaultTunnelSubscriber []func(*Tunnel, TunnelEvent)
+
+func SubscribeAllTunnelEvents(callback func(*Tunnel, TunnelEvent)) {
+	defaultTunnelSubscriber = append(defaultTunnelSubscriber, callback)
+}
+
+// NewTunnel creates the tunnel of update. info holds the IFLA_INFO_DATA
+// attributes of the link, needed for kinds netlink does not decode.
+func NewTunnel(update netlink.Link, info []syscall.NetlinkRouteAttr, t *Topology, namespace string, consoleDisplay bool) *Tunnel {
+	peerChannel := make(chan bool, 1)
+	tun := &Tunnel{
+		L2Device: NewL2Device(update, t, namespace, consoleDisplay),
+		parentLink: parentLink{
+			parentNetNsID: update.Attrs().NetNsID,
+		},
+		Kind:        update.Type(),
+		onChange:    make(map[TunnelEvent][]func(*Tunnel, TunnelEvent)),
+		peerChannel: &peerChannel,
+	}
+	var local net.IP
+	switch link := linkOf(update).(type) {
+	case *netlink.Vxlan:
+		tun.VNI = link.VxlanId
+		tun.Port = link.Port
+		tun.ParentIndex = link.VtepDevIndex
+		local = link.SrcAddr
+		// A multicast group floods to every member, only a unicast group is
+		// the address of a single peer.
+		if !link.Group.IsMulticast() {
+			tun.remote = link.Group
+		}
+	case *netlink.Gretap:
+		tun.Key = link.OKey
+		tun.ParentIndex = int(link.Link)
+		local, tun.remote = link.Local, link.Remote
+	case *netlink.Gretun:
+		tun.Key = link.OKey
+		tun.ParentIndex = int(link.Link)
+		local, tun.remote = link.Local, link.Remote
+	case *netlink.Iptun:
+		tun.ParentIndex = int(link.Link)
+		local, tun.remote = link.Local, link.Remote
+	case *netlink.Ip6tnl:
+		tun.ParentIndex = int(link.Link)
+		local, tun.remote = link.Local, link.Remote
+	case *netlink.Sittun:
+		tun.ParentIndex = int(link.Link)
+		local, tun.remote = link.Local, link.Remote
+	case *netlink.Vti:
+		tun.Key = link.OKey
+		tun.ParentIndex = int(link.Link)
+		local, tun.remote = link.Local, link.Remote
+	default:
+		if tun.Kind == "geneve" {
+			tun.parseGeneve(info)
+		}
+	}
+	if local != nil && !local.IsUnspecified() {
+		tun.Local = local.String()
+	}
+	if tun.remote != nil && tun.remote.IsUnspecified() {
+		tun.remote = nil
+	}
+	if tun.remote != nil {
+		tun.Remote = tun.remote.String()
+	}
+	for index, _ := range TunnelEventStrings {
+		for _, defaultCallback := range defaultTunnelSubscriber {
+			if err := tun.OnChange(TunnelEvent(index), defaultCallback); err != nil {
+				fmt.Println("ERROR: ASSIGNING ONCHANGE", err)
+			}
+		}
+	}
+	tun.fireChangeEvents(TunnelCreate)
+	return tun
+}
+
+func (tun *Tunnel) parseGeneve(info []syscall.NetlinkRouteAttr) {
+	for _, attr := range info {
+		switch attr.Attr.Type {
+		case iflaGeneveID:
+			if len(attr.Value) >= 4 {
+				tun.VNI = int(nl.NativeEndian().Uint32(attr.Value))
+			}
+		case iflaGeneveRemote, iflaGeneveRemote6:
+			tun.remote = net.IP(attr.Value)
+		case iflaGenevePort:
+			if len(attr.Value) >= 2 {
+				tun.Port = int(binary.BigEndian.Uint16(attr.Value))
+			}
+		}
+	}
+}
+
+func (tun *Tunnel) linkResolved() bool {
+	return tun.ParentIndex == 0 || tun.ParentNamespace != ""
+}
+
+// resolveLink looks the underlay device up and adds the underlay edge.
+func (tun *Tunnel) resolveLink() {
+	if tun.ParentIndex == 0 {
+		return
+	}
+	if tun.findParent(tun.L2Device, EdgeUnderlay) {
+		tun.fireChangeEvents(TunnelUnderlayResolve)
+	}
+}
+
+// resolvePeer places the remote endpoint of tun, either on a device of this
+// host or on an external node, and moves the tunnel edge when it changed.
+// It runs in the goroutine of the tunnel.
+func (tun *Tunnel) resolvePeer() {
+	if tun.remote == nil {
+		return
+	}
+	peer := ExternalNode(tun.remote)
+	if ns, index := tun.topology.FindAddressOwner(tun.remote); ns != nil {
+		peer = getNSIndex(ns.Name, index)
+	}
+	if peer == tun.Peer {
+		return
+	}
+	node := getNSIndex(tun.Namespace, tun.Index)
+	if tun.Peer != "" {
+		tun.topology.RemoveEdge(Edge{Kind: tun.Kind, From: node, To: tun.Peer})
+	}
+	tun.Peer = peer
+	tun.topology.AddEdge(Edge{Kind: tun.Kind, From: node, To: peer})
+	if nodeNamespace(peer) == ExternalNamespace {
+		tun.fireChangeEvents(TunnelPeerExternal)
+	} else {
+		tun.fireChangeEvents(TunnelPeerResolve)
+	}
+}
+
+// FindAddressOwner returns the namespace and the index of the device that
+// has ip assigned, or nil when no tracked namespace has it.
+func (t *Topology) FindAddressOwner(ip net.IP) (*Namespace, int) {
+	t.stateLock.RLock()
+	defer t.stateLock.RUnlock()
+	for _, n := range t.Namespaces {
+		for index, d := range n.L3Devices {
+			l3, ok := d.(*L3Device)
+			if !ok {
+				continue
+			}
+			for _, addr := range l3.ip {
+				if addr.IP.Equal(ip) {
+					return n, index
+				}
+			}
+		}
+	}
+	return nil, 0
+}
+
+// ResolveTunnels asks every tunnel to place its remote endpoint again,
+// after addresses changed or a namespace was deleted. Requests made while
+// one is pending are merged into it.
+func (t *Topology) ResolveTunnels() {
+	tunnels := make([]*Tunnel, 0)
+	t.stateLock.RLock()
+	for _, n := range t.Namespaces {
+		for _, d := range n.L2Devices {
+			if tun, ok := d.(*Tunnel); ok {
+				tunnels = append(tunnels, tun)
+			}
+		}
+	}
+	t.stateLock.RUnlock()
+	for _, tun := range tunnels {
+		select {
+		case *tun.peerChannel <- true:
+		default:
+		}
+	}
+}
+
+func (tun *Tunnel) ReceiveLinkUpdate() {
+	tun.resolvePeer()
+	for {
+		select {
+		case <-*(tun.peerChannel):
+			tun.resolvePeer()
+		case f := <-*(tun.flagsChannel):
+			tun.SetFlags(f.flags, f.operState)
+		case m := <-*(tun.setMasterChannel):
+			if m.masterIndex != 0 {
+				tun.SetMaster(m.masterIndex)
+			} else {
+				tun.UnsetMaster()
+			}
+		case reply := <-*(tun.snapshotChannel):
+			reply <- marshalDevice(tun.topology, tun)
+		case d := <-*(tun.dumpChannel):
+			if d {
+				dumper.Encode(tun)
+				*(tun.dumpChannel) <- true
+			}
+		case d := <-*(tun.deleteChannel):
+			if d {
+				return
+			}
+		case n := <-*(tun.nameChannel):
+			tun.SetName(n)
+		}
+	}
+}
+
+func (tun *Tunnel) DeleteDevice() {
+	tun.L2Device.DeleteDevice()
+	tun.fireChangeEvents(TunnelDelete)
+}
+
+func (tun *Tunnel) OnChange(event TunnelEvent, callback func(*Tunnel, TunnelEvent)) error {
+	if int(event) >= len(TunnelEventStrings) || int(event) < 0 {
+		return errors.New("Tunnel OnChange: TunnelEvent unrecognized")
+	}
+	tun.onChange[event] = append(tun.onChange[event], callback)
+	return nil
+}
+
+func (tun *Tunnel) fireChangeEvents(event TunnelEvent) {
+	for _, f := range tun.onChange[event] {
+		f(tun, event)
+	}
+}
@@ -0,0 +1,259 @@
+package devices
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	TuntapCreate = iota
+	TuntapOwnerChange
+	TuntapDelete
+)
+
+var TuntapEventStrings = []string{
+	"TuntapCreate",
+	"TuntapOwnerChange",
+	"TuntapDelete",
+}
+
+type TuntapEvent int
+
+func (e TuntapEvent) String() string {
+	for i, str := range TuntapEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+// Tuntap is a TUN or TAP device. PID is the process holding it open, found
+// through the iff: line the tun driver adds to /proc/<pid>/fdinfo. Domain is
+// the guest name when that process is QEMU.
+type Tuntap struct {
+	*L2Device
+	Mode     string `json:"mode"`
+	PID      int    `json:"pid"`
+	Command  string `json:"command"`
+	Domain   string `json:"domain,omitempty"`
+	onChange map[TuntapEvent][]func(*Tuntap, TuntapEvent)
+}
+
+var defaultTuntapSubscriber []func(*Tuntap, TuntapEvent)
+
+func SubscribeAllTuntapEvents(callback func(*Tuntap, TuntapEvent)) {
+	defaultTuntapSubscriber = append(defaultTuntapSubscriber, callback)
+}
+
+func NewTuntap(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) *Tuntap {
+	tap := &Tuntap{
+		L2Device: NewL2Device(update, t, namespace, consoleDisplay),
+		onChange: make(map[TuntapEvent][]func(*Tuntap, TuntapEvent)),
+	}
+	if link, ok := linkOf(update).(*netlink.Tuntap); ok {
+		switch link.Mode {
+		case netlink.TUNTAP_MODE_TUN:
+			tap.Mode = "tun"
+		case netlink.TUNTAP_MODE_TAP:
+			tap.Mode = "tap"
+		}
+	}
+	for index, _ := range TuntapEventStrings {
+		for _, defaultCallback := range defaultTuntapSubscriber {
+			if err := tap.OnChange(TuntapEvent(index), defaultCallback); err != nil {
+				fmt.Println("ERROR: ASSIGNING ONCHANGE", err)
+			}
+		}
+	}
+	tap.fireChangeEvents(TuntapCreate)
+	tap.findOwner()
+	return tap
+}
+
+// Label returns the name the device is best known by: the guest, the
+// owning command or the interface name.
+func (tap *Tuntap) Label() string {
+	if tap.Domain != "" {
+		return tap.Domain
+	}
+	if tap.Command != "" {
+		return tap.Command
+	}
+	return tap.Name
+}
+
+// findOwner looks for the process holding tap open. The fd is often passed
+// from a management daemon to the VM after the device was created, so this
+// is repeated whenever the state of the device changes.
+func (tap *Tuntap) findOwner() {
+	var inode uint64
+	if n := tap.topology.Get(tap.Namespace); n != nil {
+		inode = n.Inode
+	}
+	pid := findTunOwner(tap.Name, inode)
+	if pid == tap.PID {
+		return
+	}
+	command, domain := "", ""
+	if pid != 0 {
+		cmdline := procCmdline(pid)
+		if len(cmdline) != 0 {
+			command = filepath.Base(cmdline[0])
+			if strings.Contains(command, "qemu") {
+				domain = qemuDomain(cmdline)
+			}
+		}
+	}
+	tap.topology.lockState()
+	tap.PID, tap.Command, tap.Domain = pid, command, domain
+	tap.topology.unlockState()
+	tap.fireChangeEvents(TuntapOwnerChange)
+}
+
+// findTunOwner returns the pid of a process with an fd attached to the tun
+// device name, preferring processes in the network namespace with inode
+// nsInode since names are only unique within a namespace.
+func findTunOwner(name string, nsInode uint64) int {
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	owner := 0
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil || !procHasTun(pid, name) {
+			continue
+		}
+		if nsInode == 0 || procNetNsInode(pid) == nsInode {
+			return pid
+		}
+		if owner == 0 {
+			owner = pid
+		}
+	}
+	return owner
+}
+
+func procHasTun(pid int, name string) bool {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err != nil || target != "/dev/net/tun" {
+			continue
+		}
+		if fdinfoIff(fmt.Sprintf("/proc/%d/fdinfo/%s", pid, fd.Name())) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fdinfoIff returns the interface named on the iff: line of an fdinfo file.
+func fdinfoIff(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "iff:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "iff:"))
+		}
+	}
+	return ""
+}
+
+func procNetNsInode(pid int) uint64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(fmt.Sprintf("/proc/%d/ns/net", pid), &st); err != nil {
+		return 0
+	}
+	return st.Ino
+}
+
+func procCmdline(pid int) []string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+}
+
+// qemuDomain returns the guest name from the -name argument of a QEMU
+// command line, either "-name vm2" or libvirt's "-name guest=vm2,...".
+func qemuDomain(cmdline []string) string {
+	for i, arg := range cmdline {
+		if arg != "-name" || i+1 == len(cmdline) {
+			continue
+		}
+		for _, opt := range strings.Split(cmdline[i+1], ",") {
+			if strings.HasPrefix(opt, "guest=") {
+				return strings.TrimPrefix(opt, "guest=")
+			}
+		}
+		return strings.Split(cmdline[i+1], ",")[0]
+	}
+	return ""
+}
+
+func (tap *Tuntap) ReceiveLinkUpdate() {
+	for {
+		select {
+		case f := <-*(tap.flagsChannel):
+			tap.SetFlags(f.flags, f.operState)
+			tap.findOwner()
+		case m := <-*(tap.setMasterChannel):
+			if m.masterIndex != 0 {
+				tap.SetMaster(m.masterIndex)
+			} else {
+				tap.UnsetMaster()
+			}
+		case reply := <-*(tap.snapshotChannel):
+			reply <- marshalDevice(tap.topology, tap)
+		case d := <-*(tap.dumpChannel):
+			if d {
+				dumper.Encode(tap)
+				*(tap.dumpChannel) <- true
+			}
+		case d := <-*(tap.deleteChannel):
+			if d {
+				return
+			}
+		case n := <-*(tap.nameChannel):
+			tap.SetName(n)
+		}
+	}
+}
+
+func (tap *Tuntap) DeleteDevice() {
+	tap.L2Device.DeleteDevice()
+	tap.fireChangeEvents(TuntapDelete)
+}
+
+func (tap *Tuntap) OnChange(event TuntapEvent, callback func(*Tuntap, TuntapEvent)) error {
+	if int(event) >= len(TuntapEventStrings) || int(event) < 0 {
+		return errors.New("Tuntap OnChange: TuntapEvent unrecognized")
+	}
+	tap.onChange[event] = append(tap.onChange[event], callback)
+	return nil
+}
+
+func (tap *Tuntap) fireChangeEvents(event TuntapEvent) {
+	for _, f := range tap.onChange[event] {
+		f(tap, event)
+	}
+}
@@ -3,11 +3,8 @@ package devices
 import (
 	"errors"
 	"fmt"
-	"runtime"
-	"time"
 
 	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netns"
 )
 
 const (
@@ -33,11 +30,16 @@ func (e VethEvent) String() string {
 	return ""
 }
 
+// Veth is one end of a veth pair. PeerIndex is the ifindex of the other end
+// as reported by IFLA_LINK, and peerNetNsID the nsid of the namespace it
+// lives in as reported by IFLA_LINK_NETNSID. PeerNamespace is only set once
+// the peer has been found in the topology.
 type Veth struct {
 	*L2Device
 	PeerName      string
 	PeerIndex     int
 	PeerNamespace string
+	peerNetNsID   int
 	onChange      map[VethEvent][]func(*Veth, VethEvent)
 }
 
@@ -50,9 +52,10 @@ func SubscribeAllVethEvents(callback func(*Veth, VethEvent)) {
 func NewVeth(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) (*Veth, error) {
 	l2dev := NewL2Device(update, t, namespace, consoleDisplay)
 	v := &Veth{
-		L2Device:  l2dev,
-		PeerIndex: -1,
-		onChange:  make(map[VethEvent][]func(veth *Veth, event VethEvent)),
+		L2Device:    l2dev,
+		PeerIndex:   update.Attrs().ParentIndex,
+		peerNetNsID: update.Attrs().NetNsID,
+		onChange:    make(map[VethEvent][]func(veth *Veth, event VethEvent)),
 	}
 	for index, _ := range VethEventStrings {
 		for _, defaultCallback := range defaultVethSubscriber {
@@ -61,82 +64,80 @@ func NewVeth(update netlink.Link, t *Topology, namespace string, consoleDisplay
 			}
 		}
 	}
-	func() {
-		//<- time.After(100 * time.Millisecond)
-		if peer, ok := v.isPeerVisible(); ok {
-			v.PeerNamespace = v.Namespace
-			v.PeerName = peer.Name
-			v.PeerIndex = peer.Index
-			v.raiseCreateEvent()
-			//v.Pair(peer.Index, peer.Name, v.Namespace)
-		} else {
-			//fmt.Println(v.Index, v.PeerIndex, v.Namespace, "VETH CREATE")
-			v.raiseCreateEvent()
-		}
-	}()
+	if v.PeerIndex == 0 {
+		return v, errors.New("veth " + v.Name + " reported no peer ifindex")
+	}
 	return v, nil
 }
 
 func (v *Veth) Pair(peerIndex int, peerName, peerNamespace string) {
-	//fmt.Println("Pairing", v.Name, v.Namespace[:7], "with", peer.Name, peer.Namespace[:7])
+	v.topology.lockState()
 	v.PeerNamespace = peerNamespace
 	v.PeerName = peerName
 	v.PeerIndex = peerIndex
+	v.topology.unlockState()
 	v.fireChangeEvents(VethPair)
 }
 
+// Unknown marks the peer as not found in the topology, either because its
+// namespace is not tracked yet or because it was just deleted or moved.
 func (v *Veth) Unknown() {
+	v.topology.lockState()
+	v.PeerNamespace = ""
+	v.PeerName = ""
+	v.topology.unlockState()
 	v.fireChangeEvents(VethUnknown)
 }
 
-func (v *Veth) raiseCreateEvent() {
-	e := NewPeerEvent(v, VPCreate)
-	v.topology.Get(v.Namespace).SendVPCreateEvent(e)
-}
-
-func (v *Veth) raiseDeleteEvent() {
-	e := NewPeerEvent(v, VPDelete)
-	//fmt.Printf("Raise Delete Event %+v\n", e.Veth)
-	v.topology.Get(v.Namespace).SendVPDeleteEvent(e)
-}
-
-func (v *Veth) isPeerVisible() (*netlink.Veth, bool) {
-	//<- time.After(50 * time.Millisecond)
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-	err := netns.Set(*v.topology.Get(v.Namespace).nsHandle)
-	if err != nil {
-		fmt.Println("ERROR: SETTING NS TO ", v.Namespace, err)
-		return nil, false
+// peerNamespace returns the namespace the peer of v lives in.
+func (t *Topology) peerNamespace(v *Veth) *Namespace {
+	n := t.Get(v.Namespace)
+	if n == nil {
+		return nil
 	}
-	t, err := netlink.LinkByIndex(v.Index)
-	if err != nil {
-		fmt.Println("ERROR: GETTING LINK", v.Namespace, err)
-		return nil, false
-	}
-	v.Name = t.Attrs().Name
-	d, err := netlink.VethPeerIndex(t.(*netlink.Veth))
-	if err != nil {
-		//fmt.Println("ERROR: GETTING PEER INDEX in NS", v.Namespace, err)
-		<-time.After(500 * time.Millisecond)
-		d, err = netlink.VethPeerIndex(t.(*netlink.Veth))
-		if err != nil {
-			fmt.Println("ERROR: GETTING PEER INDEX in NS even after 500 milliseconds", v.Namespace, err, t.Attrs().ParentIndex)
-			return nil, false
+	return t.ResolveLinkNamespace(n, v.Index, v.peerNetNsID)
+}
+
+// PairVeth links v with its peer if the peer is already in the topology.
+// Whichever end is seen last completes the pair, so both ends agree as soon
+// as both namespaces are tracked.
+func (t *Topology) PairVeth(v *Veth) {
+	if peerNs := t.peerNamespace(v); peerNs != nil {
+		if peer := peerNs.GetVeth(v.PeerIndex); peer != nil && peer != v {
+			v.Pair(peer.Index, peer.Name, peer.Namespace)
+			peer.Pair(v.Index, v.Name, v.Namespace)
+			t.Connect(getNSIndex(v.Namespace, v.Index), getNSIndex(peer.Namespace, peer.Index))
+			t.segmentsChanged()
+			return
 		}
 	}
-	v.SetPeerIndex(d)
-	p, err := netlink.LinkByIndex(d)
-	if err != nil {
-		return nil, false
+	v.Unknown()
+}
+
+// UnpairVeth drops the connection of a deleted veth and leaves its peer
+// waiting for a new end, which is what a move into another namespace looks
+// like.
+func (t *Topology) UnpairVeth(v *Veth) {
+	if v.PeerNamespace == "" {
+		return
 	}
-	return p.(*netlink.Veth), true
+	t.Disconnect(getNSIndex(v.Namespace, v.Index), getNSIndex(v.PeerNamespace, v.PeerIndex))
+	if peer := t.Get(v.PeerNamespace).GetVeth(v.PeerIndex); peer != nil &&
+		peer.PeerNamespace == v.Namespace && peer.PeerIndex == v.Index {
+		peer.Unknown()
+	}
+	t.segmentsChanged()
+}
+
+func (v *Veth) linkResolved() bool {
+	return v.PeerNamespace != ""
+}
+
+func (v *Veth) resolveLink() {
+	v.topology.PairVeth(v)
 }
 
 func (v *Veth) ReceiveLinkUpdate() {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-	netns.Set(*v.topology.Get(v.Namespace).nsHandle)
 	for {
 		select {
 		case f := <-*(v.flagsChannel):
@@ -147,6 +148,8 @@ func (v *Veth) ReceiveLinkUpdate() {
 			} else {
 				v.UnsetMaster()
 			}
+		case reply := <-*(v.snapshotChannel):
+			reply <- marshalDevice(v.topology, v)
 		case d := <-*(v.dumpChannel):
 			if d {
 				dumper.Encode(v)
@@ -164,20 +167,23 @@ func (v *Veth) ReceiveLinkUpdate() {
 }
 
 func (v *Veth) DeleteDevice() {
-	//fmt.Println("Delete VETH")
 	v.L2Device.DeleteDevice()
-	//fmt.Println("Index:", v.Index, " Peer Index:", v.PeerIndex, "Namespace:", v.Namespace, "Peer Namespace:, ", v.PeerNamespace, "VETH DELETE")
-	v.raiseDeleteEvent()
+	v.topology.UnpairVeth(v)
+	v.fireChangeEvents(VethDelete)
 }
 
 func (v *Veth) SetName(s string) {
 	if v.Name == s {
 		return
 	}
+	v.topology.lockState()
 	v.Name = s
+	v.topology.unlockState()
 }
 func (v *Veth) SetPeerIndex(i int) {
+	v.topology.lockState()
 	v.PeerIndex = i
+	v.topology.unlockState()
 }
 func (v *Veth) OnChange(event VethEvent, callback func(*Veth, VethEvent)) error {
 	if int(event) >= len(VethEventStrings) || int(event) < 0 {
@@ -0,0 +1,67 @@
+package devices
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	VlanCreate = iota
+	VlanParentResolve
+	VlanParentUnknown
+	VlanDelete
+)
+
+var VlanEventStrings = stackedEventStrings("Vlan")
+
+type VlanEvent int
+
+func (e VlanEvent) String() string {
+	for i, str := range VlanEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+// VlanDevice is a VLAN sub-interface such as eth0.100.
+type VlanDevice struct {
+	stackedDevice
+	VlanID   int    `json:"vlanId"`
+	Protocol string `json:"protocol"`
+}
+
+var defaultVlanSubscriber []func(*VlanDevice, VlanEvent)
+
+func SubscribeAllVlanEvents(callback func(*VlanDevice, VlanEvent)) {
+	defaultVlanSubscriber = append(defaultVlanSubscriber, callback)
+}
+
+func NewVlanDevice(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) *VlanDevice {
+	v := &VlanDevice{stackedDevice: newStackedDevice(update, t, namespace, consoleDisplay, EdgeVlan)}
+	v.device = v
+	if link, ok := linkOf(update).(*netlink.Vlan); ok {
+		v.VlanID = link.VlanId
+		v.Protocol = link.VlanProtocol.String()
+		if link.VlanProtocol == netlink.VLAN_PROTOCOL_UNKNOWN {
+			v.Protocol = netlink.VLAN_PROTOCOL_8021Q.String()
+		}
+	}
+	for index, _ := range VlanEventStrings {
+		for _, defaultCallback := range defaultVlanSubscriber {
+			if err := v.OnChange(VlanEvent(index), defaultCallback); err != nil {
+				fmt.Println("ERROR: ASSIGNING ONCHANGE", err)
+			}
+		}
+	}
+	v.fireChangeEvents(stackedCreate)
+	return v
+}
+
+func (v *VlanDevice) OnChange(event VlanEvent, callback func(*VlanDevice, VlanEvent)) error {
+	return v.onStackedChange(stackedEvent(event), func(e stackedEvent) {
+		callback(v, VlanEvent(e))
+	})
+}
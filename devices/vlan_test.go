@@ -0,0 +1,52 @@
+package devices
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestVlanDevice_events(t *testing.T) {
+	topology := NewTopology()
+	n := NewNamespace("test", topology, nil)
+	topology.Namespaces["test"] = n
+	link := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "eth0.10", Index: 3, ParentIndex: 2}, VlanId: 10}
+	v := NewVlanDevice(link, topology, "test", false)
+	n.setL2Device(3, v)
+	go v.ReceiveLinkUpdate()
+
+	events := make([]string, 0)
+	for _, event := range []VlanEvent{VlanParentResolve, VlanParentUnknown, VlanDelete} {
+		if err := v.OnChange(event, func(d *VlanDevice, e VlanEvent) {
+			if d != v {
+				t.Errorf("%s fired for %v", e, d)
+			}
+			events = append(events, e.String())
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.OnChange(VlanEvent(len(VlanEventStrings)), nil); err == nil {
+		t.Error("OnChange() accepted an unknown event")
+	}
+
+	v.resolveLink()
+	n.setL2Device(2, NewL2Device(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}},
+		topology, "test", false))
+	v.resolveLink()
+
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(v.marshal(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot["name"] != "eth0.10" || snapshot["vlanId"] != 10.0 || snapshot["parentNamespace"] != "test" {
+		t.Errorf("snapshot = %v, want eth0.10 in VLAN 10 on a parent in test", snapshot)
+	}
+
+	v.DeleteDevice()
+	if want := []string{"VlanParentUnknown", "VlanParentResolve", "VlanDelete"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
@@ -0,0 +1,193 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	VrfCreate = iota
+	VrfAddMember
+	VrfRemoveMember
+	VrfRouteAdd
+	VrfRouteDelete
+	VrfDelete
+)
+
+var VrfEventStrings = []string{
+	"VrfCreate",
+	"VrfAddMember",
+	"VrfRemoveMember",
+	"VrfRouteAdd",
+	"VrfRouteDelete",
+	"VrfDelete",
+}
+
+type VrfEvent int
+
+func (e VrfEvent) String() string {
+	for i, str := range VrfEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+type vrfRouteEvent struct {
+	route *Route
+	add   bool
+}
+
+// Vrf is an L3 master device. Its members route through Table, whose routes
+// are kept in Routes.
+type Vrf struct {
+	*L2Device
+	Table        int          `json:"table"`
+	Members      map[int]bool `json:"members"`
+	Routes       []*Route     `json:"routes"`
+	routeChannel *chan vrfRouteEvent
+	onChange     map[VrfEvent][]func(*Vrf, VrfEvent, interface{})
+}
+
+// Vrf callbacks get the member index of VrfAddMember and VrfRemoveMember
+// and the *Route of VrfRouteAdd and VrfRouteDelete, nil otherwise.
+var defaultVrfSubscriber []func(*Vrf, VrfEvent, interface{})
+
+func SubscribeAllVrfEvents(callback func(*Vrf, VrfEvent, interface{})) {
+	defaultVrfSubscriber = append(defaultVrfSubscriber, callback)
+}
+
+func NewVrf(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) *Vrf {
+	routeChannel := make(chan vrfRouteEvent)
+	v := &Vrf{
+		L2Device:     NewL2Device(update, t, namespace, consoleDisplay),
+		Members:      make(map[int]bool),
+		Routes:       make([]*Route, 0),
+		routeChannel: &routeChannel,
+		onChange:     make(map[VrfEvent][]func(*Vrf, VrfEvent, interface{})),
+	}
+	if link, ok := linkOf(update).(*netlink.Vrf); ok {
+		v.Table = int(link.Table)
+	}
+	for index, _ := range VrfEventStrings {
+		for _, defaultCallback := range defaultVrfSubscriber {
+			if err := v.OnChange(VrfEvent(index), defaultCallback); err != nil {
+				fmt.Println("ERROR: ASSIGNING ONCHANGE", err)
+			}
+		}
+	}
+	v.fireChangeEvents(VrfCreate, nil)
+	return v
+}
+
+func (v *Vrf) AddMember(devIndex int) {
+	if v.Members[devIndex] {
+		return
+	}
+	v.topology.lockState()
+	v.Members[devIndex] = true
+	v.topology.unlockState()
+	v.fireChangeEvents(VrfAddMember, devIndex)
+}
+
+func (v *Vrf) RemoveMember(devIndex int) {
+	if !v.Members[devIndex] {
+		return
+	}
+	v.topology.lockState()
+	delete(v.Members, devIndex)
+	v.topology.unlockState()
+	v.fireChangeEvents(VrfRemoveMember, devIndex)
+}
+
+// updateRoute hands a route of the table of v to its goroutine. The kernel
+// flushes the table when the VRF is deleted, so routes may still arrive
+// once the goroutine stopped.
+func (v *Vrf) updateRoute(r *Route, add bool) {
+	select {
+	case *v.routeChannel <- vrfRouteEvent{r, add}:
+	case <-time.After(deviceQueryTimeout):
+	}
+}
+
+func (v *Vrf) AddRoute(r *Route) {
+	v.topology.lockState()
+	v.Routes = append(v.Routes, r)
+	v.topology.unlockState()
+	v.fireChangeEvents(VrfRouteAdd, r)
+}
+
+func (v *Vrf) DeleteRoute(r *Route) {
+	for i, route := range v.Routes {
+		if route == r {
+			v.topology.lockState()
+			v.Routes = append(v.Routes[0:i], v.Routes[i+1:]...)
+			v.topology.unlockState()
+			v.fireChangeEvents(VrfRouteDelete, r)
+			return
+		}
+	}
+}
+
+func (v *Vrf) ReceiveLinkUpdate() {
+	for {
+		select {
+		case f := <-*(v.flagsChannel):
+			v.SetFlags(f.flags, f.operState)
+		case m := <-*(v.setMasterChannel):
+			if m.devIndex == v.Index {
+				if m.masterIndex != 0 {
+					v.SetMaster(m.masterIndex)
+				} else {
+					v.UnsetMaster()
+				}
+			} else if m.masterIndex != 0 {
+				v.AddMember(m.devIndex)
+			} else {
+				v.RemoveMember(m.devIndex)
+			}
+		case r := <-*(v.routeChannel):
+			if r.add {
+				v.AddRoute(r.route)
+			} else {
+				v.DeleteRoute(r.route)
+			}
+		case reply := <-*(v.snapshotChannel):
+			reply <- marshalDevice(v.topology, v)
+		case d := <-*(v.dumpChannel):
+			if d {
+				dumper.Encode(v)
+				*(v.dumpChannel) <- true
+			}
+		case d := <-*(v.deleteChannel):
+			if d {
+				return
+			}
+		case n := <-*(v.nameChannel):
+			v.SetName(n)
+		}
+	}
+}
+
+func (v *Vrf) DeleteDevice() {
+	v.L2Device.DeleteDevice()
+	v.fireChangeEvents(VrfDelete, nil)
+}
+
+func (v *Vrf) OnChange(event VrfEvent, callback func(*Vrf, VrfEvent, interface{})) error {
+	if int(event) >= len(VrfEventStrings) || int(event) < 0 {
+		return errors.New("Vrf OnChange: VrfEvent unrecognized")
+	}
+	v.onChange[event] = append(v.onChange[event], callback)
+	return nil
+}
+
+func (v *Vrf) fireChangeEvents(event VrfEvent, item interface{}) {
+	for _, f := range v.onChange[event] {
+		f(v, event, item)
+	}
+}
@@ -0,0 +1,50 @@
+package devices
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestNamespace_DeleteRouteOfRemovedVrf(t *testing.T) {
+	topology := NewTopology()
+	n := NewNamespace("test", topology, nil)
+	link := &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: "vrf-red", Index: 5}, Table: 10}
+	v := NewVrf(link, topology, "test", false)
+	n.setL2Device(5, v)
+	go v.ReceiveLinkUpdate()
+
+	added := make(chan *Route, 1)
+	v.OnChange(VrfRouteAdd, func(v *Vrf, event VrfEvent, item interface{}) {
+		added <- item.(*Route)
+	})
+	route := netlink.Route{Dst: mustCIDR("10.2.0.0/24"), Table: 10, Type: syscall.RTN_UNICAST}
+	n.AddRoute(route)
+	select {
+	case r := <-added:
+		if r.VRF != "vrf-red" {
+			t.Errorf("route VRF = %q, want vrf-red", r.VRF)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("vrf-red got no route of table 10")
+	}
+
+	// RemoveDevice stops the goroutine of the VRF before it takes it out
+	// of L2Devices, while the kernel flushes the table of the VRF.
+	v.DeleteDevice()
+	done := make(chan bool)
+	go func() {
+		n.DeleteRoute(route)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * deviceQueryTimeout):
+		t.Error("DeleteRoute() blocked on a removed VRF")
+	}
+	if len(n.Routes) != 0 {
+		t.Errorf("len(n.Routes) = %d, want 0", len(n.Routes))
+	}
+}
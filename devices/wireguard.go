@@ -0,0 +1,246 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	WireGuardCreate = iota
+	WireGuardPeerAdd
+	WireGuardPeerRemove
+	WireGuardHandshake
+	WireGuardHandshakeStale
+	WireGuardDelete
+)
+
+var WireGuardEventStrings = []string{
+	"WireGuardCreate",
+	"WireGuardPeerAdd",
+	"WireGuardPeerRemove",
+	"WireGuardHandshake",
+	"WireGuardHandshakeStale",
+	"WireGuardDelete",
+}
+
+type WireGuardEvent int
+
+func (e WireGuardEvent) String() string {
+	for i, str := range WireGuardEventStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+// The kernel announces neither handshakes nor configuration changes, so
+// WireGuard devices are polled. A session whose last handshake is older
+// than wireGuardStaleAfter has expired, see REJECT_AFTER_TIME.
+const (
+	wireGuardPollInterval = 10 * time.Second
+	wireGuardStaleAfter   = 180 * time.Second
+)
+
+type WireGuardPeer struct {
+	PublicKey     string    `json:"publicKey"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	AllowedIPs    []string  `json:"allowedIPs"`
+	LastHandshake time.Time `json:"lastHandshake"`
+	Stale         bool      `json:"stale"`
+}
+
+// WireGuard is a WireGuard interface, configured through the WireGuard
+// generic netlink family.
+type WireGuard struct {
+	*L2Device
+	ListenPort int                       `json:"listenPort"`
+	PublicKey  string                    `json:"publicKey"`
+	Peers      map[string]*WireGuardPeer `json:"peers"`
+	lastError  string
+	onChange   map[WireGuardEvent][]func(*WireGuard, WireGuardEvent, interface{})
+	// refreshChannel asks for a poll before the next tick, see
+	// WireGuard.refreshSoon.
+	refreshChannel *chan bool
+}
+
+// WireGuard callbacks get the *WireGuardPeer peer events are about, nil for
+// WireGuardCreate and WireGuardDelete.
+var defaultWireGuardSubscriber []func(*WireGuard, WireGuardEvent, interface{})
+
+func SubscribeAllWireGuardEvents(callback func(*WireGuard, WireGuardEvent, interface{})) {
+	defaultWireGuardSubscriber = append(defaultWireGuardSubscriber, callback)
+}
+
+func NewWireGuard(update netlink.Link, t *Topology, namespace string, consoleDisplay bool) *WireGuard {
+	refreshChannel := make(chan bool, 1)
+	w := &WireGuard{
+		L2Device:       NewL2Device(update, t, namespace, consoleDisplay),
+		Peers:          make(map[string]*WireGuardPeer),
+		onChange:       make(map[WireGuardEvent][]func(*WireGuard, WireGuardEvent, interface{})),
+		refreshChannel: &refreshChannel,
+	}
+	for index, _ := range WireGuardEventStrings {
+		for _, defaultCallback := range defaultWireGuardSubscriber {
+			if err := w.OnChange(WireGuardEvent(index), defaultCallback); err != nil {
+				fmt.Println("ERROR: ASSIGNING ONCHANGE", err)
+			}
+		}
+	}
+	w.fireChangeEvents(WireGuardCreate, nil)
+	return w
+}
+
+// device queries the configuration of w from inside its namespace.
+func (w *WireGuard) device() (*wgtypes.Device, error) {
+	n := w.topology.Get(w.Namespace)
+	if n == nil {
+		return nil, fmt.Errorf("namespace %s not found", w.Namespace)
+	}
+	var dev *wgtypes.Device
+	err := n.Exec(func() error {
+		c, err := wgctrl.New()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		dev, err = c.Device(w.Name)
+		return err
+	})
+	return dev, err
+}
+
+// refreshSoon asks for a poll of w, such as when its L3 device was created
+// and waits for the allowed IPs. Requests made while one is pending are
+// merged into it.
+func (w *WireGuard) refreshSoon() {
+	select {
+	case *w.refreshChannel <- true:
+	default:
+	}
+}
+
+// refresh polls the configuration and the handshakes of w and fires events
+// for what changed since the last poll. The allowed IPs of the peers are
+// handed to the L3 device of w.
+func (w *WireGuard) refresh() {
+	dev, err := w.device()
+	if err != nil {
+		if err.Error() != w.lastError {
+			fmt.Println("ERROR: QUERYING WIREGUARD DEVICE", w.Name, "IN NS", w.Namespace, err)
+			w.lastError = err.Error()
+		}
+		return
+	}
+	w.lastError = ""
+	w.ListenPort = dev.ListenPort
+	w.PublicKey = dev.PublicKey.String()
+
+	seen := make(map[string]bool)
+	allowed := make([]string, 0)
+	for _, p := range dev.Peers {
+		key := p.PublicKey.String()
+		seen[key] = true
+		peer, ok := w.Peers[key]
+		if !ok {
+			peer = &WireGuardPeer{PublicKey: key}
+			w.Peers[key] = peer
+		}
+		peer.Endpoint = ""
+		if p.Endpoint != nil {
+			peer.Endpoint = p.Endpoint.String()
+		}
+		peer.AllowedIPs = make([]string, 0, len(p.AllowedIPs))
+		for _, ipNet := range p.AllowedIPs {
+			peer.AllowedIPs = append(peer.AllowedIPs, ipNet.String())
+		}
+		allowed = append(allowed, peer.AllowedIPs...)
+		stale := p.LastHandshakeTime.IsZero() || time.Since(p.LastHandshakeTime) > wireGuardStaleAfter
+		handshake := !p.LastHandshakeTime.Equal(peer.LastHandshake)
+		peer.LastHandshake = p.LastHandshakeTime
+		if !ok {
+			peer.Stale = stale
+			w.fireChangeEvents(WireGuardPeerAdd, peer)
+		} else if stale && !peer.Stale {
+			peer.Stale = true
+			w.fireChangeEvents(WireGuardHandshakeStale, peer)
+		} else if handshake && !stale {
+			peer.Stale = false
+			w.fireChangeEvents(WireGuardHandshake, peer)
+		}
+	}
+	for key, peer := range w.Peers {
+		if !seen[key] {
+			w.fireChangeEvents(WireGuardPeerRemove, peer)
+			delete(w.Peers, key)
+		}
+	}
+	var l3 *L3Device
+	w.topology.stateLock.RLock()
+	if n := w.topology.get(w.Namespace); n != nil {
+		l3, _ = n.L3Devices[w.Index].(*L3Device)
+	}
+	w.topology.stateLock.RUnlock()
+	if l3 != nil {
+		l3.updateAllowedIPs(allowed)
+	}
+}
+
+func (w *WireGuard) ReceiveLinkUpdate() {
+	ticker := time.NewTicker(wireGuardPollInterval)
+	defer ticker.Stop()
+	w.refresh()
+	for {
+		select {
+		case <-ticker.C:
+			w.refresh()
+		case <-*(w.refreshChannel):
+			w.refresh()
+		case f := <-*(w.flagsChannel):
+			w.SetFlags(f.flags, f.operState)
+		case m := <-*(w.setMasterChannel):
+			if m.masterIndex != 0 {
+				w.SetMaster(m.masterIndex)
+			} else {
+				w.UnsetMaster()
+			}
+		case reply := <-*(w.snapshotChannel):
+			reply <- marshalDevice(w.topology, w)
+		case d := <-*(w.dumpChannel):
+			if d {
+				dumper.Encode(w)
+				*(w.dumpChannel) <- true
+			}
+		case d := <-*(w.deleteChannel):
+			if d {
+				return
+			}
+		case n := <-*(w.nameChannel):
+			w.SetName(n)
+		}
+	}
+}
+
+func (w *WireGuard) DeleteDevice() {
+	w.L2Device.DeleteDevice()
+	w.fireChangeEvents(WireGuardDelete, nil)
+}
+
+func (w *WireGuard) OnChange(event WireGuardEvent, callback func(*WireGuard, WireGuardEvent, interface{})) error {
+	if int(event) >= len(WireGuardEventStrings) || int(event) < 0 {
+		return errors.New("WireGuard OnChange: WireGuardEvent unrecognized")
+	}
+	w.onChange[event] = append(w.onChange[event], callback)
+	return nil
+}
+
+func (w *WireGuard) fireChangeEvents(event WireGuardEvent, item interface{}) {
+	for _, f := range w.onChange[event] {
+		f(w, event, item)
+	}
+}
@@ -0,0 +1,190 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+const criScanInterval = 5 * time.Second
+
+type cri struct {
+	// seen holds the ID of every pod sandbox reported so far, false for
+	// those in the host network namespace.
+	seen map[string]bool
+	sync.Mutex
+}
+
+// NewCRI returns a Discoverer that finds the network namespaces of the pod
+// sandboxes of a CRI runtime (containerd, CRI-O) through crictl, which reads
+// the runtime endpoint from /etc/crictl.yaml or CONTAINER_RUNTIME_ENDPOINT.
+// Namespaces are named after the pod sandbox ID like Docker containers are.
+func NewCRI() Discoverer {
+	return &cri{seen: make(map[string]bool)}
+}
+
+func (c *cri) Name() string {
+	return "cri"
+}
+
+type criPod struct {
+	ID       string `json:"id"`
+	Metadata struct {
+		Name      string `json:"name"`
+		UID       string `json:"uid"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+}
+
+type criPodStatus struct {
+	Status struct {
+		Linux struct {
+			Namespaces struct {
+				Options struct {
+					Network string `json:"network"`
+				} `json:"options"`
+			} `json:"namespaces"`
+		} `json:"linux"`
+	} `json:"status"`
+	Info struct {
+		Pid         int `json:"pid"`
+		RuntimeSpec struct {
+			Linux struct {
+				Namespaces []struct {
+					Type string `json:"type"`
+					Path string `json:"path"`
+				} `json:"namespaces"`
+			} `json:"linux"`
+		} `json:"runtimeSpec"`
+	} `json:"info"`
+}
+
+// crictl runs a crictl command with JSON output and decodes it into v.
+func crictl(v interface{}, command string, args ...string) error {
+	out, err := exec.Command("crictl", append([]string{command, "-o", "json"}, args...)...).Output()
+	if err != nil {
+		return fmt.Errorf("crictl %s: %v", command, err)
+	}
+	return json.Unmarshal(out, v)
+}
+
+func listPods() ([]criPod, error) {
+	var pods struct {
+		Items []criPod `json:"items"`
+	}
+	if err := crictl(&pods, "pods", "--state", "ready"); err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// openPodNamespace opens the network namespace of the pod sandbox id. It
+// returns false for pods in the host network namespace, which has no pod of
+// its own to report.
+func openPodNamespace(id string) (netns.NsHandle, bool, error) {
+	var status criPodStatus
+	if err := crictl(&status, "inspectp", id); err != nil {
+		return netns.None(), false, err
+	}
+	if status.Status.Linux.Namespaces.Options.Network == "NODE" {
+		return netns.None(), false, nil
+	}
+	for _, ns := range status.Info.RuntimeSpec.Linux.Namespaces {
+		if ns.Type == "network" && ns.Path != "" {
+			h, err := netns.GetFromPath(ns.Path)
+			return h, err == nil, err
+		}
+	}
+	if status.Info.Pid != 0 {
+		h, err := netns.GetFromPid(status.Info.Pid)
+		return h, err == nil, err
+	}
+	return netns.None(), false, fmt.Errorf("no network namespace in the status of pod %s", id)
+}
+
+func podNamespaceName(id string) string {
+	if len(id) > nameLimit {
+		return id[:nameLimit]
+	}
+	return id
+}
+
+// diff compares pods with the previous scan and returns the resulting events.
+func (c *cri) diff(pods []criPod) []Event {
+	c.Lock()
+	defer c.Unlock()
+	events := make([]Event, 0)
+	scan := make(map[string]bool)
+	for _, pod := range pods {
+		scan[pod.ID] = true
+		if _, ok := c.seen[pod.ID]; ok {
+			continue
+		}
+		h, ok, err := openPodNamespace(pod.ID)
+		if err != nil {
+			fmt.Println("ERROR: OPENING NS OF POD", pod.Metadata.Namespace+"/"+pod.Metadata.Name, err)
+			continue
+		}
+		c.seen[pod.ID] = ok
+		if !ok {
+			continue
+		}
+		events = append(events, Event{
+			Type:   NamespaceAppeared,
+			Name:   podNamespaceName(pod.ID),
+			Source: c.Name(),
+			Handle: h,
+			Metadata: map[string]string{
+				"pod":          pod.Metadata.Name,
+				"podNamespace": pod.Metadata.Namespace,
+				"podUID":       pod.Metadata.UID,
+				"podSandboxID": pod.ID,
+			},
+		})
+	}
+	for id, ok := range c.seen {
+		if scan[id] {
+			continue
+		}
+		delete(c.seen, id)
+		if ok {
+			events = append(events, Event{Type: NamespaceGone, Name: podNamespaceName(id), Source: c.Name()})
+		}
+	}
+	return events
+}
+
+// Retry forgets the pod sandbox of e, so that the next scan reports it again.
+func (c *cri) Retry(e Event) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.seen, e.Metadata["podSandboxID"])
+}
+
+func (c *cri) List() ([]Event, error) {
+	pods, err := listPods()
+	if err != nil {
+		return nil, err
+	}
+	return c.diff(pods), nil
+}
+
+// Watch lists the pod sandboxes every criScanInterval, since crictl has no
+// stream of sandbox events common to all runtimes.
+func (c *cri) Watch(events chan<- Event, errs chan<- error) {
+	for {
+		<-time.After(criScanInterval)
+		pods, err := listPods()
+		if err != nil {
+			errs <- err
+			continue
+		}
+		for _, e := range c.diff(pods) {
+			events <- e
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Package discovery finds the network namespaces openvnv should track. Each
+// source of namespaces (Docker, CRI, /var/run/netns, procfs) is a
+// Discoverer; the topology loop consumes their events without knowing where
+// they came from.
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netns"
+)
+
+type EventType int
+
+const (
+	NamespaceAppeared EventType = iota
+	NamespaceGone
+	NamespaceUpdated
+)
+
+var EventTypeStrings = []string{
+	"NamespaceAppeared",
+	"NamespaceGone",
+	"NamespaceUpdated",
+}
+
+func (e EventType) String() string {
+	for i, str := range EventTypeStrings {
+		if i == int(e) {
+			return str
+		}
+	}
+	return ""
+}
+
+// Event reports a change of a namespace seen by a Discoverer. Handle is only
+// set for NamespaceAppeared and is owned by the receiver. Inode and PIDs are
+// only known to discoverers that look at processes.
+type Event struct {
+	Type     EventType
+	Name     string
+	Source   string
+	Handle   netns.NsHandle
+	Inode    uint64
+	PIDs     []int
+	Metadata map[string]string
+}
+
+// Discoverer is a source of network namespaces.
+type Discoverer interface {
+	Name() string
+	// List returns a NamespaceAppeared event for every namespace present now.
+	List() ([]Event, error)
+	// Watch sends events for namespaces appearing and disappearing after
+	// List was called. It does not return unless watching fails for good.
+	Watch(events chan<- Event, errs chan<- error)
+}
+
+// Retrier is implemented by discoverers that report a namespace once. Retry
+// forgets e, a NamespaceAppeared event the receiver failed to act on, so
+// that the namespace is reported again.
+type Retrier interface {
+	Retry(e Event)
+}
+
+// Retry hands e back to the discoverer it came from, if it can report it
+// again.
+func Retry(ds []Discoverer, e Event) {
+	for _, d := range ds {
+		if r, ok := d.(Retrier); ok && d.Name() == e.Source {
+			r.Retry(e)
+		}
+	}
+}
+
+var providers = map[string]func() Discoverer{
+	"cri":    NewCRI,
+	"docker": NewDocker,
+	"netns":  NewNetnsDir,
+	"procfs": NewProcfs,
+}
+
+// Providers returns the names accepted by New.
+func Providers() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New returns the discoverers named in names, in that order.
+func New(names []string) ([]Discoverer, error) {
+	ds := make([]Discoverer, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p, ok := providers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown discovery provider %q, available: %s", name,
+				strings.Join(Providers(), ","))
+		}
+		ds = append(ds, p())
+	}
+	return ds, nil
+}
+
+// Watch starts watching with every discoverer and merges their events and
+// errors into a single stream each.
+func Watch(ds []Discoverer) (<-chan Event, <-chan error) {
+	events := make(chan Event)
+	errs := make(chan error)
+	for _, d := range ds {
+		go d.Watch(events, errs)
+	}
+	return events, errs
+}
@@ -0,0 +1,109 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/vishvananda/netns"
+)
+
+// nameLimit is the length of the container ID prefix used as namespace name.
+var nameLimit = 10
+
+type docker struct{}
+
+// NewDocker returns a Discoverer for the namespaces of running Docker
+// containers.
+func NewDocker() Discoverer {
+	return &docker{}
+}
+
+func (d *docker) Name() string {
+	return "docker"
+}
+
+func (d *docker) appeared(id string, metadata map[string]string) (Event, error) {
+	h, err := netns.GetFromDocker(id[:nameLimit])
+	if err != nil {
+		return Event{}, fmt.Errorf("getting netns of container %s: %v", id[:nameLimit], err)
+	}
+	metadata["containerID"] = id
+	return Event{
+		Type:     NamespaceAppeared,
+		Name:     id[:nameLimit],
+		Source:   d.Name(),
+		Handle:   h,
+		Metadata: metadata,
+	}, nil
+}
+
+func (d *docker) List() ([]Event, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	containerList, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(containerList))
+	for _, container := range containerList {
+		metadata := make(map[string]string)
+		if len(container.Names) > 0 {
+			metadata["container"] = strings.TrimPrefix(container.Names[0], "/")
+		}
+		metadata["image"] = container.Image
+		e, err := d.appeared(container.ID, metadata)
+		if err != nil {
+			fmt.Println("ERROR: DOCKER DISCOVERY", err)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (d *docker) Watch(events chan<- Event, errs chan<- error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		errs <- err
+		return
+	}
+	opt := types.EventsOptions{
+		Since: "",
+		Until: "",
+		Filters: filters.NewArgs(filters.KeyValuePair{Key: "event", Value: "start"},
+			filters.KeyValuePair{Key: "event", Value: "destroy"}),
+	}
+	updateMessage, errC := cli.Events(context.Background(), opt)
+	for {
+		select {
+		case u := <-updateMessage:
+			if u.Type != "container" {
+				continue
+			}
+			switch u.Action {
+			case "start":
+				metadata := map[string]string{
+					"container": u.Actor.Attributes["name"],
+					"image":     u.Actor.Attributes["image"],
+				}
+				e, err := d.appeared(u.ID, metadata)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				events <- e
+			case "destroy":
+				events <- Event{Type: NamespaceGone, Name: u.ID[:nameLimit], Source: d.Name()}
+			}
+		case err := <-errC:
+			errs <- err
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/vishvananda/netns"
+)
+
+// netnsDir is where `ip netns add` bind mounts named namespaces.
+const netnsDir = "/var/run/netns"
+
+const nsfsMagic = 0x6e736673
+
+// netnsMountTimeout bounds the wait between the creation of a file in
+// netnsDir and the namespace being mounted on it.
+const netnsMountTimeout = 5 * time.Second
+
+type netnsDirDiscoverer struct {
+	dir string
+	// fd is the inotify instance watching dir, set up by the first of List
+	// and Watch so that no namespace is added unseen between the two.
+	fd int
+	sync.Once
+	watchErr error
+}
+
+// NewNetnsDir returns a Discoverer for the named namespaces managed with
+// `ip netns`.
+func NewNetnsDir() Discoverer {
+	return &netnsDirDiscoverer{dir: netnsDir}
+}
+
+func (d *netnsDirDiscoverer) Name() string {
+	return "netns"
+}
+
+// isNetnsMounted reports whether path is an nsfs bind mount. `ip netns add`
+// creates the file before mounting the namespace on it, so the inotify
+// create event arrives before the namespace can be opened.
+func isNetnsMounted(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	return st.Type == nsfsMagic
+}
+
+// waitNetnsMounted waits up to netnsMountTimeout for path to be mounted. It
+// returns an error when it was not, unless path was removed meanwhile.
+func waitNetnsMounted(path string) (bool, error) {
+	for deadline := time.Now().Add(netnsMountTimeout); time.Now().Before(deadline); {
+		if isNetnsMounted(path) {
+			return true, nil
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("%s is not a mounted namespace after %v", path, netnsMountTimeout)
+}
+
+// watch sets up the inotify watch on the directory, once.
+func (d *netnsDirDiscoverer) watch() error {
+	d.Do(func() {
+		if d.watchErr = os.MkdirAll(d.dir, 0755); d.watchErr != nil {
+			return
+		}
+		d.fd, d.watchErr = syscall.InotifyInit1(syscall.IN_CLOEXEC)
+		if d.watchErr != nil {
+			return
+		}
+		_, d.watchErr = syscall.InotifyAddWatch(d.fd, d.dir, syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO)
+		if d.watchErr != nil {
+			syscall.Close(d.fd)
+		}
+	})
+	return d.watchErr
+}
+
+func (d *netnsDirDiscoverer) appeared(name string) (Event, error) {
+	path := filepath.Join(d.dir, name)
+	h, err := netns.GetFromPath(path)
+	if err != nil {
+		return Event{}, fmt.Errorf("opening %s: %v", path, err)
+	}
+	return Event{
+		Type:     NamespaceAppeared,
+		Name:     name,
+		Source:   d.Name(),
+		Handle:   h,
+		Metadata: map[string]string{"path": path},
+	}, nil
+}
+
+// List starts watching the directory before reading it, a namespace added
+// in between is then reported by both and deduplicated by the receiver.
+func (d *netnsDirDiscoverer) List() ([]Event, error) {
+	if err := d.watch(); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	events := make([]Event, 0, len(entries))
+	for _, entry := range entries {
+		if !isNetnsMounted(filepath.Join(d.dir, entry.Name())) {
+			continue
+		}
+		e, err := d.appeared(entry.Name())
+		if err != nil {
+			fmt.Println("ERROR: NETNS DISCOVERY", err)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// Watch watches the directory with inotify and reports namespaces added
+// with `ip netns add` and removed with `ip netns del`.
+func (d *netnsDirDiscoverer) Watch(events chan<- Event, errs chan<- error) {
+	if err := d.watch(); err != nil {
+		errs <- err
+		return
+	}
+	defer syscall.Close(d.fd)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.Read(d.fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			errs <- err
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			name := string(nameBytes[:clen(nameBytes)])
+			if name == "" {
+				continue
+			}
+			switch {
+			case event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+				mounted, err := waitNetnsMounted(filepath.Join(d.dir, name))
+				if err != nil {
+					errs <- err
+				}
+				if !mounted {
+					continue
+				}
+				e, err := d.appeared(name)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				events <- e
+			case event.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+				events <- Event{Type: NamespaceGone, Name: name, Source: d.Name()}
+			}
+		}
+	}
+}
+
+// clen returns the length of the NUL terminated string in b.
+func clen(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,160 @@
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alaypatel07/openvnv/devices"
+	"github.com/vishvananda/netns"
+)
+
+const procScanInterval = 5 * time.Second
+
+type procfs struct {
+	// seen holds the PIDs of every namespace reported so far, by inode.
+	seen map[uint64][]int
+	sync.Mutex
+}
+
+// NewProcfs returns a Discoverer that finds every network namespace with at
+// least one process in it by scanning /proc/*/ns/net. Namespaces are named
+// after their nsfs inode, so one reachable under several names is reported
+// once per name and deduplicated by the receiver.
+func NewProcfs() Discoverer {
+	return &procfs{seen: make(map[uint64][]int)}
+}
+
+func (p *procfs) Name() string {
+	return "procfs"
+}
+
+func procNamespaceName(inode uint64) string {
+	return "netns-" + strconv.FormatUint(inode, 10)
+}
+
+// scanProcNamespaces returns the PIDs of every process in /proc grouped by
+// the inode of their network namespace.
+func scanProcNamespaces() (map[uint64][]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	scan := make(map[uint64][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		link, err := os.Readlink("/proc/" + entry.Name() + "/ns/net")
+		if err != nil {
+			continue
+		}
+		var inode uint64
+		if _, err := fmt.Sscanf(link, "net:[%d]", &inode); err != nil {
+			continue
+		}
+		scan[inode] = append(scan[inode], pid)
+	}
+	return scan, nil
+}
+
+// openProcNamespace opens the namespace through the first of pids that is
+// still alive and still in it.
+func openProcNamespace(inode uint64, pids []int) (netns.NsHandle, error) {
+	err := fmt.Errorf("no process left in namespace %d", inode)
+	for _, pid := range pids {
+		var h netns.NsHandle
+		h, err = netns.GetFromPath("/proc/" + strconv.Itoa(pid) + "/ns/net")
+		if err != nil {
+			continue
+		}
+		var got uint64
+		if got, err = devices.NamespaceInode(h); err == nil && got == inode {
+			return h, nil
+		}
+		h.Close()
+	}
+	return netns.None(), err
+}
+
+// diff compares scan with the previous one and returns the resulting events.
+func (p *procfs) diff(scan map[uint64][]int) []Event {
+	p.Lock()
+	defer p.Unlock()
+	events := make([]Event, 0)
+	for inode, pids := range scan {
+		old, ok := p.seen[inode]
+		if !ok {
+			h, err := openProcNamespace(inode, pids)
+			if err != nil {
+				fmt.Println("ERROR: OPENING NS FROM /proc", err)
+				continue
+			}
+			events = append(events, Event{
+				Type:   NamespaceAppeared,
+				Name:   procNamespaceName(inode),
+				Source: p.Name(),
+				Handle: h,
+				Inode:  inode,
+				PIDs:   pids,
+			})
+		} else if !reflect.DeepEqual(old, pids) {
+			events = append(events, Event{
+				Type:   NamespaceUpdated,
+				Name:   procNamespaceName(inode),
+				Source: p.Name(),
+				Inode:  inode,
+				PIDs:   pids,
+			})
+		}
+		p.seen[inode] = pids
+	}
+	for inode := range p.seen {
+		if _, ok := scan[inode]; !ok {
+			delete(p.seen, inode)
+			events = append(events, Event{
+				Type:   NamespaceGone,
+				Name:   procNamespaceName(inode),
+				Source: p.Name(),
+				Inode:  inode,
+			})
+		}
+	}
+	return events
+}
+
+// Retry forgets the namespace of e, so that the next scan reports it again.
+func (p *procfs) Retry(e Event) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.seen, e.Inode)
+}
+
+func (p *procfs) List() ([]Event, error) {
+	scan, err := scanProcNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	return p.diff(scan), nil
+}
+
+// Watch rescans /proc every procScanInterval, since procfs offers no
+// notification when a process enters a new namespace.
+func (p *procfs) Watch(events chan<- Event, errs chan<- error) {
+	for {
+		<-time.After(procScanInterval)
+		scan, err := scanProcNamespaces()
+		if err != nil {
+			errs <- err
+			continue
+		}
+		for _, e := range p.diff(scan) {
+			events <- e
+		}
+	}
+}
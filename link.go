@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"sort"
 	"syscall"
 
 	"github.com/alaypatel07/openvnv/devices"
@@ -12,23 +13,53 @@ import (
 	"github.com/vishvananda/netns"
 )
 
-type byBridge []netlink.Link
-
-func (s byBridge) Len() int {
-	return len(s)
-}
-
-func (s byBridge) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
+// sortLinks orders links so that a device comes after its parent, for
+// stacked devices such as VLANs, and masters come before their ports at the
+// same depth, so that both find the other when they are created. The
+// kernel order is kept otherwise.
+func sortLinks(links []netlink.Link) {
+	byIndex := make(map[int]netlink.Link, len(links))
+	for _, l := range links {
+		byIndex[l.Attrs().Index] = l
+	}
+	depth := func(l netlink.Link) int {
+		// The parent of a link may be in another namespace, where the
+		// same index is another link. The order is then only a guess,
+		// which resolveLink makes up for. The bound stops on cycles.
+		d := 0
+		for ; d < len(links) && l.Attrs().ParentIndex != 0; d++ {
+			parent, ok := byIndex[l.Attrs().ParentIndex]
+			if !ok {
+				break
+			}
+			l = parent
+		}
+		return d
+	}
+	depths := make(map[int]int, len(links))
+	for _, l := range links {
+		depths[l.Attrs().Index] = depth(l)
+	}
+	sort.SliceStable(links, func(i, j int) bool {
+		di, dj := depths[links[i].Attrs().Index], depths[links[j].Attrs().Index]
+		if di != dj {
+			return di < dj
+		}
+		return isMaster(links[i]) && !isMaster(links[j])
+	})
 }
 
-func (s byBridge) Less(i, j int) bool {
-	return s[i].Type() == "bridge"
+func isMaster(l netlink.Link) bool {
+	switch l.Type() {
+	case "bridge", "bond", "team", "vrf":
+		return true
+	}
+	return false
 }
 
-func createNamespaceDeleteCallback() (func(namespace *devices.Namespace, event devices.NSEvent), *chan bool) {
+func createNamespaceDeleteCallback() (func(namespace *devices.Namespace, event devices.NSEvent, item interface{}), *chan bool) {
 	doneChannel := make(chan bool)
-	callback := func(namespace *devices.Namespace, event devices.NSEvent) {
+	callback := func(namespace *devices.Namespace, event devices.NSEvent, item interface{}) {
 		doneChannel <- true
 	}
 	return callback, &doneChannel
@@ -60,7 +91,7 @@ func listenOnLinkMessagesWithExisting(namespace *devices.Namespace, targetNS *ne
 	}
 	ldone := make(chan struct{})
 	if err := netlink.LinkSubscribeWithOptions(lu, ldone, options); err != nil {
-		fmt.Errorf("Link Subscribe error", err)
+		fmt.Println("ERROR: LINK SUBSCRIBE", err)
 	}
 
 	for {
@@ -78,6 +109,16 @@ func listenOnLinkMessagesWithExisting(namespace *devices.Namespace, targetNS *ne
 					update.Attrs().OperState == netlink.OperDown {
 					namespace.SetFlags(int(update.Attrs().Index), update.Attrs().Flags, update.Attrs().OperState)
 				}
+				if update.Change != 0xffffffff {
+					namespace.UpdateLinkInfo(&update)
+				}
+				// Port VLAN and STP state changes are only announced through AF_BRIDGE
+				// messages, bridge settings through messages of the bridge.
+				if update.Family == syscall.AF_BRIDGE && update.Attrs().MasterIndex != 0 {
+					namespace.UpdateBridgeState(int(update.Attrs().MasterIndex))
+				} else if update.Family == syscall.AF_BRIDGE || update.Type() == "bridge" {
+					namespace.UpdateBridgeState(int(update.Attrs().Index))
+				}
 			}
 			if update.Header.Type == syscall.RTM_DELLINK {
 				if update.Change == 0xffffffff {
@@ -8,14 +8,13 @@ import (
 	"io"
 	"net"
 	"os"
-	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alaypatel07/openvnv/devices"
-	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netns"
+	"github.com/alaypatel07/openvnv/discovery"
 )
 
 var namespace *devices.Namespace
@@ -25,13 +24,19 @@ var consoleDisplay *bool
 var dumpIP *string
 var encoder *json.Encoder
 
-func defaultL3Callback() func(device *devices.L3Device, event devices.L3DeviceEvent) {
+func defaultL3Callback() func(device *devices.L3Device, event devices.L3DeviceEvent, item interface{}) {
 	encoder = devices.GetEncoder()
-	return func(device *devices.L3Device, event devices.L3DeviceEvent) {
+	return func(device *devices.L3Device, event devices.L3DeviceEvent, item interface{}) {
 		t := make(map[string]interface{})
 		t["name"] = device.Index
 		t["namespace"] = device.Namespace
 		t["addresses"] = device.IP
+		t["allowedIPs"] = device.AllowedIPs
+		switch event {
+		case devices.L3DeviceNeighborAdd, devices.L3DeviceNeighborState, devices.L3DeviceNeighborDelete,
+			devices.L3DeviceGatewayFailed:
+			t["neighbor"] = item
+		}
 		t["connections"] = device.L2EventChannel().Master
 		t["indexName"] = "device1"
 		switch event {
@@ -46,7 +51,7 @@ func defaultL3Callback() func(device *devices.L3Device, event devices.L3DeviceEv
 	}
 }
 
-func defaultNSCallback() func(namespace *devices.Namespace, event devices.NSEvent) {
+func defaultNSCallback() func(namespace *devices.Namespace, event devices.NSEvent, item interface{}) {
 	encoder := devices.GetEncoder()
 
 	getKeys := func(name string, m map[string]string) []string {
@@ -57,34 +62,22 @@ func defaultNSCallback() func(namespace *devices.Namespace, event devices.NSEven
 		return keys
 	}
 
-	getRoutes := func(routes []netlink.Route) []map[string]string {
-		t := make([]map[string]string, len(routes))
-		for i, r := range routes {
-			m := make(map[string]string)
-			if r.Src != nil {
-				m["source"] = fmt.Sprintf("%s", r.Src)
-			}
-			if r.Dst != nil {
-				m["destination"] = fmt.Sprintf("%s", r.Dst)
-			}
-			if r.Gw != nil {
-				m["gateway"] = fmt.Sprintf("%s", r.Gw)
-			}
-			if r.NewDst != nil {
-				m["nexthop"] = fmt.Sprintf("Dst: %s", r.NewDst)
-			}
-			t[i] = m
-		}
-		return t
-	}
-
-	return func(namespace *devices.Namespace, change devices.NSEvent) {
+	return func(namespace *devices.Namespace, change devices.NSEvent, item interface{}) {
 		t := make(map[string]interface{})
 		t["name"] = namespace.Name
 		t["indexName"] = "namespace1"
 		t["connection"] = getKeys(namespace.Name, namespace.Connections)
-		t["route"] = getRoutes(namespace.Routes)
+		t["route"] = namespace.Routes
+		t["nsids"] = devices.NsidStrings(namespace.Nsids())
 		t["mode"] = namespace.Type
+		switch item := item.(type) {
+		case *devices.Route:
+			t["changedRoute"] = item
+		case *devices.Rule:
+			t["changedRule"] = item
+		case *devices.Nexthop:
+			t["changedNexthop"] = item
+		}
 		switch change {
 		case devices.NSCreate:
 			t["event"] = "create"
@@ -98,6 +91,8 @@ func defaultNSCallback() func(namespace *devices.Namespace, event devices.NSEven
 			t["event"] = "update"
 		case devices.NSRouteDelete:
 			t["event"] = "update"
+		case devices.NSRuleAdd, devices.NSRuleDelete, devices.NSNexthopAdd, devices.NSNexthopDelete:
+			t["event"] = "update"
 		}
 		encoder.Encode(t)
 	}
@@ -122,12 +117,180 @@ func defaultVethCallback() func(veth *devices.Veth, events devices.VethEvent) {
 	}
 }
 
+func defaultVlanCallback() func(vlan *devices.VlanDevice, events devices.VlanEvent) {
+	encoder := devices.GetEncoder()
+	return func(vlan *devices.VlanDevice, event devices.VlanEvent) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["name"] = vlan.Name
+		t["namespace"] = vlan.Namespace
+		t["index"] = vlan.Index
+		t["vlanId"] = vlan.VlanID
+		t["protocol"] = vlan.Protocol
+		t["parentIndex"] = vlan.ParentIndex
+		t["parentNamespace"] = vlan.ParentNamespace
+		encoder.Encode(t)
+	}
+}
+
+func defaultMacvlanCallback() func(macvlan *devices.Macvlan, events devices.MacvlanEvent) {
+	encoder := devices.GetEncoder()
+	return func(macvlan *devices.Macvlan, event devices.MacvlanEvent) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["name"] = macvlan.Name
+		t["namespace"] = macvlan.Namespace
+		t["index"] = macvlan.Index
+		t["kind"] = macvlan.Kind
+		t["mode"] = macvlan.Mode
+		t["parentIndex"] = macvlan.ParentIndex
+		t["parentNamespace"] = macvlan.ParentNamespace
+		encoder.Encode(t)
+	}
+}
+
+func defaultIpvlanCallback() func(ipvlan *devices.Ipvlan, events devices.IpvlanEvent) {
+	encoder := devices.GetEncoder()
+	return func(ipvlan *devices.Ipvlan, event devices.IpvlanEvent) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["name"] = ipvlan.Name
+		t["namespace"] = ipvlan.Namespace
+		t["index"] = ipvlan.Index
+		t["mode"] = ipvlan.Mode
+		t["flag"] = ipvlan.Flag
+		t["parentIndex"] = ipvlan.ParentIndex
+		t["parentNamespace"] = ipvlan.ParentNamespace
+		encoder.Encode(t)
+	}
+}
+
+func defaultTunnelCallback() func(tunnel *devices.Tunnel, events devices.TunnelEvent) {
+	encoder := devices.GetEncoder()
+	return func(tunnel *devices.Tunnel, event devices.TunnelEvent) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["name"] = tunnel.Name
+		t["namespace"] = tunnel.Namespace
+		t["index"] = tunnel.Index
+		t["kind"] = tunnel.Kind
+		t["vni"] = tunnel.VNI
+		t["local"] = tunnel.Local
+		t["remote"] = tunnel.Remote
+		t["port"] = tunnel.Port
+		t["underlayIndex"] = tunnel.ParentIndex
+		t["peer"] = tunnel.Peer
+		encoder.Encode(t)
+	}
+}
+
+func defaultWireGuardCallback() func(wg *devices.WireGuard, events devices.WireGuardEvent, item interface{}) {
+	encoder := devices.GetEncoder()
+	return func(wg *devices.WireGuard, event devices.WireGuardEvent, item interface{}) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["name"] = wg.Name
+		t["namespace"] = wg.Namespace
+		t["index"] = wg.Index
+		t["listenPort"] = wg.ListenPort
+		t["publicKey"] = wg.PublicKey
+		if item != nil {
+			t["peer"] = item
+		}
+		encoder.Encode(t)
+	}
+}
+
+func defaultTuntapCallback() func(tap *devices.Tuntap, events devices.TuntapEvent) {
+	encoder := devices.GetEncoder()
+	return func(tap *devices.Tuntap, event devices.TuntapEvent) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["name"] = tap.Name
+		t["namespace"] = tap.Namespace
+		t["index"] = tap.Index
+		t["mode"] = tap.Mode
+		t["pid"] = tap.PID
+		t["command"] = tap.Command
+		t["domain"] = tap.Domain
+		encoder.Encode(t)
+	}
+}
+
+func defaultVrfCallback() func(vrf *devices.Vrf, events devices.VrfEvent, item interface{}) {
+	encoder := devices.GetEncoder()
+	return func(vrf *devices.Vrf, event devices.VrfEvent, item interface{}) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["name"] = vrf.Name
+		t["namespace"] = vrf.Namespace
+		t["index"] = vrf.Index
+		t["table"] = vrf.Table
+		switch event {
+		case devices.VrfAddMember, devices.VrfRemoveMember:
+			t["member"] = item
+		case devices.VrfRouteAdd, devices.VrfRouteDelete:
+			t["route"] = item
+		}
+		encoder.Encode(t)
+	}
+}
+
+func defaultEdgeCallback() func(edge devices.Edge, event devices.EdgeEvent) {
+	encoder := devices.GetEncoder()
+	return func(edge devices.Edge, event devices.EdgeEvent) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["kind"] = edge.Kind
+		t["from"] = edge.From
+		t["to"] = edge.To
+		encoder.Encode(t)
+	}
+}
+
+// defaultSegmentCallback prints segment changes with the member joining or
+// leaving.
+func defaultSegmentCallback() func(segment *devices.Segment, event devices.SegmentEvent, item interface{}) {
+	encoder := devices.GetEncoder()
+	return func(segment *devices.Segment, event devices.SegmentEvent, item interface{}) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["id"] = segment.ID
+		t["members"] = segment.Members
+		if event == devices.SegmentJoin || event == devices.SegmentLeave {
+			t["member"] = item
+		}
+		encoder.Encode(t)
+	}
+}
+
+// defaultReachabilityCallback prints pairs of namespaces gaining or losing
+// their path, with where it breaks.
+func defaultReachabilityCallback() func(r *devices.Reachability, event devices.ReachabilityEvent) {
+	encoder := devices.GetEncoder()
+	return func(r *devices.Reachability, event devices.ReachabilityEvent) {
+		t := make(map[string]interface{})
+		t["event"] = event.String()
+		t["reachability"] = r
+		encoder.Encode(t)
+	}
+}
+
 func main() {
 	fmt.Println("Hello OpenVNV")
-	go registerWS(":8080")
 	consoleDisplay = flag.Bool("events", false, "Use -events to display events on console")
 	dumpIP = flag.String("ip", "empty", "Use -ip=<ip>:<port> to send events to remote tcp connection")
+	wsAddr := flag.String("ws", ":8080", "Use -ws=<ip>:<port> to serve events over websocket on /ws")
+	providers := flag.String("discovery", "docker,netns,procfs",
+		"Use -discovery=<p1>,<p2> to pick namespace discovery providers among "+strings.Join(discovery.Providers(), ","))
 	flag.Parse()
+	discoverers, err := discovery.New(strings.Split(*providers, ","))
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+	subscribeWSEvents()
+	go registerWS(*wsAddr)
 	var sock io.Writer
 	if *dumpIP != "empty" {
 		var err error
@@ -146,119 +309,45 @@ func main() {
 		n := defaultNSCallback()
 		v := defaultVethCallback()
 		d := defaultL3Callback()
-		nws := defaultNSWSCallback()
 		devices.SubscribeAllNamespaceEvents(n)
 		devices.SubscribeAllVethEvents(v)
+		devices.SubscribeAllVlanEvents(defaultVlanCallback())
+		devices.SubscribeAllMacvlanEvents(defaultMacvlanCallback())
+		devices.SubscribeAllIpvlanEvents(defaultIpvlanCallback())
+		devices.SubscribeAllTunnelEvents(defaultTunnelCallback())
+		devices.SubscribeAllTuntapEvents(defaultTuntapCallback())
+		devices.SubscribeAllVrfEvents(defaultVrfCallback())
+		devices.SubscribeAllWireGuardEvents(defaultWireGuardCallback())
+		devices.SubscribeAllEdgeEvents(defaultEdgeCallback())
+		devices.SubscribeAllSegmentEvents(defaultSegmentCallback())
+		devices.SubscribeAllReachabilityEvents(defaultReachabilityCallback())
 		devices.SubscribeAllL3DeviceEvents(d)
-		devices.SubscribeAllNamespaceEvents(nws)
 	}
-	createExistingNamespaces(*consoleDisplay)
-	go netnsTopoligy()
+	createExistingNamespaces(discoverers, *consoleDisplay)
+	go netnsTopoligy(discoverers)
 	dumpTopology()
 }
-func defaultNSWSCallback() func(namespace *devices.Namespace, event devices.NSEvent) {
-	getKeys := func(m map[string]string) []string {
-		keys := make([]string, 0, len(m))
-		for k := range m {
-			z := strings.Split(k, ":")
-			keys = append(keys, z[0])
-		}
-		return keys
-	}
-	getRoutes := func(routes []netlink.Route) []map[string]string {
-		t := make([]map[string]string, len(routes))
-		for i, r := range routes {
-			m := make(map[string]string)
-			if r.Src != nil {
-				m["source"] = fmt.Sprintf("%s", r.Src)
-			}
-			if r.Dst != nil {
-				m["destination"] = fmt.Sprintf("%s", r.Dst)
-			}
-			if r.Gw != nil {
-				m["gateway"] = fmt.Sprintf("%s", r.Gw)
-			}
-			if r.NewDst != nil {
-				m["nexthop"] = fmt.Sprintf("Dst: %s", r.NewDst)
-			}
-			t[i] = m
-		}
-		return t
-	}
-
-	callback := func(namespace *devices.Namespace, event devices.NSEvent) {
-		//fmt.Println("NSWS Called", event, namespace.Routes, namespace.Connections)
-		temp := make(map[string]interface{})
-		temp["name"] = namespace.Name
-		temp["peer"] = getKeys(namespace.Connections)
-		temp["route"] = getRoutes(namespace.Routes)
-		temp["mode"] = namespace.Type
-		e := WsEvents{
-			DeviceType: "namespace",
-			EventData:  temp,
-			EventType:  event.String(),
-		}
-		chans := GetChannels()
-
-		for _, value := range *chans {
-			//fmt.Println("Sending to", s)
-			*value <- e
-		}
-	}
-	return callback
-}
 
-func netnsTopoligy() {
-	var netnsCreateChannel = make(chan string)
-	var netnsDestroyChannel = make(chan string)
-	var errChan = make(chan error)
-	go SubscribeDockerNetnsUpdate(&netnsCreateChannel, &netnsDestroyChannel, errChan)
+func netnsTopoligy(discoverers []discovery.Discoverer) {
+	events, errs := discovery.Watch(discoverers)
 	for {
 		select {
-		case u := <-netnsCreateChannel:
-			fmt.Println("GOT:", u)
-			processNewNamespace(u, *consoleDisplay)
-		case u := <-netnsDestroyChannel:
-			topology.DeleteNamespace(u)
-		case err := <-errChan:
-			fmt.Println("ERROR: SUBSCRIBEDOCKERUPDATE", err)
+		case e := <-events:
+			fmt.Println("GOT:", e.Type, e.Name, "FROM", e.Source)
+			processDiscoveryEvent(discoverers, e, *consoleDisplay)
+		case err := <-errs:
+			fmt.Println("ERROR: NAMESPACE DISCOVERY", err)
 		}
 	}
 }
 
-func processNewNamespace(name string, consoleDisplay bool) {
-	targetNS, err := netns.GetFromDocker(name)
-	if err != nil {
-		fmt.Println("ERROR: GETTING DOCKER NS: ", err, namespace)
-		return
-	}
-	runtime.LockOSThread()
-
-	defaultNS, err := netns.Get()
-	if err != nil {
-		fmt.Println("ERROR: GETTING CURRENT NS: ", err, namespace)
-		return
-	}
-
-	err = netns.Set(targetNS)
-	t := topology.CreateNamespace(name, &targetNS)
-	if err != nil {
-		fmt.Println("ERROR: SETTING GOROUTINE TO DOCKER NS: ", err, namespace)
-		return
-	}
-	createDevices(t, consoleDisplay)
-	err = netns.Set(defaultNS)
-	if err != nil {
-		fmt.Println("ERROR: SETTING GOROUTINE TO DEFAULT NS: ", err, namespace)
-		return
-	}
-
-	runtime.UnlockOSThread()
-	go listenOnLinkMessagesWithExisting(t, &targetNS, consoleDisplay)
-}
-
 func dumpTopology() {
-	commands := "Enter:\nIndex Number to look for device state or\n'*' to look for all devices\n'bye' to exit\n'help' to print this message again"
+	commands := "Enter:\nIndex Number to look for device state or\n'*' to look for all devices\n" +
+		"'mac <address>' to find the bridge ports a MAC address was learned on\n" +
+		"'segments' to list the broadcast domains\n'segment <namespace>:<index>' to show the broadcast domain of a device\n" +
+		"'trace <namespace>[:<device>] <ip>' to follow a packet hop by hop through the topology\n" +
+		"'reach' to show which namespaces reach each other\n" +
+		"'bye' to exit\n'help' to print this message again"
 	fmt.Println(commands)
 	reader := bufio.NewReader(os.Stdin)
 	for {
@@ -269,19 +358,92 @@ func dumpTopology() {
 			os.Exit(1)
 		}
 		if text == "bye" {
-			for ns, _ := range topology.Namespaces {
+			for ns, _ := range topology.GetNamespaces() {
 				time.After(5 * time.Second)
 				topology.DeleteNamespace(ns)
 			}
 			os.Exit(0)
 		} else if text == "*" {
-			for ns, n := range topology.Namespaces {
+			for ns, n := range topology.GetNamespaces() {
 				fmt.Println("\nConnections for namespace", ns)
 				fmt.Println(n.Connections)
+				fmt.Println("\nRules for namespace", ns)
+				for _, r := range n.Rules {
+					fmt.Println("  ", r)
+				}
+				fmt.Println("\nNexthops for namespace", ns)
+				nhids := make([]int, 0, len(n.Nexthops))
+				for id := range n.Nexthops {
+					nhids = append(nhids, id)
+				}
+				sort.Ints(nhids)
+				for _, id := range nhids {
+					fmt.Println("  ", n.Nexthops[id])
+				}
 				fmt.Println("\nRoutes for namespace", ns)
-				fmt.Println(n.Routes)
+				tables := n.RouteTables()
+				ids := make([]int, 0, len(tables))
+				for table := range tables {
+					ids = append(ids, table)
+				}
+				sort.Ints(ids)
+				for _, table := range ids {
+					fmt.Println("table", devices.TableName(table))
+					for _, r := range n.TableRules(table) {
+						fmt.Println("  selected by", r)
+					}
+					for _, r := range tables[table] {
+						fmt.Println("  ", r)
+					}
+				}
+				fmt.Println("\nNsids for namespace", ns)
+				fmt.Println(devices.NsidStrings(n.Nsids()))
 				n.DumpAll()
 			}
+			fmt.Println("\nEdges")
+			for _, e := range topology.Edges() {
+				fmt.Println(e.Kind, e.From, "->", e.To)
+			}
+		} else if text == "segments" {
+			for _, s := range topology.Segments() {
+				fmt.Println(s.ID, s.Members)
+			}
+		} else if strings.HasPrefix(text, "segment ") {
+			node := strings.TrimSpace(strings.TrimPrefix(text, "segment "))
+			if s := topology.SegmentOf(node); s != nil {
+				fmt.Println(s.ID, s.Members)
+			} else {
+				fmt.Println("no segment for", node)
+			}
+		} else if strings.HasPrefix(text, "mac ") {
+			mac := strings.TrimSpace(strings.TrimPrefix(text, "mac "))
+			for _, l := range topology.LocateMAC(mac) {
+				fmt.Printf("%s bridge %d port %d (%s) vlan %d %s\n",
+					l.Namespace, l.Bridge, l.Entry.Port, l.PortName, l.Entry.Vlan, l.Entry.State)
+			}
+		} else if text == "reach" {
+			for _, r := range topology.ReachabilityMatrix() {
+				switch {
+				case r.L3:
+					fmt.Println(r.From, "->", r.To, "l3")
+				case r.L2:
+					fmt.Println(r.From, "->", r.To, "l2 only, l3:", r.Cause, r.BreakAt)
+				default:
+					fmt.Println(r.From, "->", r.To, "unreachable:", r.Cause, r.BreakAt, r.Reason)
+				}
+			}
+		} else if strings.HasPrefix(text, "trace ") {
+			args := strings.Fields(strings.TrimPrefix(text, "trace "))
+			if len(args) != 2 || net.ParseIP(args[1]) == nil {
+				fmt.Println("usage: trace <namespace>[:<device>] <ip>")
+				continue
+			}
+			tr, err := topology.Trace(args[0], net.ParseIP(args[1]))
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				continue
+			}
+			fmt.Println(tr)
 		} else if text == "help" {
 			fmt.Println("\n\n", commands)
 		} else {
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/alaypatel07/openvnv/devices"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func listenOnMdbMessages(namespace *devices.Namespace, targetNs *netns.NsHandle) {
+	refresh := func() {
+		if err := namespace.RefreshMdb(); err != nil {
+			fmt.Println("ERROR: DUMPING MDB IN NS", namespace.Name, err)
+		}
+	}
+	receiveAt(namespace, targetNs, "MDB", refresh, func(m syscall.NetlinkMessage) {
+		if m.Header.Type != unix.RTM_NEWMDB && m.Header.Type != unix.RTM_DELMDB {
+			return
+		}
+		entries, err := devices.ParseMdb(m.Data)
+		if err != nil {
+			fmt.Println("ERROR: PARSING MDB MESSAGE IN NS", namespace.Name, err)
+			return
+		}
+		namespace.UpdateMdb(entries, m.Header.Type == unix.RTM_NEWMDB)
+	}, unix.RTNLGRP_MDB)
+}
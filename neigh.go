@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/alaypatel07/openvnv/devices"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// subscribeNeighs subscribes to the neighbours and FDB entries of
+// targetNs, those already present included.
+func subscribeNeighs(namespace *devices.Namespace, targetNs *netns.NsHandle) (chan netlink.NeighUpdate, chan struct{}, error) {
+	nu := make(chan netlink.NeighUpdate)
+	done := make(chan struct{})
+	options := netlink.NeighSubscribeOptions{
+		Namespace: targetNs,
+		ErrorCallback: func(e error) {
+			fmt.Println("ERROR: RECEIVING NEIGHS IN NS", namespace.Name, e)
+		},
+		ListExisting: true,
+	}
+	if err := netlink.NeighSubscribeWithOptions(nu, done, options); err != nil {
+		return nil, nil, err
+	}
+	return nu, done, nil
+}
+
+func listenOnNeighMessages(namespace *devices.Namespace, targetNs *netns.NsHandle) {
+
+	nu, done, err := subscribeNeighs(namespace, targetNs)
+	if err != nil {
+		fmt.Println("ERROR: NEIGH SUBSCRIBE IN NS", namespace.Name, err)
+		return
+	}
+
+	callback, doneChannel := createNamespaceDeleteCallback()
+	namespace.OnChange(devices.NSDelete, callback)
+	deleted := make(chan struct{})
+	go func() {
+		for u := range *doneChannel {
+			if u {
+				close(deleted)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case update, ok := <-nu:
+			if !ok {
+				// netlink closes nu on any receive error after reporting
+				// it. Subscribing again dumps the entries afresh.
+				close(done)
+				if nu, done, err = subscribeNeighs(namespace, targetNs); err != nil {
+					fmt.Println("ERROR: NEIGH SUBSCRIBE IN NS", namespace.Name, err)
+					return
+				}
+				continue
+			}
+			add := update.Type == syscall.RTM_NEWNEIGH
+			switch update.Family {
+			case syscall.AF_BRIDGE:
+				namespace.UpdateFdb(update.Neigh, add)
+			case syscall.AF_INET, syscall.AF_INET6:
+				namespace.UpdateNeighbor(update.Neigh, add)
+			}
+		case <-deleted:
+			close(done)
+			return
+		}
+	}
+}
@@ -1,21 +1,16 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"runtime"
-	"sort"
+	"syscall"
 
 	"github.com/alaypatel07/openvnv/devices"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
+	"github.com/alaypatel07/openvnv/discovery"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
 
-var nameLimit = 10
-
 func createDevices(namespace *devices.Namespace, consoleDisplay bool) {
 	if consoleDisplay {
 		fmt.Println("Processing devices in namespace, ", namespace.Name)
@@ -25,7 +20,7 @@ func createDevices(namespace *devices.Namespace, consoleDisplay bool) {
 		fmt.Println("ERROR: GETTING DEVICES IN DOCKER NS: ", err, namespace)
 		return
 	}
-	sort.Sort(byBridge(links))
+	sortLinks(links)
 
 	for _, link := range links {
 		namespace.AddL2Device(link, consoleDisplay)
@@ -35,7 +30,8 @@ func createDevices(namespace *devices.Namespace, consoleDisplay bool) {
 		}
 		namespace.AddL3Device(link.Attrs().Index, addrs, consoleDisplay)
 	}
-	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: syscall.RT_TABLE_UNSPEC},
+		netlink.RT_FILTER_TABLE)
 	if err != nil {
 		fmt.Println("ERROR GETTING ROUTES IN NS", namespace.Name, err)
 	}
@@ -47,14 +43,55 @@ func createDevices(namespace *devices.Namespace, consoleDisplay bool) {
 	}
 }
 
-func createExistingNamespaces(consoleDisplay bool) {
+// startNamespace adds targetNS to the topology under name, creates the
+// devices already present in it and starts its link, address and route
+// listeners. A namespace that is already tracked under another name only
+// gets name recorded as an alias.
+func startNamespace(name string, targetNS netns.NsHandle, consoleDisplay bool) *devices.Namespace {
+	if inode, err := devices.NamespaceInode(targetNS); err == nil {
+		if n := topology.GetByInode(inode); n != nil {
+			topology.AddAlias(name, n)
+			targetNS.Close()
+			return n
+		}
+	}
 
-	ctx := context.Background()
-	cli, err := client.NewEnvClient()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	defaultNS, err := netns.Get()
 	if err != nil {
-		return
+		fmt.Println("ERROR: GETTING CURRENT NS: ", err, name)
+		return nil
+	}
+	defer defaultNS.Close()
+
+	err = netns.Set(targetNS)
+	if err != nil {
+		fmt.Println("ERROR: SETTING GOROUTINE TO NS: ", err, name)
+		return nil
+	}
+	t := topology.CreateNamespace(name, &targetNS)
+	createDevices(t, consoleDisplay)
+	err = netns.Set(defaultNS)
+	if err != nil {
+		fmt.Println("ERROR: SETTING GOROUTINE TO DEFAULT NS: ", err, name)
+		return nil
 	}
 
+	go listenOnLinkMessagesWithExisting(t, &targetNS, consoleDisplay)
+	go listenOnAddressMessages(t, &targetNS)
+	go listenOnRouteMessages(t, &targetNS)
+	go listenOnNsidMessages(t, &targetNS)
+	go listenOnNeighMessages(t, &targetNS)
+	go listenOnMdbMessages(t, &targetNS)
+	go listenOnRuleMessages(t, &targetNS)
+	go listenOnNexthopMessages(t, &targetNS)
+	return t
+}
+
+func createExistingNamespaces(discoverers []discovery.Discoverer, consoleDisplay bool) {
+
 	namespace = topology.GetDefaultNamespace()
 
 	createDevices(namespace, consoleDisplay)
@@ -62,73 +99,45 @@ func createExistingNamespaces(consoleDisplay bool) {
 	go listenOnLinkMessagesWithExisting(namespace, nil, consoleDisplay)
 	go listenOnAddressMessages(namespace, nil)
 	go listenOnRouteMessages(namespace, nil)
-
-	containerList, err := cli.ContainerList(ctx, types.ContainerListOptions{})
-	if err != nil {
-		fmt.Println("ERROR: GETTING CONTAINER LIST", err)
-		return
-	}
-
-	for _, container := range containerList {
-		runtime.LockOSThread()
-
-		defaultNS, err := netns.Get()
+	go listenOnNsidMessages(namespace, nil)
+	go listenOnNeighMessages(namespace, nil)
+	go listenOnMdbMessages(namespace, nil)
+	go listenOnRuleMessages(namespace, nil)
+	go listenOnNexthopMessages(namespace, nil)
+
+	for _, d := range discoverers {
+		events, err := d.List()
 		if err != nil {
-			fmt.Println("ERROR: GETTING CURRENT NS: ", err, namespace)
-			return
-		}
-
-		targetNS, err := netns.GetFromDocker(container.ID[:nameLimit])
-		if err != nil {
-			fmt.Println("ERROR: GETTING DOCKER NS: ", err, namespace)
-			return
+			fmt.Println("ERROR: LISTING NAMESPACES FROM", d.Name(), err)
+			continue
 		}
-		err = netns.Set(targetNS)
-		if err != nil {
-			fmt.Println("ERROR: SETTING GOROUTINE TO DOCKER NS: ", err, namespace)
-			return
-		}
-		t := topology.CreateNamespace(container.ID[:nameLimit], &targetNS)
-		createDevices(t, consoleDisplay)
-		err = netns.Set(defaultNS)
-		if err != nil {
-			fmt.Println("ERROR: SETTING GOROUTINE TO DEFAULT NS: ", err, namespace)
-			return
+		for _, e := range events {
+			processDiscoveryEvent(discoverers, e, consoleDisplay)
 		}
-
-		runtime.UnlockOSThread()
-		go listenOnLinkMessagesWithExisting(t, &targetNS, consoleDisplay)
-		go listenOnAddressMessages(t, &targetNS)
-		go listenOnRouteMessages(t, &targetNS)
 	}
-
 }
 
-func SubscribeDockerNetnsUpdate(createUpdate *chan string, destroyUpdate *chan string, errChan chan error) {
-	ctx := context.Background()
-	cli, err := client.NewEnvClient()
-	if err != nil {
-		errChan <- err
-		return
-	}
-	opt := types.EventsOptions{
-		Since: "",
-		Until: "",
-		Filters: filters.NewArgs(filters.KeyValuePair{Key: "event", Value: "start"},
-			filters.KeyValuePair{Key: "event", Value: "destroy"}),
-	}
-	updateMessage, errC := cli.Events(ctx, opt)
-	for {
-		select {
-		case u := <-updateMessage:
-			if u.Type == "container" && u.Action == "start" {
-				*createUpdate <- u.ID[:nameLimit]
-			}
-			if u.Type == "container" && u.Action == "destroy" {
-				*destroyUpdate <- u.ID[:nameLimit]
-			}
-		case err := <-errC:
-			errChan <- err
+// processDiscoveryEvent applies a namespace change reported by one of the
+// discovery providers to the topology. A namespace that could not be
+// started is handed back to its provider to be reported again.
+func processDiscoveryEvent(discoverers []discovery.Discoverer, e discovery.Event, consoleDisplay bool) {
+	switch e.Type {
+	case discovery.NamespaceAppeared:
+		n := startNamespace(e.Name, e.Handle, consoleDisplay)
+		if n == nil {
+			discovery.Retry(discoverers, e)
+			return
+		}
+		n.AddMetadata(e.Source, e.Metadata)
+		if e.Inode != 0 {
+			topology.SetPIDs(e.Inode, e.PIDs)
+		}
+	case discovery.NamespaceUpdated:
+		topology.SetPIDs(e.Inode, e.PIDs)
+	case discovery.NamespaceGone:
+		if e.Inode != 0 {
+			topology.SetPIDs(e.Inode, nil)
 		}
+		topology.DeleteNamespace(e.Name)
 	}
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/alaypatel07/openvnv/devices"
+	"github.com/vishvananda/netns"
+)
+
+func listenOnNexthopMessages(namespace *devices.Namespace, targetNs *netns.NsHandle) {
+	refresh := func() {
+		if err := namespace.RefreshNexthops(); err != nil {
+			fmt.Println("ERROR: DUMPING NEXTHOPS IN NS", namespace.Name, err)
+		}
+	}
+	receiveAt(namespace, targetNs, "NEXTHOP", refresh, func(m syscall.NetlinkMessage) {
+		if m.Header.Type != devices.RtmNewNexthop && m.Header.Type != devices.RtmDelNexthop {
+			return
+		}
+		nh, err := devices.ParseNexthop(m.Data)
+		if err != nil {
+			fmt.Println("ERROR: PARSING NEXTHOP MESSAGE IN NS", namespace.Name, err)
+			return
+		}
+		if m.Header.Type == devices.RtmNewNexthop {
+			namespace.AddNexthop(nh)
+		} else {
+			namespace.DeleteNexthop(nh)
+		}
+	}, devices.RtnlGroupNexthop)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/alaypatel07/openvnv/devices"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// rtnlGroupNsid is RTNLGRP_NSID, the multicast group of RTM_NEWNSID and
+// RTM_DELNSID notifications.
+const rtnlGroupNsid = 0x1c
+
+// subscribeAt opens a NETLINK_ROUTE socket inside targetNs, or the current
+// namespace when targetNs is nil, joined to groups.
+func subscribeAt(targetNs *netns.NsHandle, groups ...uint) (*nl.NetlinkSocket, error) {
+	if targetNs == nil {
+		return nl.Subscribe(unix.NETLINK_ROUTE, groups...)
+	}
+	curNs, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer curNs.Close()
+	return nl.SubscribeAt(*targetNs, curNs, unix.NETLINK_ROUTE, groups...)
+}
+
+// receiveAt hands the messages of groups inside targetNs to handle until
+// namespace is deleted. refresh dumps the state the messages update, first
+// and again after the socket failed: netlink drops messages when the socket
+// runs out of buffer space, ENOBUFS, and a dump is the only way to make up
+// for them.
+func receiveAt(namespace *devices.Namespace, targetNs *netns.NsHandle, kind string, refresh func(),
+	handle func(syscall.NetlinkMessage), groups ...uint) {
+	s, err := subscribeAt(targetNs, groups...)
+	if err != nil {
+		fmt.Println("ERROR:", kind, "SUBSCRIBE IN NS", namespace.Name, err)
+		return
+	}
+	// NSDelete is fired from the goroutine deleting the namespace, which
+	// must not wait for this listener. Closing the socket ends Receive.
+	var lock sync.Mutex
+	deleted := false
+	callback, doneChannel := createNamespaceDeleteCallback()
+	namespace.OnChange(devices.NSDelete, callback)
+	go func() {
+		for u := range *doneChannel {
+			if u {
+				lock.Lock()
+				deleted = true
+				s.Close()
+				lock.Unlock()
+				return
+			}
+		}
+	}()
+
+	refresh()
+	for {
+		msgs, _, err := s.Receive()
+		if err != nil {
+			lock.Lock()
+			if deleted {
+				lock.Unlock()
+				return
+			}
+			fmt.Println("ERROR: RECEIVING", kind, "MESSAGES IN NS", namespace.Name, err)
+			s.Close()
+			s, err = subscribeAt(targetNs, groups...)
+			lock.Unlock()
+			if err != nil {
+				fmt.Println("ERROR:", kind, "SUBSCRIBE IN NS", namespace.Name, err)
+				return
+			}
+			refresh()
+			continue
+		}
+		for _, m := range msgs {
+			handle(m)
+		}
+	}
+}
+
+func listenOnNsidMessages(namespace *devices.Namespace, targetNs *netns.NsHandle) {
+	// An nsid assigned while messages were lost may place links as well.
+	refresh := func() {
+		topology.NsidAdded(namespace)
+	}
+	receiveAt(namespace, targetNs, "NSID", refresh, func(m syscall.NetlinkMessage) {
+		switch m.Header.Type {
+		case unix.RTM_NEWNSID:
+			topology.NsidAdded(namespace)
+		case unix.RTM_DELNSID:
+			if id, ok := devices.ParseNsid(m.Data); ok {
+				topology.NsidDeleted(namespace, id)
+			}
+		}
+	}, rtnlGroupNsid)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/alaypatel07/openvnv/devices"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func subscribeRoutes(namespace *devices.Namespace, targetNs *netns.NsHandle) (chan netlink.RouteUpdate, chan struct{}, error) {
+	ru := make(chan netlink.RouteUpdate)
+	done := make(chan struct{})
+	options := netlink.RouteSubscribeOptions{
+		Namespace: targetNs,
+		ErrorCallback: func(e error) {
+			fmt.Println("ERROR: RECEIVING ROUTES IN NS", namespace.Name, e)
+		},
+		ListExisting: false,
+	}
+	if err := netlink.RouteSubscribeWithOptions(ru, done, options); err != nil {
+		return nil, nil, err
+	}
+	return ru, done, nil
+}
+
+func listenOnRouteMessages(namespace *devices.Namespace, targetNs *netns.NsHandle) {
+
+	ru, done, err := subscribeRoutes(namespace, targetNs)
+	if err != nil {
+		fmt.Println("ERROR: ROUTE SUBSCRIBE IN NS", namespace.Name, err)
+		return
+	}
+
+	// NSDelete is fired from the goroutine deleting the namespace, which
+	// must not wait for this listener.
+	callback, doneChannel := createNamespaceDeleteCallback()
+	namespace.OnChange(devices.NSDelete, callback)
+	deleted := make(chan struct{})
+	go func() {
+		for u := range *doneChannel {
+			if u {
+				close(deleted)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case update, ok := <-ru:
+			if !ok {
+				// netlink closes ru on any receive error, ENOBUFS included,
+				// after reporting it. The updates lost are made up for by
+				// subscribing again and dumping the routes.
+				close(done)
+				if ru, done, err = subscribeRoutes(namespace, targetNs); err != nil {
+					fmt.Println("ERROR: ROUTE SUBSCRIBE IN NS", namespace.Name, err)
+					return
+				}
+				if err := namespace.RefreshRoutes(); err != nil {
+					fmt.Println("ERROR: DUMPING ROUTES IN NS", namespace.Name, err)
+				}
+				continue
+			}
+			switch update.Type {
+			case syscall.RTM_NEWROUTE:
+				namespace.AddRoute(update.Route)
+			case syscall.RTM_DELROUTE:
+				namespace.DeleteRoute(update.Route)
+			}
+		case <-namespace.GatewayChanges():
+			namespace.ResolveGateways()
+		case <-deleted:
+			close(done)
+			return
+		}
+	}
+}
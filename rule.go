@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/alaypatel07/openvnv/devices"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func listenOnRuleMessages(namespace *devices.Namespace, targetNs *netns.NsHandle) {
+	refresh := func() {
+		if err := namespace.RefreshRules(); err != nil {
+			fmt.Println("ERROR: DUMPING RULES IN NS", namespace.Name, err)
+		}
+	}
+	receiveAt(namespace, targetNs, "RULE", refresh, func(m syscall.NetlinkMessage) {
+		if m.Header.Type != unix.RTM_NEWRULE && m.Header.Type != unix.RTM_DELRULE {
+			return
+		}
+		r, err := devices.ParseRule(m.Data)
+		if err != nil {
+			fmt.Println("ERROR: PARSING RULE MESSAGE IN NS", namespace.Name, err)
+			return
+		}
+		if m.Header.Type == unix.RTM_NEWRULE {
+			namespace.AddRule(r)
+		} else {
+			namespace.DeleteRule(r)
+		}
+	}, unix.RTNLGRP_IPV4_RULE, unix.RTNLGRP_IPV6_RULE)
+}
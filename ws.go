@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alaypatel07/openvnv/devices"
+	"github.com/gorilla/websocket"
+)
+
+// wsClientBuffer is the number of events queued for a client before it is
+// considered too slow and dropped.
+const wsClientBuffer = 256
+
+const wsWriteTimeout = 5 * time.Second
+
+type WsEvents struct {
+	DeviceType string      `json:"deviceType"`
+	EventType  string      `json:"eventType"`
+	Namespace  string      `json:"namespace"`
+	EventData  interface{} `json:"eventData"`
+	// Item is what the event is about within EventData, such as the FDB
+	// entry of a bridge event or the peer of a WireGuard event.
+	Item interface{} `json:"item,omitempty"`
+}
+
+// wsRequest is sent by clients to change their subscription. Entries of
+// Namespaces are namespace names, entries of Events are either a device type
+// ("namespace", "l2device", "bridge", "bond", "veth", "vlan", "macvlan",
+// "ipvlan", "tunnel", "tuntap", "wireguard", "vrf", "edge", "segment",
+// "reachability", "l3device") or an event name such as "NSRouteAdd".
+type wsRequest struct {
+	Action     string   `json:"action"`
+	Namespaces []string `json:"namespaces"`
+	Events     []string `json:"events"`
+}
+
+type wsSubscription struct {
+	Namespaces        []string `json:"namespaces"`
+	Events            []string `json:"events"`
+	ExcludeNamespaces []string `json:"excludeNamespaces"`
+	ExcludeEvents     []string `json:"excludeEvents"`
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	// events are encoded when published, see encodeWS.
+	events            chan []byte
+	namespaces        map[string]bool
+	types             map[string]bool
+	excludeNamespaces map[string]bool
+	excludeTypes      map[string]bool
+}
+
+func newWsClient(conn *websocket.Conn) *wsClient {
+	return &wsClient{
+		conn:              conn,
+		events:            make(chan []byte, wsClientBuffer),
+		namespaces:        make(map[string]bool),
+		types:             make(map[string]bool),
+		excludeNamespaces: make(map[string]bool),
+		excludeTypes:      make(map[string]bool),
+	}
+}
+
+// wants reports whether e passes the client's filters. Empty include sets
+// mean every namespace or event type. Events spanning namespaces have no
+// namespace and only go through the event type filters.
+func (c *wsClient) wants(e WsEvents) bool {
+	if e.DeviceType == "topology" {
+		return true
+	}
+	if c.excludeNamespaces[e.Namespace] || c.excludeTypes[e.DeviceType] || c.excludeTypes[e.EventType] {
+		return false
+	}
+	if e.Namespace != "" && len(c.namespaces) != 0 && !c.namespaces[e.Namespace] {
+		return false
+	}
+	if len(c.types) != 0 && !c.types[e.DeviceType] && !c.types[e.EventType] {
+		return false
+	}
+	return true
+}
+
+func (c *wsClient) apply(r wsRequest) error {
+	switch r.Action {
+	case "subscribe":
+		for _, ns := range r.Namespaces {
+			c.namespaces[ns] = true
+			delete(c.excludeNamespaces, ns)
+		}
+		for _, e := range r.Events {
+			c.types[e] = true
+			delete(c.excludeTypes, e)
+		}
+	case "unsubscribe":
+		for _, ns := range r.Namespaces {
+			delete(c.namespaces, ns)
+			c.excludeNamespaces[ns] = true
+		}
+		for _, e := range r.Events {
+			delete(c.types, e)
+			c.excludeTypes[e] = true
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
+
+func (c *wsClient) subscription() wsSubscription {
+	keys := func(m map[string]bool) []string {
+		k := make([]string, 0, len(m))
+		for key := range m {
+			k = append(k, key)
+		}
+		return k
+	}
+	return wsSubscription{
+		Namespaces:        keys(c.namespaces),
+		Events:            keys(c.types),
+		ExcludeNamespaces: keys(c.excludeNamespaces),
+		ExcludeEvents:     keys(c.excludeTypes),
+	}
+}
+
+var wsClients = struct {
+	sync.Mutex
+	m map[*wsClient]bool
+}{m: make(map[*wsClient]bool)}
+
+// publishWS queues e for every interested client without blocking. A client
+// whose queue is full is dropped so that a slow reader never stalls the
+// device and namespace goroutines firing events.
+func publishWS(e WsEvents) {
+	wsClients.Lock()
+	defer wsClients.Unlock()
+	var msg []byte
+	for c := range wsClients.m {
+		if !c.wants(e) {
+			continue
+		}
+		if msg == nil {
+			var err error
+			if msg, err = encodeWS(e); err != nil {
+				fmt.Println("ERROR: ENCODING WS EVENT", e.EventType, err)
+				return
+			}
+		}
+		select {
+		case c.events <- msg:
+		default:
+			fmt.Println("WS: dropping slow client", c.conn.RemoteAddr())
+			removeWsClient(c)
+		}
+	}
+}
+
+// encodeWS encodes e as the event is fired, holding the topology state
+// still, since the objects it carries keep changing after.
+func encodeWS(e WsEvents) ([]byte, error) {
+	var msg []byte
+	var err error
+	topology.ReadState(func() {
+		msg, err = json.Marshal(e)
+	})
+	return msg, err
+}
+
+// removeWsClient must be called with wsClients locked.
+func removeWsClient(c *wsClient) {
+	if _, ok := wsClients.m[c]; ok {
+		delete(wsClients.m, c)
+		close(c.events)
+	}
+}
+
+func (c *wsClient) writeEvents() {
+	defer c.conn.Close()
+	for msg := range c.events {
+		c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			fmt.Println("WS: writing to", c.conn.RemoteAddr(), err)
+			wsClients.Lock()
+			removeWsClient(c)
+			wsClients.Unlock()
+			for range c.events {
+			}
+			return
+		}
+	}
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteTimeout))
+}
+
+func (c *wsClient) readRequests() {
+	for {
+		var r wsRequest
+		if err := c.conn.ReadJSON(&r); err != nil {
+			wsClients.Lock()
+			removeWsClient(c)
+			wsClients.Unlock()
+			return
+		}
+		wsClients.Lock()
+		e := WsEvents{DeviceType: "subscription", EventType: "update"}
+		if err := c.apply(r); err != nil {
+			e.EventType = "error"
+			e.EventData = err.Error()
+		} else {
+			e.EventData = c.subscription()
+		}
+		msg, err := json.Marshal(e)
+		if _, ok := wsClients.m[c]; ok && err == nil {
+			select {
+			case c.events <- msg:
+			default:
+				removeWsClient(c)
+			}
+		}
+		wsClients.Unlock()
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+func serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Println("ERROR: WS UPGRADE", err)
+		return
+	}
+	c := newWsClient(conn)
+	snapshot, err := json.Marshal(WsEvents{
+		DeviceType: "topology",
+		EventType:  "snapshot",
+		EventData:  topology.Snapshot(),
+	})
+	if err != nil {
+		fmt.Println("ERROR: ENCODING SNAPSHOT", err)
+		conn.Close()
+		return
+	}
+	wsClients.Lock()
+	c.events <- snapshot
+	wsClients.m[c] = true
+	wsClients.Unlock()
+	go c.writeEvents()
+	go c.readRequests()
+}
+
+func registerWS(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", serveWS)
+	registerAPI(mux)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Println("ERROR: WS SERVER", err)
+	}
+}
+
+func subscribeWSEvents() {
+	devices.SubscribeAllNamespaceEvents(defaultNSWSCallback())
+	devices.SubscribeAllL2DeviceEvents(defaultL2WSCallback())
+	devices.SubscribeAllL2BridgeEvents(defaultBridgeWSCallback())
+	devices.SubscribeAllL2BondEvents(defaultBondWSCallback())
+	devices.SubscribeAllVethEvents(defaultVethWSCallback())
+	devices.SubscribeAllVlanEvents(defaultVlanWSCallback())
+	devices.SubscribeAllMacvlanEvents(defaultMacvlanWSCallback())
+	devices.SubscribeAllIpvlanEvents(defaultIpvlanWSCallback())
+	devices.SubscribeAllTunnelEvents(defaultTunnelWSCallback())
+	devices.SubscribeAllTuntapEvents(defaultTuntapWSCallback())
+	devices.SubscribeAllWireGuardEvents(defaultWireGuardWSCallback())
+	devices.SubscribeAllVrfEvents(defaultVrfWSCallback())
+	devices.SubscribeAllEdgeEvents(defaultEdgeWSCallback())
+	devices.SubscribeAllSegmentEvents(defaultSegmentWSCallback())
+	devices.SubscribeAllReachabilityEvents(defaultReachabilityWSCallback())
+	devices.SubscribeAllL3DeviceEvents(defaultL3WSCallback())
+}
+
+func defaultNSWSCallback() func(namespace *devices.Namespace, event devices.NSEvent, item interface{}) {
+	getKeys := func(m map[string]string) []string {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			z := strings.Split(k, ":")
+			keys = append(keys, z[0])
+		}
+		return keys
+	}
+
+	callback := func(namespace *devices.Namespace, event devices.NSEvent, item interface{}) {
+		temp := make(map[string]interface{})
+		temp["name"] = namespace.Name
+		topology.ReadState(func() {
+			temp["peer"] = getKeys(namespace.Connections)
+			temp["route"] = append([]*devices.Route(nil), namespace.Routes...)
+			temp["mode"] = namespace.Type
+		})
+		temp["nsids"] = namespace.Nsids()
+		switch item := item.(type) {
+		case *devices.Route:
+			temp["changedRoute"] = item
+		case *devices.Rule:
+			temp["changedRule"] = item
+		case *devices.Nexthop:
+			temp["changedNexthop"] = item
+		}
+		publishWS(WsEvents{
+			DeviceType: "namespace",
+			EventData:  temp,
+			EventType:  event.String(),
+			Namespace:  namespace.Name,
+		})
+	}
+	return callback
+}
+
+func defaultL2WSCallback() func(dev devices.L2Device, event devices.L2Event) {
+	return func(dev devices.L2Device, event devices.L2Event) {
+		publishWS(WsEvents{
+			DeviceType: "l2device",
+			EventData:  dev,
+			EventType:  event.String(),
+			Namespace:  dev.Namespace,
+		})
+	}
+}
+
+func defaultBridgeWSCallback() func(dev devices.L2Bridge, event devices.L2BridgeEvent, item interface{}) {
+	return func(dev devices.L2Bridge, event devices.L2BridgeEvent, item interface{}) {
+		publishWS(WsEvents{
+			DeviceType: "bridge",
+			EventData:  dev,
+			Item:       item,
+			EventType:  event.String(),
+			Namespace:  dev.Namespace,
+		})
+	}
+}
+
+func defaultBondWSCallback() func(dev *devices.L2Bond, event devices.L2BondEvent, item interface{}) {
+	return func(dev *devices.L2Bond, event devices.L2BondEvent, item interface{}) {
+		publishWS(WsEvents{
+			DeviceType: "bond",
+			EventData:  dev,
+			Item:       item,
+			EventType:  event.String(),
+			Namespace:  dev.Namespace,
+		})
+	}
+}
+
+func defaultVethWSCallback() func(veth *devices.Veth, event devices.VethEvent) {
+	return func(veth *devices.Veth, event devices.VethEvent) {
+		publishWS(WsEvents{
+			DeviceType: "veth",
+			EventData:  veth,
+			EventType:  event.String(),
+			Namespace:  veth.Namespace,
+		})
+	}
+}
+
+func defaultVlanWSCallback() func(vlan *devices.VlanDevice, event devices.VlanEvent) {
+	return func(vlan *devices.VlanDevice, event devices.VlanEvent) {
+		publishWS(WsEvents{
+			DeviceType: "vlan",
+			EventData:  vlan,
+			EventType:  event.String(),
+			Namespace:  vlan.Namespace,
+		})
+	}
+}
+
+func defaultMacvlanWSCallback() func(macvlan *devices.Macvlan, event devices.MacvlanEvent) {
+	return func(macvlan *devices.Macvlan, event devices.MacvlanEvent) {
+		publishWS(WsEvents{
+			DeviceType: "macvlan",
+			EventData:  macvlan,
+			EventType:  event.String(),
+			Namespace:  macvlan.Namespace,
+		})
+	}
+}
+
+func defaultIpvlanWSCallback() func(ipvlan *devices.Ipvlan, event devices.IpvlanEvent) {
+	return func(ipvlan *devices.Ipvlan, event devices.IpvlanEvent) {
+		publishWS(WsEvents{
+			DeviceType: "ipvlan",
+			EventData:  ipvlan,
+			EventType:  event.String(),
+			Namespace:  ipvlan.Namespace,
+		})
+	}
+}
+
+func defaultTunnelWSCallback() func(tunnel *devices.Tunnel, event devices.TunnelEvent) {
+	return func(tunnel *devices.Tunnel, event devices.TunnelEvent) {
+		publishWS(WsEvents{
+			DeviceType: "tunnel",
+			EventData:  tunnel,
+			EventType:  event.String(),
+			Namespace:  tunnel.Namespace,
+		})
+	}
+}
+
+func defaultTuntapWSCallback() func(tap *devices.Tuntap, event devices.TuntapEvent) {
+	return func(tap *devices.Tuntap, event devices.TuntapEvent) {
+		publishWS(WsEvents{
+			DeviceType: "tuntap",
+			EventData:  tap,
+			EventType:  event.String(),
+			Namespace:  tap.Namespace,
+		})
+	}
+}
+
+func defaultWireGuardWSCallback() func(wg *devices.WireGuard, event devices.WireGuardEvent, item interface{}) {
+	return func(wg *devices.WireGuard, event devices.WireGuardEvent, item interface{}) {
+		publishWS(WsEvents{
+			DeviceType: "wireguard",
+			EventData:  wg,
+			Item:       item,
+			EventType:  event.String(),
+			Namespace:  wg.Namespace,
+		})
+	}
+}
+
+func defaultVrfWSCallback() func(vrf *devices.Vrf, event devices.VrfEvent, item interface{}) {
+	return func(vrf *devices.Vrf, event devices.VrfEvent, item interface{}) {
+		publishWS(WsEvents{
+			DeviceType: "vrf",
+			EventData:  vrf,
+			Item:       item,
+			EventType:  event.String(),
+			Namespace:  vrf.Namespace,
+		})
+	}
+}
+
+// defaultEdgeWSCallback publishes edges under the namespace of their To end,
+// which is the device that declares the relation, or of their From end for
+// edges to external nodes.
+func defaultEdgeWSCallback() func(edge devices.Edge, event devices.EdgeEvent) {
+	return func(edge devices.Edge, event devices.EdgeEvent) {
+		publishWS(WsEvents{
+			DeviceType: "edge",
+			EventData:  edge,
+			EventType:  event.String(),
+			Namespace:  edgeNamespace(edge),
+		})
+	}
+}
+
+func edgeNamespace(edge devices.Edge) string {
+	ns := strings.SplitN(edge.To, ":", 2)[0]
+	if ns == devices.ExternalNamespace {
+		ns = strings.SplitN(edge.From, ":", 2)[0]
+	}
+	return ns
+}
+
+// defaultSegmentWSCallback publishes segments without a namespace, since a
+// segment may span several.
+func defaultSegmentWSCallback() func(segment *devices.Segment, event devices.SegmentEvent, item interface{}) {
+	return func(segment *devices.Segment, event devices.SegmentEvent, item interface{}) {
+		publishWS(WsEvents{
+			DeviceType: "segment",
+			EventData:  segment,
+			Item:       item,
+			EventType:  event.String(),
+		})
+	}
+}
+
+// defaultReachabilityWSCallback publishes a pair under the namespace the
+// path starts from.
+func defaultReachabilityWSCallback() func(r *devices.Reachability, event devices.ReachabilityEvent) {
+	return func(r *devices.Reachability, event devices.ReachabilityEvent) {
+		publishWS(WsEvents{
+			DeviceType: "reachability",
+			EventData:  r,
+			EventType:  event.String(),
+			Namespace:  r.From,
+		})
+	}
+}
+
+func defaultL3WSCallback() func(device *devices.L3Device, event devices.L3DeviceEvent, item interface{}) {
+	return func(device *devices.L3Device, event devices.L3DeviceEvent, item interface{}) {
+		t := make(map[string]interface{})
+		t["index"] = device.Index
+		t["addresses"] = device.IP
+		t["allowedIPs"] = device.AllowedIPs
+		t["neighbors"] = device.Neighbors
+		publishWS(WsEvents{
+			DeviceType: "l3device",
+			EventData:  t,
+			Item:       item,
+			EventType:  event.String(),
+			Namespace:  device.Namespace,
+		})
+	}
+}